@@ -0,0 +1,268 @@
+package cassandra
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+
+	"github.com/douban/gobeansproxy/config"
+	"github.com/gocql/gocql"
+	"gopkg.in/yaml.v3"
+)
+
+const CfgChangeImport = "import"
+
+// DispatcherCfgs is the merged static and c* cfg of prefix dispatchers,
+// in the same {value: [prefix...]} format as static cfg in proxy.yaml.
+// A nil dispatcher cfg is left untouched by import.
+type DispatcherCfgs struct {
+	RWSwitcher  map[string][]string `yaml:"rwswitcher,omitempty" json:"rwswitcher,omitempty"`
+	TableFinder map[string][]string `yaml:"tablefinder,omitempty" json:"tablefinder,omitempty"`
+}
+
+// CfgImportPlan is the changes of cfg tables to apply by import
+type CfgImportPlan struct {
+	RWSwitcher  []*CfgChange `json:"rwswitcher"`
+	TableFinder []*CfgChange `json:"tablefinder"`
+
+	rwCfg       DisPatcherCfg
+	tableCfg    DisPatcherCfg
+	switcher    *PrefixSwitcher
+	transitions []*PrefixTransition
+	op          SwitchOperator
+}
+
+func (p *CfgImportPlan) Empty() bool {
+	return len(p.RWSwitcher) == 0 && len(p.TableFinder) == 0
+}
+
+// ParseDispatcherCfgs parse exported cfg in yaml or json
+func ParseDispatcherCfgs(b []byte) (*DispatcherCfgs, error) {
+	cfgs := new(DispatcherCfgs)
+	if err := yaml.Unmarshal(b, cfgs); err != nil {
+		return nil, fmt.Errorf("parse dispatcher cfg err: %s", err)
+	}
+	return cfgs, nil
+}
+
+// Marshal encode cfgs in format yaml or json
+func (c *DispatcherCfgs) Marshal(format string) ([]byte, error) {
+	switch format {
+	case "yaml", "":
+		return yaml.Marshal(c)
+	case "json":
+		return json.MarshalIndent(c, "", "  ")
+	}
+	return nil, fmt.Errorf("unsupported format %s, must be yaml/json", format)
+}
+
+// groupByValue convert {prefix: value} to {value: [prefix...]}
+func groupByValue(m map[string]string) map[string][]string {
+	r := make(map[string][]string)
+	for p, v := range m {
+		r[v] = append(r[v], p)
+	}
+	for _, prefixes := range r {
+		sort.Strings(prefixes)
+	}
+	return r
+}
+
+// ExportCfg return the cfg loaded by switcher and finder if enabled in cfg
+func ExportCfg(cfg *config.CassandraStoreCfg, switcher *PrefixSwitcher, finder *KeyTableFinder) *DispatcherCfgs {
+	cfgs := new(DispatcherCfgs)
+	if switcher != nil && cfg.PrefixRWDispatcherCfg.Enable {
+		switcher.lock.RLock()
+		cfgs.RWSwitcher = groupByValue(switcher.currentTrieMap)
+		switcher.lock.RUnlock()
+	}
+	if finder != nil && cfg.PrefixTableDispatcherCfg.Enable {
+		finder.lock.RLock()
+		cfgs.TableFinder = groupByValue(finder.currentMap)
+		finder.lock.RUnlock()
+	}
+	return cfgs
+}
+
+// desiredCfgMap convert {value: [prefix...]} to {prefix: value}, values are
+// normalized by normalize
+func desiredCfgMap(data map[string][]string, normalize func(string) (string, error)) (map[string]string, error) {
+	m := make(map[string]string)
+	for v, prefixes := range data {
+		nv, err := normalize(v)
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range prefixes {
+			if old, ok := m[p]; ok && old != nv {
+				return nil, fmt.Errorf("prefix %s is set to both %s and %s", p, old, nv)
+			}
+			m[p] = nv
+		}
+	}
+	return m, nil
+}
+
+// planDispatcherImport diff current cfg with the desired one, prefixes in
+// static cfg can not be changed by the cfg table
+func planDispatcherImport(
+	name string, dc DisPatcherCfg, current map[string]string,
+	desired map[string]string) ([]*CfgChange, error) {
+	if !dc.Enable {
+		return nil, fmt.Errorf("%s is disabled", name)
+	}
+	if !dc.historyEnabled() {
+		return nil, fmt.Errorf("%s requires cfg_keyspace and cfg_table to import", name)
+	}
+	static := map[string]string{}
+	for v, prefixes := range dc.StaticCfg {
+		for _, p := range prefixes {
+			static[p] = v
+		}
+	}
+	changes := diffCfgMap(current, desired)
+	for _, ch := range changes {
+		if _, ok := static[ch.Prefix]; ok {
+			return nil, fmt.Errorf("%s prefix %s is set in proxy.yaml, can not be changed to %q",
+				name, ch.Prefix, ch.New)
+		}
+		ch.Table = dc.CfgFromCstarTable
+		ch.Op = CfgChangeImport
+	}
+	return changes, nil
+}
+
+func normalizeSwitchRule(v string) (string, error) {
+	r, err := parseSwitchRule(v)
+	if err != nil {
+		return "", fmt.Errorf("%s is not a validate rwstatus: %s", v, err)
+	}
+	if r.From < 0 {
+		return "", fmt.Errorf("rollout %s must be <from>-><to>@<percent> to import", v)
+	}
+	return r.String(), nil
+}
+
+func normalizeTable(v string) (string, error) {
+	if v == "" {
+		return "", fmt.Errorf("empty table name")
+	}
+	return v, nil
+}
+
+// PlanImport validate data and return the changes to make the cfg of
+// switcher and finder the same as data. cfg is the static cfg in proxy.yaml.
+func PlanImport(
+	cfg *config.CassandraStoreCfg, switcher *PrefixSwitcher, finder *KeyTableFinder,
+	data *DispatcherCfgs, op SwitchOperator) (*CfgImportPlan, error) {
+	plan := &CfgImportPlan{
+		RWSwitcher:  []*CfgChange{},
+		TableFinder: []*CfgChange{},
+		rwCfg:       DisPatcherCfg(cfg.PrefixRWDispatcherCfg),
+		tableCfg:    DisPatcherCfg(cfg.PrefixTableDispatcherCfg),
+		switcher:    switcher,
+		op:          op,
+	}
+
+	if data.RWSwitcher != nil {
+		if switcher == nil {
+			return nil, fmt.Errorf("rwswitcher is disabled")
+		}
+		desired, err := desiredCfgMap(data.RWSwitcher, normalizeSwitchRule)
+		if err != nil {
+			return nil, err
+		}
+		switcher.lock.RLock()
+		current := switcher.currentTrieMap
+		switcher.lock.RUnlock()
+		plan.RWSwitcher, err = planDispatcherImport("rwswitcher", plan.rwCfg, current, desired)
+		if err != nil {
+			return nil, err
+		}
+
+		upserts := map[string][]string{}
+		for _, ch := range plan.RWSwitcher {
+			if ch.New == "" {
+				t, err := switcher.checkDelete(ch.Prefix, op)
+				if err != nil {
+					return nil, err
+				}
+				plan.transitions = append(plan.transitions, t)
+			} else {
+				upserts[ch.New] = append(upserts[ch.New], ch.Prefix)
+			}
+		}
+		_, transitions, err := switcher.checkUpsert(upserts, op)
+		if err != nil {
+			return nil, err
+		}
+		plan.transitions = append(plan.transitions, transitions...)
+	}
+
+	if data.TableFinder != nil {
+		if finder == nil {
+			return nil, fmt.Errorf("tablefinder is disabled")
+		}
+		desired, err := desiredCfgMap(data.TableFinder, normalizeTable)
+		if err != nil {
+			return nil, err
+		}
+		finder.lock.RLock()
+		current := finder.currentMap
+		finder.lock.RUnlock()
+		plan.TableFinder, err = planDispatcherImport("tablefinder", plan.tableCfg, current, desired)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return plan, nil
+}
+
+func (c *DisPatcherCfg) addToBatch(batch *gocql.Batch, changes []*CfgChange) {
+	for _, ch := range changes {
+		if ch.New == "" {
+			batch.Query(
+				fmt.Sprintf("delete from %s.%s where prefix = ?", c.CfgFromCstarKeySpace, c.CfgFromCstarTable),
+				ch.Prefix,
+			)
+		} else {
+			batch.Query(
+				fmt.Sprintf("insert into %s.%s (prefix, value) values (?, ?)", c.CfgFromCstarKeySpace, c.CfgFromCstarTable),
+				ch.Prefix, ch.New,
+			)
+		}
+	}
+}
+
+// ApplyImport write all changes of plan to cfg tables in a logged batch,
+// so either all or none of them are applied. Dispatchers should be reloaded after it.
+func ApplyImport(plan *CfgImportPlan, cqlStore *CassandraStore) error {
+	if plan.Empty() {
+		return nil
+	}
+	apply := func() error {
+		batch := cqlStore.session.NewBatch(gocql.LoggedBatch)
+		plan.rwCfg.addToBatch(batch, plan.RWSwitcher)
+		plan.tableCfg.addToBatch(batch, plan.TableFinder)
+		if err := cqlStore.session.ExecuteBatch(batch); err != nil {
+			return fmt.Errorf("import cfg err: %s", err)
+		}
+		return nil
+	}
+	// record history of changed tables
+	if len(plan.RWSwitcher) > 0 {
+		inner := apply
+		apply = func() error { return plan.rwCfg.withHistory(CfgChangeImport, plan.op, cqlStore, inner) }
+	}
+	if len(plan.TableFinder) > 0 {
+		inner := apply
+		apply = func() error { return plan.tableCfg.withHistory(CfgChangeImport, plan.op, cqlStore, inner) }
+	}
+	if err := apply(); err != nil {
+		return err
+	}
+	if plan.switcher != nil {
+		plan.switcher.recordTransitions(plan.rwCfg, cqlStore, plan.transitions...)
+	}
+	return nil
+}
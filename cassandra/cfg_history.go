@@ -0,0 +1,268 @@
+package cassandra
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/douban/gobeansproxy/config"
+	"github.com/gocql/gocql"
+)
+
+// changes of a cfg table are appended to this table in the same keyspace,
+// see conf/cfg_history.cql
+const cfgHistoryTable = "cfg_history"
+
+const (
+	CfgChangeUpsert   = "upsert"
+	CfgChangeDelete   = "delete"
+	CfgChangeRollback = "rollback"
+	CfgChangeActivate = "activate"
+)
+
+// CfgChange is a change of one prefix in a cfg table, Old or New is empty
+// if the prefix is added or deleted
+type CfgChange struct {
+	ID     string    `json:"id"`
+	Table  string    `json:"table"`
+	Prefix string    `json:"prefix"`
+	Op     string    `json:"op"`
+	Old    string    `json:"old"`
+	New    string    `json:"new"`
+	Who    string    `json:"who"`
+	Client string    `json:"client"`
+	When   time.Time `json:"when"`
+}
+
+// dispatcherCfgOf return the cfg table of dispatcher d
+func dispatcherCfgOf(d PrefixDisPatcher, cfg *config.CassandraStoreCfg) (DisPatcherCfg, error) {
+	switch d.(type) {
+	case *PrefixSwitcher:
+		return DisPatcherCfg(cfg.PrefixRWDispatcherCfg), nil
+	case *KeyTableFinder:
+		return DisPatcherCfg(cfg.PrefixTableDispatcherCfg), nil
+	}
+	return DisPatcherCfg{}, fmt.Errorf("unsupported dispatcher %T", d)
+}
+
+func (c *DisPatcherCfg) loadDBMap(cqlStore *CassandraStore) (map[string]string, error) {
+	pkeys, pvalues, err := c.LoadFromDB(cqlStore)
+	if err != nil {
+		return nil, err
+	}
+	m := make(map[string]string, len(pkeys))
+	for idx, k := range pkeys {
+		m[string(k)] = pvalues[idx]
+	}
+	return m, nil
+}
+
+// diffCfgMap return changes from before to after ordered by prefix
+func diffCfgMap(before, after map[string]string) []*CfgChange {
+	changes := []*CfgChange{}
+	for p, v := range after {
+		if old, ok := before[p]; !ok || old != v {
+			changes = append(changes, &CfgChange{Prefix: p, Old: before[p], New: v})
+		}
+	}
+	for p, v := range before {
+		if _, ok := after[p]; !ok {
+			changes = append(changes, &CfgChange{Prefix: p, Old: v})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Prefix < changes[j].Prefix })
+	return changes
+}
+
+// withHistory run change on the cfg table, and append what is changed by it
+// to the history table as op
+func (c *DisPatcherCfg) withHistory(
+	op string, who SwitchOperator, cqlStore *CassandraStore, change func() error) error {
+	if !c.historyEnabled() {
+		return change()
+	}
+	before, err := c.loadDBMap(cqlStore)
+	if err != nil {
+		return err
+	}
+	changeErr := change()
+	after, err := c.loadDBMap(cqlStore)
+	if err != nil {
+		if changeErr != nil {
+			return changeErr
+		}
+		return fmt.Errorf("load cfg for history err: %s", err)
+	}
+
+	for _, ch := range diffCfgMap(before, after) {
+		id := gocql.TimeUUID()
+		err := cqlStore.session.Query(
+			fmt.Sprintf(
+				"insert into %s.%s (cfg_table, id, prefix, op, old_value, new_value, who, client) "+
+					"values (?, ?, ?, ?, ?, ?, ?, ?)",
+				c.CfgFromCstarKeySpace, cfgHistoryTable,
+			), c.CfgFromCstarTable, id, ch.Prefix, op, ch.Old, ch.New, who.Who, who.Client,
+		).Exec()
+		if err != nil {
+			logger.Errorf("append cfg history %s %s -> %s err: %s", ch.Prefix, ch.Old, ch.New, err)
+		}
+	}
+	return changeErr
+}
+
+func (c *DisPatcherCfg) queryHistory(
+	cqlStore *CassandraStore, where string, args ...interface{}) ([]*CfgChange, error) {
+	r := cqlStore.session.Query(
+		fmt.Sprintf(
+			"select id, prefix, op, old_value, new_value, who, client from %s.%s where cfg_table = ?%s",
+			c.CfgFromCstarKeySpace, cfgHistoryTable, where,
+		), append([]interface{}{c.CfgFromCstarTable}, args...)...,
+	).Iter().Scanner()
+
+	changes := []*CfgChange{}
+	for r.Next() {
+		var id gocql.UUID
+		ch := &CfgChange{Table: c.CfgFromCstarTable}
+		if err := r.Scan(&id, &ch.Prefix, &ch.Op, &ch.Old, &ch.New, &ch.Who, &ch.Client); err != nil {
+			return nil, fmt.Errorf("scan cfg history err: %s", err)
+		}
+		ch.ID = id.String()
+		ch.When = id.Time()
+		changes = append(changes, ch)
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("list cfg history err: %s", err)
+	}
+	return changes, nil
+}
+
+// ListCfgHistory return changes of the cfg table of d, newest first
+func ListCfgHistory(
+	d PrefixDisPatcher, cfg *config.CassandraStoreCfg,
+	limit int, cqlStore *CassandraStore) ([]*CfgChange, error) {
+	dc, err := dispatcherCfgOf(d, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !dc.historyEnabled() {
+		return nil, fmt.Errorf("cfg history requires cfg_keyspace and cfg_table")
+	}
+	return dc.queryHistory(cqlStore, " limit ?", limit)
+}
+
+// UpsertCfg upsert prefixes of d and record the changes in history
+func UpsertCfg(
+	d PrefixDisPatcher, cfg *config.CassandraStoreCfg, data map[string][]string,
+	cqlStore *CassandraStore, op SwitchOperator) error {
+	dc, err := dispatcherCfgOf(d, cfg)
+	if err != nil {
+		return err
+	}
+	return dc.withHistory(CfgChangeUpsert, op, cqlStore, func() error {
+		return upsertBy(d, cfg, data, cqlStore, op)
+	})
+}
+
+// DeleteCfg delete prefix of d and record the change in history
+func DeleteCfg(
+	d PrefixDisPatcher, cfg *config.CassandraStoreCfg, prefix string,
+	cqlStore *CassandraStore, op SwitchOperator) error {
+	dc, err := dispatcherCfgOf(d, cfg)
+	if err != nil {
+		return err
+	}
+	return dc.withHistory(CfgChangeDelete, op, cqlStore, func() error {
+		return deleteBy(d, cfg, prefix, cqlStore, op)
+	})
+}
+
+// RollbackCfg restore the cfg table of d as it was right after the change id,
+// by undoing all changes newer than it. Only the cfg table is restored,
+// prefixes in proxy.yaml are not changed.
+func RollbackCfg(
+	d PrefixDisPatcher, cfg *config.CassandraStoreCfg, id string,
+	cqlStore *CassandraStore, op SwitchOperator) ([]*CfgChange, error) {
+	dc, err := dispatcherCfgOf(d, cfg)
+	if err != nil {
+		return nil, err
+	}
+	if !dc.historyEnabled() {
+		return nil, fmt.Errorf("cfg history requires cfg_keyspace and cfg_table")
+	}
+	uuid, err := gocql.ParseUUID(id)
+	if err != nil {
+		return nil, fmt.Errorf("bad history id %s: %s", id, err)
+	}
+	if found, err := dc.queryHistory(cqlStore, " and id = ?", uuid); err != nil {
+		return nil, err
+	} else if len(found) == 0 {
+		return nil, fmt.Errorf("history %s not found in %s", id, dc.CfgFromCstarTable)
+	}
+	newer, err := dc.queryHistory(cqlStore, " and id > ?", uuid)
+	if err != nil {
+		return nil, err
+	}
+	current, err := dc.loadDBMap(cqlStore)
+	if err != nil {
+		return nil, err
+	}
+
+	changes := diffCfgMap(current, undoCfgChanges(current, newer))
+	upserts := map[string][]string{}
+	for _, ch := range changes {
+		if ch.New != "" {
+			upserts[ch.New] = append(upserts[ch.New], ch.Prefix)
+		}
+	}
+	err = dc.withHistory(CfgChangeRollback, op, cqlStore, func() error {
+		if len(upserts) > 0 {
+			if err := upsertBy(d, cfg, upserts, cqlStore, op); err != nil {
+				return err
+			}
+		}
+		for _, ch := range changes {
+			if ch.New == "" {
+				if err := deleteBy(d, cfg, ch.Prefix, cqlStore, op); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	return changes, err
+}
+
+// undoCfgChanges return cfg m with changes (newest first) undone
+func undoCfgChanges(m map[string]string, changes []*CfgChange) map[string]string {
+	r := make(map[string]string, len(m))
+	for p, v := range m {
+		r[p] = v
+	}
+	for _, ch := range changes {
+		if ch.Old == "" {
+			delete(r, ch.Prefix)
+		} else {
+			r[ch.Prefix] = ch.Old
+		}
+	}
+	return r
+}
+
+// upsertBy validate the transitions by op if d is the prefix switcher
+func upsertBy(
+	d PrefixDisPatcher, cfg *config.CassandraStoreCfg, data map[string][]string,
+	cqlStore *CassandraStore, op SwitchOperator) error {
+	if s, ok := d.(*PrefixSwitcher); ok {
+		return s.UpsertBy(cfg, data, cqlStore, op)
+	}
+	return d.Upsert(cfg, data, cqlStore)
+}
+
+func deleteBy(
+	d PrefixDisPatcher, cfg *config.CassandraStoreCfg, prefix string,
+	cqlStore *CassandraStore, op SwitchOperator) error {
+	if s, ok := d.(*PrefixSwitcher); ok {
+		return s.DeletePrefixBy(cfg, prefix, cqlStore, op)
+	}
+	return d.DeletePrefix(cfg, prefix, cqlStore)
+}
@@ -0,0 +1,94 @@
+package cassandra
+
+import (
+	"fmt"
+	"hash/fnv"
+	"sort"
+	"time"
+
+	"github.com/douban/gobeansproxy/config"
+)
+
+// cfgVersion is the hash of prefix cfg m and other cfg in extra,
+// proxies loaded the same cfg have the same version
+func cfgVersion(m map[string]string, extra ...string) uint32 {
+	prefixes := make([]string, 0, len(m))
+	for p := range m {
+		prefixes = append(prefixes, p)
+	}
+	sort.Strings(prefixes)
+
+	h := fnv.New32a()
+	for _, p := range prefixes {
+		fmt.Fprintf(h, "%s=%s\n", p, m[p])
+	}
+	for _, e := range extra {
+		fmt.Fprintf(h, "%s\n", e)
+	}
+	return h.Sum32()
+}
+
+// loadDispatcherMap load prefix -> value from static cfg and c* cfg table
+// as getTableTrieFromCfg and GetPrefixSwitchTrieFromCfg, without building trie
+func loadDispatcherMap(c config.PrefixDisPatcherCfg, cqlStore *CassandraStore) (map[string]string, error) {
+	m := map[string]string{}
+	if !c.Enable {
+		return m, nil
+	}
+	if c.CfgFromCstarTable != "" && c.CfgFromCstarKeySpace != "" {
+		dc := DisPatcherCfg(c)
+		pkeys, pvalues, err := dc.LoadFromDB(cqlStore)
+		if err != nil {
+			return nil, err
+		}
+		for idx, k := range pkeys {
+			m[string(k)] = pvalues[idx]
+		}
+	}
+	for v, prefixes := range c.StaticCfg {
+		for _, p := range prefixes {
+			m[p] = v
+		}
+	}
+	return m, nil
+}
+
+func switcherCfgVersion(m map[string]string, cfg *config.CassandraStoreCfg) uint32 {
+	return cfgVersion(m, cfg.SwitchToKeyDefault)
+}
+
+func tableFinderCfgVersion(m map[string]string, cfg *config.CassandraStoreCfg) uint32 {
+	return cfgVersion(m, cfg.DefaultTable, fmt.Sprint(cfg.PrefixTTLCfg))
+}
+
+// CfgVersion return version of the cfg loaded and when it is loaded
+func (s *PrefixSwitcher) CfgVersion() (uint32, time.Time) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.version, s.loadedAt
+}
+
+// RemoteCfgVersion return version of cfg in cfg and the c* cfg table
+func (s *PrefixSwitcher) RemoteCfgVersion(cfg *config.CassandraStoreCfg, cqlStore *CassandraStore) (uint32, error) {
+	m, err := loadDispatcherMap(cfg.PrefixRWDispatcherCfg, cqlStore)
+	if err != nil {
+		return 0, err
+	}
+	return switcherCfgVersion(m, cfg), nil
+}
+
+// CfgVersion return version of the cfg loaded and when it is loaded
+func (f *KeyTableFinder) CfgVersion() (uint32, time.Time) {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	return f.version, f.loadedAt
+}
+
+// RemoteCfgVersion return version of cfg in cfg and the c* cfg table
+func (f *KeyTableFinder) RemoteCfgVersion(cfg *config.CassandraStoreCfg, cqlStore *CassandraStore) (uint32, error) {
+	m, err := loadDispatcherMap(cfg.PrefixTableDispatcherCfg, cqlStore)
+	if err != nil {
+		return 0, err
+	}
+	return tableFinderCfgVersion(m, cfg), nil
+}
@@ -0,0 +1,491 @@
+package cassandra
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/douban/gobeansproxy/config"
+	"github.com/gocql/gocql"
+)
+
+// tables in cfg_keyspace of prefix_rw_dispatcher_cfg, see conf/coordinated_switch.cql
+const (
+	heartbeatTable    = "proxy_heartbeat"
+	stagedSwitchTable = "staged_switch"
+	// only one switch is staged at a time
+	stagedSwitchRow = "current"
+
+	StagedPending = "pending"
+	StagedActive  = "active"
+	StagedAborted = "aborted"
+
+	DEFAULT_COORDINATED_SWITCH_INTERVAL = 5 * time.Second
+)
+
+// StagedSwitch is a prefix switch waiting for all alive proxies to load it,
+// Data is {status: [prefix...]} with the from status of rollout filled.
+type StagedSwitch struct {
+	ID         string              `json:"id"`
+	Data       map[string][]string `json:"data"`
+	Who        string              `json:"who"`
+	State      string              `json:"state"`
+	StagedAt   time.Time           `json:"staged_at"`
+	ActivateAt time.Time           `json:"activate_at"`
+	Error      string              `json:"error,omitempty"`
+}
+
+type ProxyHeartbeat struct {
+	Proxy      string    `json:"proxy"`
+	CfgVersion int64     `json:"cfg_version"`
+	Acked      string    `json:"acked"`
+	Applied    string    `json:"applied"`
+	UpdatedAt  time.Time `json:"updated_at"`
+}
+
+type CoordinatedSwitchStatus struct {
+	Staged  *StagedSwitch     `json:"staged"`
+	Proxies []*ProxyHeartbeat `json:"proxies"`
+	Lagging []string          `json:"lagging"`
+	Error   string            `json:"error,omitempty"`
+}
+
+// SwitchCoordinator switch prefixes on all proxies at the same time:
+//  1. a switch is staged as pending in the staged_switch table
+//  2. every proxy heartbeats into proxy_heartbeat, and acks the pending
+//     switch after it validates the switch
+//  3. once all alive proxies acked, one of them activates the switch with
+//     an activate time
+//  4. every proxy writes the switch to the cfg table and reloads it at the
+//     activate time, so a proxy started before it does not load it early
+//
+// cfg reloading of other ways should be held while a switch is in progress.
+type SwitchCoordinator struct {
+	proxy    string
+	confdir  string
+	keyspace string
+	cfgTable DisPatcherCfg
+	interval time.Duration
+	switcher *PrefixSwitcher
+	cqlStore *CassandraStore
+
+	lock      sync.Mutex
+	staged    *StagedSwitch
+	acked     string
+	applied   string
+	scheduled string
+	lastErr   string
+	quit      chan struct{}
+}
+
+func NewSwitchCoordinator(
+	proxy, confdir string, interval time.Duration, cfg *config.CassandraStoreCfg,
+	switcher *PrefixSwitcher, cqlStore *CassandraStore) (*SwitchCoordinator, error) {
+	keyspace := cfg.PrefixRWDispatcherCfg.CfgFromCstarKeySpace
+	if keyspace == "" {
+		return nil, fmt.Errorf("coordinated switch requires cfg_keyspace of prefix_rw_dispatcher_cfg")
+	}
+	if interval <= 0 {
+		interval = DEFAULT_COORDINATED_SWITCH_INTERVAL
+	}
+	c := &SwitchCoordinator{
+		proxy:    proxy,
+		confdir:  confdir,
+		keyspace: keyspace,
+		cfgTable: DisPatcherCfg(cfg.PrefixRWDispatcherCfg),
+		interval: interval,
+		switcher: switcher,
+		cqlStore: cqlStore,
+		quit:     make(chan struct{}),
+	}
+	staged, err := c.getStaged()
+	if err != nil {
+		return nil, err
+	}
+	if staged != nil && staged.State == StagedActive && !time.Now().Before(staged.ActivateAt) {
+		// written to cfg table and loaded in NewPrefixSwitcher already,
+		// otherwise it is applied at the activate time as other proxies
+		c.applied = staged.ID
+	}
+	c.staged = staged
+	return c, nil
+}
+
+func (c *SwitchCoordinator) Run() {
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+	for {
+		c.tick()
+		select {
+		case <-c.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *SwitchCoordinator) Stop() {
+	close(c.quit)
+}
+
+func (c *SwitchCoordinator) setErr(err error) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err != nil {
+		logger.Errorf("coordinated switch err: %s", err)
+		c.lastErr = err.Error()
+	} else {
+		c.lastErr = ""
+	}
+}
+
+func (c *SwitchCoordinator) tick() {
+	staged, err := c.getStaged()
+	if err != nil {
+		c.setErr(err)
+		return
+	}
+	c.lock.Lock()
+	c.staged = staged
+	c.lock.Unlock()
+
+	if staged != nil {
+		switch staged.State {
+		case StagedPending:
+			c.ack(staged)
+		case StagedActive:
+			c.schedule(staged)
+		}
+	}
+
+	if err := c.heartbeat(); err != nil {
+		c.setErr(err)
+		return
+	}
+
+	if staged != nil && staged.State == StagedPending {
+		proxies, err := c.listProxies()
+		if err != nil {
+			c.setErr(err)
+			return
+		}
+		if len(laggingProxies(staged, proxies)) == 0 {
+			if err := c.activate(staged); err != nil {
+				c.setErr(err)
+				return
+			}
+		}
+	}
+	c.setErr(nil)
+}
+
+// ack the pending switch if it is valid
+func (c *SwitchCoordinator) ack(staged *StagedSwitch) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.acked == staged.ID {
+		return
+	}
+	for v := range staged.Data {
+		if r, err := parseSwitchRule(v); err != nil || r.From < 0 {
+			logger.Errorf("staged switch %s has bad status %s, not acked", staged.ID, v)
+			return
+		}
+	}
+	c.acked = staged.ID
+	logger.Infof("staged switch %s acked: %v", staged.ID, staged.Data)
+}
+
+// schedule reloading the cfg table at the activate time of the active switch
+func (c *SwitchCoordinator) schedule(staged *StagedSwitch) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.applied == staged.ID || c.scheduled == staged.ID {
+		return
+	}
+	c.scheduled = staged.ID
+	delay := time.Until(staged.ActivateAt)
+	if delay < 0 {
+		delay = 0
+	}
+	logger.Infof("staged switch %s will be applied in %s", staged.ID, delay)
+	time.AfterFunc(delay, func() { c.apply(staged) })
+}
+
+// apply write the active switch to the cfg table and reload it, every proxy
+// writes the same data so it does not matter which one is the first
+func (c *SwitchCoordinator) apply(staged *StagedSwitch) {
+	now := time.Now()
+	transitions := []*PrefixTransition{}
+	c.switcher.lock.RLock()
+	for v, prefixes := range staged.Data {
+		for _, p := range prefixes {
+			from := c.switcher.currentRuleOf(p, false).String()
+			if from == v {
+				continue
+			}
+			transitions = append(transitions, &PrefixTransition{
+				Prefix: p, From: from, To: v,
+				Who: staged.Who, Client: c.proxy, When: now,
+			})
+		}
+	}
+	c.switcher.lock.RUnlock()
+
+	current, err := c.getStaged()
+	if err == nil && (current == nil || current.ID != staged.ID) {
+		// replaced by a newer switch, which is applied instead
+		c.lock.Lock()
+		c.scheduled = ""
+		c.lock.Unlock()
+		return
+	}
+	if err == nil {
+		op := SwitchOperator{Who: staged.Who, Client: c.proxy}
+		err = c.cfgTable.withHistory(CfgChangeActivate, op, c.cqlStore, func() error {
+			return c.cfgTable.SaveToDB(staged.Data, c.cqlStore)
+		})
+	}
+	if err == nil {
+		var cfg *config.CassandraStoreCfg
+		cfg, err = c.switcher.LoadStaticCfg(c.confdir)
+		if err == nil {
+			err = c.switcher.LoadCfg(cfg, c.cqlStore)
+		}
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if err != nil {
+		// try again in next tick
+		c.scheduled = ""
+		c.lastErr = fmt.Sprintf("apply staged switch %s err: %s", staged.ID, err)
+		logger.Errorf("%s", c.lastErr)
+		return
+	}
+	c.applied = staged.ID
+	c.switcher.recordTransitions(c.cfgTable, c.cqlStore, transitions...)
+	logger.Infof("staged switch %s applied", staged.ID)
+}
+
+// Holding return true if a switch is in progress and not applied here,
+// reloading cfg table during which may switch before other proxies
+func (c *SwitchCoordinator) Holding() bool {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	if c.staged == nil {
+		return false
+	}
+	switch c.staged.State {
+	case StagedPending:
+		return true
+	case StagedActive:
+		return c.applied != c.staged.ID
+	}
+	return false
+}
+
+func (c *SwitchCoordinator) heartbeat() error {
+	c.lock.Lock()
+	acked, applied := c.acked, c.applied
+	c.lock.Unlock()
+	version, _ := c.switcher.CfgVersion()
+
+	ttl := int(3 * c.interval / time.Second)
+	if ttl < 3 {
+		ttl = 3
+	}
+	return c.cqlStore.session.Query(
+		fmt.Sprintf(
+			"insert into %s.%s (proxy, cfg_version, acked, applied, updated_at) values (?, ?, ?, ?, ?) using ttl ?",
+			c.keyspace, heartbeatTable,
+		), c.proxy, int64(version), acked, applied, time.Now(), ttl,
+	).Exec()
+}
+
+// listProxies return proxies alive, i.e. heartbeat rows not expired
+func (c *SwitchCoordinator) listProxies() ([]*ProxyHeartbeat, error) {
+	r := c.cqlStore.session.Query(
+		fmt.Sprintf(
+			"select proxy, cfg_version, acked, applied, updated_at from %s.%s",
+			c.keyspace, heartbeatTable,
+		),
+	).Iter().Scanner()
+
+	proxies := []*ProxyHeartbeat{}
+	for r.Next() {
+		h := new(ProxyHeartbeat)
+		if err := r.Scan(&h.Proxy, &h.CfgVersion, &h.Acked, &h.Applied, &h.UpdatedAt); err != nil {
+			return nil, fmt.Errorf("scan heartbeat err: %s", err)
+		}
+		proxies = append(proxies, h)
+	}
+	if err := r.Err(); err != nil {
+		return nil, fmt.Errorf("list heartbeat err: %s", err)
+	}
+	sort.Slice(proxies, func(i, j int) bool { return proxies[i].Proxy < proxies[j].Proxy })
+	return proxies, nil
+}
+
+func (c *SwitchCoordinator) getStaged() (*StagedSwitch, error) {
+	var data string
+	s := new(StagedSwitch)
+	err := c.cqlStore.session.Query(
+		fmt.Sprintf(
+			"select switch_id, data, who, state, staged_at, activate_at, error from %s.%s where id = ?",
+			c.keyspace, stagedSwitchTable,
+		), stagedSwitchRow,
+	).Scan(&s.ID, &data, &s.Who, &s.State, &s.StagedAt, &s.ActivateAt, &s.Error)
+	if err != nil {
+		if err == gocql.ErrNotFound {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("get staged switch err: %s", err)
+	}
+	if err := json.Unmarshal([]byte(data), &s.Data); err != nil {
+		return nil, fmt.Errorf("bad staged switch data %s: %s", data, err)
+	}
+	return s, nil
+}
+
+// Stage validate and stage a switch of prefixes in data, which is {status: [prefix...]},
+// it fails if another switch is pending
+func (c *SwitchCoordinator) Stage(data map[string][]string, op SwitchOperator) (*StagedSwitch, error) {
+	resolved, _, err := c.switcher.checkUpsert(data, op)
+	if err != nil {
+		return nil, err
+	}
+	b, err := json.Marshal(resolved)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	s := &StagedSwitch{
+		ID:       fmt.Sprintf("%d@%s", now.UnixNano(), c.proxy),
+		Data:     resolved,
+		Who:      op.Who,
+		State:    StagedPending,
+		StagedAt: now,
+	}
+
+	old, err := c.getStaged()
+	if err != nil {
+		return nil, err
+	}
+	var q string
+	args := []interface{}{}
+	if old == nil {
+		q = fmt.Sprintf(
+			"insert into %s.%s (id, switch_id, data, who, state, staged_at, activate_at, error) "+
+				"values (?, ?, ?, ?, ?, ?, ?, '') if not exists",
+			c.keyspace, stagedSwitchTable,
+		)
+		args = append(args, stagedSwitchRow, s.ID, string(b), s.Who, s.State, s.StagedAt, time.Time{})
+	} else {
+		if old.State == StagedPending {
+			return nil, fmt.Errorf("switch %s staged by %s is pending", old.ID, old.Who)
+		}
+		if old.State == StagedActive && now.Before(old.ActivateAt) {
+			return nil, fmt.Errorf("switch %s staged by %s is activating at %s", old.ID, old.Who, old.ActivateAt)
+		}
+		q = fmt.Sprintf(
+			"update %s.%s set switch_id = ?, data = ?, who = ?, state = ?, staged_at = ?, activate_at = ?, error = '' "+
+				"where id = ? if switch_id = ?",
+			c.keyspace, stagedSwitchTable,
+		)
+		args = append(args, s.ID, string(b), s.Who, s.State, s.StagedAt, time.Time{}, stagedSwitchRow, old.ID)
+	}
+	applied, err := c.cqlStore.session.Query(q, args...).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return nil, fmt.Errorf("stage switch err: %s", err)
+	}
+	if !applied {
+		return nil, fmt.Errorf("another switch is staged at the same time, try again")
+	}
+	logger.Infof("switch %s staged by %s: %v", s.ID, s.Who, resolved)
+	return s, nil
+}
+
+// activate the pending switch if no other proxy did, it is written to the
+// cfg table at the activate time by apply
+func (c *SwitchCoordinator) activate(staged *StagedSwitch) error {
+	activateAt := time.Now().Add(2 * c.interval)
+	applied, err := c.cqlStore.session.Query(
+		fmt.Sprintf(
+			"update %s.%s set state = ?, activate_at = ? where id = ? if state = ? and switch_id = ?",
+			c.keyspace, stagedSwitchTable,
+		), StagedActive, activateAt, stagedSwitchRow, StagedPending, staged.ID,
+	).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return fmt.Errorf("activate staged switch %s err: %s", staged.ID, err)
+	}
+	if !applied {
+		// activated or aborted by others
+		return nil
+	}
+	logger.Infof("staged switch %s activated at %s", staged.ID, activateAt)
+	return nil
+}
+
+// Abort the pending switch
+func (c *SwitchCoordinator) Abort(op SwitchOperator) error {
+	applied, err := c.cqlStore.session.Query(
+		fmt.Sprintf(
+			"update %s.%s set state = ?, error = ? where id = ? if state = ?",
+			c.keyspace, stagedSwitchTable,
+		), StagedAborted, "aborted by "+op.Who, stagedSwitchRow, StagedPending,
+	).MapScanCAS(map[string]interface{}{})
+	if err != nil {
+		return fmt.Errorf("abort staged switch err: %s", err)
+	}
+	if !applied {
+		return fmt.Errorf("no pending switch to abort")
+	}
+	return nil
+}
+
+func (c *SwitchCoordinator) Status() *CoordinatedSwitchStatus {
+	st := &CoordinatedSwitchStatus{Lagging: []string{}}
+	staged, err := c.getStaged()
+	if err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	proxies, err := c.listProxies()
+	if err != nil {
+		st.Error = err.Error()
+		return st
+	}
+	st.Staged = staged
+	st.Proxies = proxies
+	if staged != nil {
+		st.Lagging = laggingProxies(staged, proxies)
+	}
+	c.lock.Lock()
+	if st.Error == "" {
+		st.Error = c.lastErr
+	}
+	c.lock.Unlock()
+	return st
+}
+
+// laggingProxies return alive proxies which have not acked the pending
+// switch, or not applied the active one
+func laggingProxies(staged *StagedSwitch, proxies []*ProxyHeartbeat) []string {
+	lagging := []string{}
+	for _, p := range proxies {
+		switch staged.State {
+		case StagedPending:
+			if p.Acked != staged.ID {
+				lagging = append(lagging, p.Proxy)
+			}
+		case StagedActive:
+			if p.Applied != staged.ID {
+				lagging = append(lagging, p.Proxy)
+			}
+		}
+	}
+	return lagging
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -18,6 +19,10 @@ import (
 
 const (
 	MAX_KEY_LEN = 250
+	// flag of value created by incr, same as gobeansdb
+	FLAG_INCR = 0x00000204
+	// max retries of read-modify-write when the value is changed concurrently
+	MAX_CAS_RETRY = 5
 )
 
 var (
@@ -26,6 +31,8 @@ var (
 	selectQ string
 	insertQ string
 	deleteQ string
+	casUpdateQ string
+	insertNXQ string
 )
 
 type CassandraStore struct {
@@ -34,6 +41,8 @@ type CassandraStore struct {
 	keyTableFinder *KeyTableFinder
 	staticTable bool
 	ClusterName string
+	// use ReceiveTime of value as write timestamp
+	receiveTimeAsTS bool
 }
 
 func NewCassandraStore(cstarCfg *config.CassandraStoreCfg) (*CassandraStore, error) {
@@ -76,13 +85,21 @@ func NewCassandraStore(cstarCfg *config.CassandraStoreCfg) (*CassandraStore, err
 		cstarCfg.DefaultKeySpace, cstarCfg.DefaultTable,
 	)
 	insertQ = fmt.Sprintf(
-		"insert into %s.%s (key, value) values (?, ?)",
+		"insert into %s.%s (key, value) values (?, ?) using ttl ?",
 		cstarCfg.DefaultKeySpace, cstarCfg.DefaultTable,
 	)
 	deleteQ = fmt.Sprintf(
 		"delete from %s.%s where key = ?",
 		cstarCfg.DefaultKeySpace, cstarCfg.DefaultTable,
 	)
+	casUpdateQ = fmt.Sprintf(
+		"update %s.%s using ttl ? set value = ? where key = ? if value.body = ?",
+		cstarCfg.DefaultKeySpace, cstarCfg.DefaultTable,
+	)
+	insertNXQ = fmt.Sprintf(
+		"insert into %s.%s (key, value) values (?, ?) if not exists using ttl ?",
+		cstarCfg.DefaultKeySpace, cstarCfg.DefaultTable,
+	)
 
 	if err != nil {
 		return nil, err
@@ -102,6 +119,7 @@ func NewCassandraStore(cstarCfg *config.CassandraStoreCfg) (*CassandraStore, err
 		}
 		cqlStore.keyTableFinder = ktFinder
 		cqlStore.staticTable = !cstarCfg.PrefixTableDispatcherCfg.Enable
+		cqlStore.receiveTimeAsTS = cstarCfg.UseReceiveTimeAsTimestamp
 		return cqlStore, nil
 	}
 }
@@ -120,7 +138,8 @@ func (c *CassandraStore) GetClusterName() (string, error) {
 	}
 }
 
-func (c *CassandraStore) Get(key string) (*mc.Item, error) {
+// getValue return nil if key not found
+func (c *CassandraStore) getValue(key string) (*BDBValue, error) {
 	var q string
 	if c.staticTable {
 		q = selectQ
@@ -133,20 +152,30 @@ func (c *CassandraStore) Get(key string) (*mc.Item, error) {
 	defer query.Release()
 	err := query.Scan(&value)
 	if err == gocql.ErrNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return value, nil
+}
+
+func (c *CassandraStore) Get(key string) (*mc.Item, error) {
+	value, err := c.getValue(key)
+	if err != nil {
+		return nil, err
+	}
+	if value == nil || value.IsExpired(time.Now()) {
 		// https://github.com/douban/gobeansdb/blob/master/memcache/protocol.go#L499
 		// just return nil for not found
 		return nil, nil
 	}
 
+	item, err := value.ToMCItem()
 	if err != nil {
 		return nil, err
-	} else {
-		item, err := value.ToMCItem()
-		if err != nil {
-			return nil, err
-		}
-		return item, nil
 	}
+	return item, nil
 }
 
 func (c *CassandraStore) GetMulti(keys []string, result map[string]*mc.Item) error {
@@ -185,9 +214,23 @@ func (c *CassandraStore) GetMulti(keys []string, result map[string]*mc.Item) err
 	return nil
 }
 
+// SetWithValue insert v with TTL by exptime of v, or the default TTL of the
+// prefix of key when exptime is 0, expired value is deleted.
 func (c *CassandraStore) SetWithValue(key string, v *BDBValue) (ok bool, err error) {
-	var q string
+	now := time.Now()
+	if v.ReceiveTime.IsZero() {
+		v.ReceiveTime = now
+	}
+	if v.Exptime == 0 {
+		v.Exptime = c.defaultExptime(key, now)
+	}
+	ttl := v.TTL(now)
+	if ttl < 0 {
+		_, err = c.DeleteAt(key, v.ReceiveTime)
+		return err == nil, err
+	}
 
+	var q string
 	if c.staticTable {
 		q = insertQ
 	} else {
@@ -198,8 +241,10 @@ func (c *CassandraStore) SetWithValue(key string, v *BDBValue) (ok bool, err err
 		q,
 		key,
 		v,
+		ttl,
 	)
 	defer query.Release()
+	c.withTimestamp(query, v.ReceiveTime)
 	err = query.Exec()
 
 	if err != nil {
@@ -211,31 +256,143 @@ func (c *CassandraStore) SetWithValue(key string, v *BDBValue) (ok bool, err err
 }
 
 func (c *CassandraStore) Set(key string, item *mc.Item) (ok bool, err error) {
-	var q string
+	return c.SetWithValue(key, NewBDBValue(item))
+}
 
-	if c.staticTable {
-		q = insertQ
-	} else {
-		q = c.keyTableFinder.GetSqlTpl("insert", key)
+// casSet set key to v by lightweight transaction, only if the body of key is
+// still the body of old, or key not exists when old is nil.
+func (c *CassandraStore) casSet(key string, v *BDBValue, old *BDBValue) (applied bool, err error) {
+	ttl := v.TTL(time.Now())
+	if ttl < 0 {
+		// expired just now, keep it for a while is harmless
+		ttl = 1
 	}
 
-	v := NewBDBValue(item)
-	query := c.session.Query(
-		q,
-		key,
-		v,
-	)
+	var query *gocql.Query
+	if old == nil {
+		var q string
+		if c.staticTable {
+			q = insertNXQ
+		} else {
+			q = c.keyTableFinder.GetSqlTpl("insert_nx", key)
+		}
+		query = c.session.Query(q, key, v, ttl)
+	} else {
+		var q string
+		if c.staticTable {
+			q = casUpdateQ
+		} else {
+			q = c.keyTableFinder.GetSqlTpl("cas_update", key)
+		}
+		query = c.session.Query(q, ttl, v, key, old.Body)
+	}
 	defer query.Release()
-	err = query.Exec()
+	return query.MapScanCAS(map[string]interface{}{})
+}
 
-	if err != nil {
-		logger.Debugf("Set key %s err: %s", key, err)
-		return false, err
+// defaultExptime return the absolute exptime by the default ttl of prefix of key,
+// 0 if the prefix has no default ttl
+func (c *CassandraStore) defaultExptime(key string, now time.Time) int {
+	ttl := c.keyTableFinder.GetTTLByKey(key)
+	if ttl <= 0 {
+		return 0
+	}
+	return int(now.Unix()) + ttl
+}
+
+// keepExptime return exptime for a new value which expires with old
+func keepExptime(old *BDBValue) int {
+	expireAt := old.ExpireAt()
+	if expireAt.IsZero() {
+		return 0
+	}
+	return int(expireAt.Unix())
+}
+
+// Incr like gobeansdb: the value is created with FLAG_INCR if key not exists,
+// value of key must be a number set by incr.
+func (c *CassandraStore) Incr(key string, value int) (int, error) {
+	for i := 0; i < MAX_CAS_RETRY; i++ {
+		old, err := c.getValue(key)
+		if err != nil {
+			return 0, err
+		}
+		now := time.Now()
+		result := value
+		v := &BDBValue{ReceiveTime: now, Flag: FLAG_INCR}
+		if old != nil && !old.IsExpired(now) {
+			if old.Flag != FLAG_INCR {
+				return 0, fmt.Errorf("incr key %s with flag 0x%x", key, old.Flag)
+			}
+			n, err := strconv.Atoi(string(old.Body))
+			if err != nil {
+				return 0, fmt.Errorf("incr key %s with value %q", key, old.Body)
+			}
+			result += n
+			v.Exptime = keepExptime(old)
+		} else {
+			v.Exptime = c.defaultExptime(key, now)
+		}
+		v.Body = []byte(strconv.Itoa(result))
+
+		applied, err := c.casSet(key, v, old)
+		if err != nil {
+			return 0, err
+		}
+		if applied {
+			return result, nil
+		}
+	}
+	return 0, fmt.Errorf("incr key %s conflicted %d times", key, MAX_CAS_RETRY)
+}
+
+// Append value to the body of key, return false if key not exists like memcache
+func (c *CassandraStore) Append(key string, value []byte) (bool, error) {
+	for i := 0; i < MAX_CAS_RETRY; i++ {
+		old, err := c.getValue(key)
+		if err != nil {
+			return false, err
+		}
+		now := time.Now()
+		if old == nil || old.IsExpired(now) {
+			return false, nil
+		}
+
+		v := *old
+		v.ReceiveTime = now
+		v.Exptime = keepExptime(old)
+		v.Body = make([]byte, 0, len(old.Body)+len(value))
+		v.Body = append(append(v.Body, old.Body...), value...)
+		applied, err := c.casSet(key, &v, old)
+		if err != nil {
+			return false, err
+		}
+		if applied {
+			return true, nil
+		}
+	}
+	return false, fmt.Errorf("append key %s conflicted %d times", key, MAX_CAS_RETRY)
+}
+
+// timestampQuery is a query whose write timestamp can be set, e.g. *gocql.Query
+type timestampQuery interface {
+	WithTimestamp(timestamp int64) *gocql.Query
+}
+
+// withTimestamp use t as the write timestamp of query if enabled,
+// conditional updates must not use it.
+func (c *CassandraStore) withTimestamp(query timestampQuery, t time.Time) {
+	if c.receiveTimeAsTS && !t.IsZero() {
+		query.WithTimestamp(t.UnixMicro())
 	}
-	return true, nil
 }
 
 func (c *CassandraStore) Delete(key string) (bool, error) {
+	return c.DeleteAt(key, time.Now())
+}
+
+// DeleteAt delete key, receiveTime is when proxy received the delete
+func (c *CassandraStore) DeleteAt(key string, receiveTime time.Time) (bool, error) {
 	var q string
 
 	if c.staticTable {
@@ -249,6 +406,7 @@ func (c *CassandraStore) Delete(key string) (bool, error) {
 		key,
 	)
 	defer query.Release()
+	c.withTimestamp(query, receiveTime)
 	err := query.Exec()
 
 	return err == nil, err
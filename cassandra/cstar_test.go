@@ -0,0 +1,118 @@
+package cassandra
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/douban/gobeansproxy/config"
+	"github.com/gocql/gocql"
+)
+
+// newTestCassandraStore connect to the c* of dev env (.doubanpde/scripts/cassandra),
+// CASSANDRA_HOSTS can be used to override the hosts, test is skipped if c* is not available
+func newTestCassandraStore(t *testing.T) *CassandraStore {
+	hosts := []string{"127.0.0.1:9042"}
+	if h := os.Getenv("CASSANDRA_HOSTS"); h != "" {
+		hosts = strings.Split(h, ",")
+	}
+	cfg := &config.CassandraStoreCfg{
+		Enable:                    true,
+		Hosts:                     hosts,
+		DefaultKeySpace:           "doubandb",
+		DefaultTable:              "kvstore",
+		CstarTimeoutMs:            1000,
+		CstarConnectTimeoutMs:     1000,
+		CstarWriteTimeoutMs:       1000,
+		RetryNum:                  1,
+		NumConns:                  1,
+		Username:                  "doubandb_test",
+		Password:                  "doubandb_test",
+		UseReceiveTimeAsTimestamp: true,
+	}
+	store, err := NewCassandraStore(cfg)
+	if err != nil {
+		t.Skipf("cassandra is not available: %s", err)
+	}
+	t.Cleanup(store.Close)
+	return store
+}
+
+// recordedQuery record timestamps set by WithTimestamp
+type recordedQuery struct {
+	timestamps []int64
+}
+
+func (q *recordedQuery) WithTimestamp(timestamp int64) *gocql.Query {
+	q.timestamps = append(q.timestamps, timestamp)
+	return nil
+}
+
+func TestWithTimestamp(t *testing.T) {
+	rtime := time.Date(2023, 5, 1, 12, 0, 0, 123456789, time.UTC)
+
+	store := &CassandraStore{receiveTimeAsTS: true}
+	query := &recordedQuery{}
+	store.withTimestamp(query, rtime)
+	if len(query.timestamps) != 1 || query.timestamps[0] != rtime.UnixMicro() {
+		t.Errorf("timestamp should be %d, got %v", rtime.UnixMicro(), query.timestamps)
+	}
+
+	// no receive time, c* use its own time
+	query = &recordedQuery{}
+	store.withTimestamp(query, time.Time{})
+	if len(query.timestamps) != 0 {
+		t.Errorf("timestamp should not be set without receive time, got %v", query.timestamps)
+	}
+
+	store = &CassandraStore{receiveTimeAsTS: false}
+	store.withTimestamp(query, rtime)
+	if len(query.timestamps) != 0 {
+		t.Errorf("timestamp should not be set when disabled, got %v", query.timestamps)
+	}
+}
+
+func TestSetWithReceiveTimeAsTimestamp(t *testing.T) {
+	store := newTestCassandraStore(t)
+	key := fmt.Sprintf("/test/cstar/timestamp/%d", time.Now().UnixNano())
+	now := time.Now()
+
+	newer := &BDBValue{ReceiveTime: now, Body: []byte("newer")}
+	if ok, err := store.SetWithValue(key, newer); !ok {
+		t.Fatalf("set newer err: %s", err)
+	}
+
+	// a set replayed from dual write error log is older
+	older := &BDBValue{ReceiveTime: now.Add(-time.Minute), Body: []byte("older")}
+	if ok, err := store.SetWithValue(key, older); !ok {
+		t.Fatalf("set older err: %s", err)
+	}
+	item, err := store.Get(key)
+	if err != nil || item == nil {
+		t.Fatalf("get %s err: %v", key, err)
+	}
+	if string(item.Body) != "newer" {
+		t.Fatalf("older set overwrite the newer value: %s", item.Body)
+	}
+	item.Free()
+
+	// an older delete neither
+	if _, err := store.DeleteAt(key, now.Add(-time.Second)); err != nil {
+		t.Fatalf("delete err: %s", err)
+	}
+	item, err = store.Get(key)
+	if err != nil || item == nil {
+		t.Fatalf("older delete removed the newer value, err: %v", err)
+	}
+	item.Free()
+
+	if _, err := store.DeleteAt(key, now.Add(time.Second)); err != nil {
+		t.Fatalf("delete err: %s", err)
+	}
+	item, err = store.Get(key)
+	if err != nil || item != nil {
+		t.Fatalf("newer delete should remove the value, err: %v", err)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"time"
 
 	"github.com/douban/gobeansproxy/config"
 	logrus "github.com/sirupsen/logrus"
@@ -27,9 +28,15 @@ func setLogLevel(logLevel string) {
 	})
 }
 
+// DualWriteRetrier retry the c* writes failed in dual write
+type DualWriteRetrier interface {
+	Add(key, op string)
+}
+
 type DualWriteErrorMgr struct {
 	EFile string
 	ELogger *logrus.Logger
+	Retrier DualWriteRetrier
 }
 
 func NewDualWErrMgr(ecfg *config.DualWErrCfg, logger *logrus.Logger) (*DualWriteErrorMgr, error) {
@@ -45,7 +52,8 @@ func NewDualWErrMgr(ecfg *config.DualWErrCfg, logger *logrus.Logger) (*DualWrite
 	}
 	
 	// set dump Logger
-	logger.SetFormatter(&logrus.JSONFormatter{})
+	// time of failed writes is used by reconcile, keep it precise
+	logger.SetFormatter(&logrus.JSONFormatter{TimestampFormat: time.RFC3339Nano})
 	dumpFile := filepath.Join(ecfg.DumpToDir, ecfg.FName)
 	logger.SetOutput(&rotateLogger.Logger{
 		Filename: dumpFile,
@@ -66,4 +74,7 @@ func (e *DualWriteErrorMgr) HandleErr(key, op string, err error) {
 		"key": key,
 		"op": op,
 	}).Error(err)
+	if e.Retrier != nil {
+		e.Retrier.Add(key, op)
+	}
 }
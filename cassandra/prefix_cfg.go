@@ -59,7 +59,7 @@ func (c *DisPatcherCfg) SaveToDB(m map[string][]string, cqlStore *CassandraStore
 			).Exec()
 
 			if err != nil {
-				return fmt.Errorf("insert %s -> %s err: %s", p, value)
+				return fmt.Errorf("insert %s -> %s err: %s", p, value, err)
 			}
 		}
 	}
@@ -0,0 +1,87 @@
+package cassandra
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// keys are divided into buckets by hash for rollout, so percent can be 0.01
+const rolloutBuckets = 10000
+
+// PrefixSwitchRule is the status of a prefix, keys of it are switched from
+// From to To gradually by Percent, a rule not in rollout has Percent 100.
+//
+// a rule is saved as "<to>" or "<from>-><to>@<percent>", e.g.
+// "br1w1cr0w1->br0w1cr1w1@10" reads 10% keys from c*
+type PrefixSwitchRule struct {
+	From    PrefixSwitchStatus
+	To      PrefixSwitchStatus
+	Percent float64
+}
+
+func fullSwitchRule(s PrefixSwitchStatus) PrefixSwitchRule {
+	return PrefixSwitchRule{From: s, To: s, Percent: 100}
+}
+
+// parseSwitchRule parse "<to>", "<to>@<percent>" or "<from>-><to>@<percent>",
+// From of "<to>@<percent>" is -1 and must be filled by the caller.
+func parseSwitchRule(v string) (PrefixSwitchRule, error) {
+	r := PrefixSwitchRule{From: -1, Percent: 100}
+	to := v
+	if idx := strings.LastIndex(v, "@"); idx >= 0 {
+		pct, err := strconv.ParseFloat(v[idx+1:], 64)
+		if err != nil || pct < 0 || pct > 100 {
+			return r, fmt.Errorf("bad rollout percent of %s", v)
+		}
+		r.Percent = pct
+		to = v[:idx]
+	}
+	if idx := strings.Index(to, "->"); idx >= 0 {
+		from, err := strToSwitchStatus(to[:idx])
+		if err != nil {
+			return r, err
+		}
+		r.From = from
+		to = to[idx+2:]
+	}
+	status, err := strToSwitchStatus(to)
+	if err != nil {
+		return r, err
+	}
+	r.To = status
+	if r.Percent >= 100 || r.From == r.To {
+		return fullSwitchRule(r.To), nil
+	}
+	return r, nil
+}
+
+func (r PrefixSwitchRule) IsRollout() bool {
+	return r.Percent < 100
+}
+
+func (r PrefixSwitchRule) String() string {
+	if !r.IsRollout() {
+		return r.To.String()
+	}
+	return fmt.Sprintf("%s->%s@%s", r.From, r.To, strconv.FormatFloat(r.Percent, 'f', -1, 64))
+}
+
+// rolloutBucket is a stable bucket of key in [0, rolloutBuckets)
+func rolloutBucket(key string) int {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return int(h.Sum32() % rolloutBuckets)
+}
+
+// statusOf return the status of key, To if key is in the rolled out percent
+func (r PrefixSwitchRule) statusOf(key string) PrefixSwitchStatus {
+	if !r.IsRollout() {
+		return r.To
+	}
+	if float64(rolloutBucket(key)) < r.Percent*rolloutBuckets/100 {
+		return r.To
+	}
+	return r.From
+}
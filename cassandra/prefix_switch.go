@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"sync"
+	"time"
+	"unicode/utf8"
 
 	"github.com/acomagu/trie/v2"
 	"github.com/douban/gobeansproxy/config"
@@ -24,35 +26,33 @@ const (
 	PrefixSwitchCrw PrefixSwitchStatus = 3
 	// c* read only bdb disable
 	PrefixSwitchCr PrefixSwitchStatus  = 4
+	// bdb r/w c* w, sampled reads are also read from c* and compared
+	PrefixSwitchBrwCwVerify PrefixSwitchStatus = 5
 
 	statusBrw string = "br1w1cr0w0"
 	statusBrwCw string = "br1w1cr0w1"
 	statusBwCrw string = "br0w1cr1w1"
 	statusCrw string = "br0w0cr1w1"
 	statusCr string = "br0w0cr1w0"
-)
-
-var (
-	allowRWStatus = map[string]bool{
-		statusBrw: true,
-		statusBrwCw: true,
-		statusBwCrw: true,
-		statusCrw: true,
-		statusCr: true,
-	}
+	statusBrwCwVerify string = "verify"
 )
 
 type PrefixSwitcher struct {
-	trie *trie.Tree[rune, PrefixSwitchStatus]
+	trie *trie.Tree[rune, PrefixSwitchRule]
 	defaultT PrefixSwitchStatus
 	lock sync.RWMutex
 	currentTrieMap map[string]string
 	cstarEnabled bool
 	bdbEnabled bool
+	// last transition of prefixes switched online
+	transitions map[string]*PrefixTransition
+	// version of cfg loaded, see cfgVersion
+	version uint32
+	loadedAt time.Time
 }
 
 func (s PrefixSwitchStatus) IsReadOnBeansdb() bool {
-	return s == PrefixSwitchBrw || s == PrefixSwitchBrwCw
+	return s == PrefixSwitchBrw || s == PrefixSwitchBrwCw || s == PrefixSwitchBrwCwVerify
 }
 
 func (s PrefixSwitchStatus) IsReadOnCstar() bool {
@@ -60,11 +60,18 @@ func (s PrefixSwitchStatus) IsReadOnCstar() bool {
 }
 
 func (s PrefixSwitchStatus) IsWriteOnBeansdb() bool {
-	return s == PrefixSwitchBrw || s == PrefixSwitchBrwCw || s == PrefixSwitchBwCrw
+	return s == PrefixSwitchBrw || s == PrefixSwitchBrwCw || s == PrefixSwitchBwCrw ||
+		s == PrefixSwitchBrwCwVerify
 }
 
 func (s PrefixSwitchStatus) IsWriteOnCstar() bool {
-	return s == PrefixSwitchCrw || s == PrefixSwitchBrwCw || s == PrefixSwitchBwCrw
+	return s == PrefixSwitchCrw || s == PrefixSwitchBrwCw || s == PrefixSwitchBwCrw ||
+		s == PrefixSwitchBrwCwVerify
+}
+
+// IsVerify return true if reads on beansdb should be compared with c*
+func (s PrefixSwitchStatus) IsVerify() bool {
+	return s == PrefixSwitchBrwCwVerify
 }
 
 func strToSwitchStatus(s string) (PrefixSwitchStatus, error) {
@@ -79,6 +86,8 @@ func strToSwitchStatus(s string) (PrefixSwitchStatus, error) {
 		return PrefixSwitchCrw, nil
 	case statusCr:
 		return PrefixSwitchCr, nil
+	case statusBrwCwVerify:
+		return PrefixSwitchBrwCwVerify, nil
 	default:
 		return -1, fmt.Errorf("Unsupported switch type of %s", s) 
 	}
@@ -86,7 +95,7 @@ func strToSwitchStatus(s string) (PrefixSwitchStatus, error) {
 
 func GetPrefixSwitchTrieFromCfg(
 	cfg *config.CassandraStoreCfg, cqlStore *CassandraStore) (
-	*trie.Tree[rune, PrefixSwitchStatus], map[string]string, error) {
+	*trie.Tree[rune, PrefixSwitchRule], map[string]string, error) {
 	if !cfg.PrefixRWDispatcherCfg.Enable {
 		logger.Infof("rw switcher disabled, skip init ...")
 		return nil, nil, nil
@@ -95,7 +104,7 @@ func GetPrefixSwitchTrieFromCfg(
 	s2k := cfg.PrefixRWDispatcherCfg.StaticCfg
 
 	keysString := [][]rune{}
-	vStatus := []PrefixSwitchStatus{}
+	vStatus := []PrefixSwitchRule{}
 	vStrStatus := []string{}
 	dedup := map[string]struct{}{}
 
@@ -142,16 +151,19 @@ func GetPrefixSwitchTrieFromCfg(
 
 	// now init real value
 	for _, sv := range vStrStatus {
-		rv, err := strToSwitchStatus(sv)
+		rv, err := parseSwitchRule(sv)
 		if err != nil {
 			return nil, nil, fmt.Errorf("parse value %s to status err: %s", sv, err)
 		}
+		if rv.From < 0 {
+			return nil, nil, fmt.Errorf("rollout value %s must be <from>-><to>@<percent>", sv)
+		}
 		vStatus = append(vStatus, rv)
 	}
 
 	logger.Infof("Loading from cfg: %v", loadedMap)
 	if len(keysString) == len(vStatus) && len(keysString) > 0 {
-		tr := trie.New[rune, PrefixSwitchStatus](keysString, vStatus)
+		tr := trie.New[rune, PrefixSwitchRule](keysString, vStatus)
 		return &tr, loadedMap, nil
 	} else {
 		return nil, loadedMap, nil
@@ -183,39 +195,64 @@ func NewPrefixSwitcher(cfg *config.ProxyConfig, cqlStore *CassandraStore) (*Pref
 	f.defaultT = defaultS
 	f.currentTrieMap = nowMap
 	f.bdbEnabled = cfg.DStoreConfig.Enable
+	f.version = switcherCfgVersion(nowMap, &cfg.CassandraStoreCfg)
+	f.loadedAt = time.Now()
 	return f, nil
 }
 
 // use this to match longest prefix of key
 // You should lock the s trie to prevent trie update
 func (s *PrefixSwitcher) matchStatus(key string) PrefixSwitchStatus {
+	status, _ := s.matchStatusAndPrefix(key)
+	return status
+}
+
+// use this to match longest prefix of key, prefix is "" if key matches
+// no prefix and default status is used
+// You should lock the s trie to prevent trie update
+func (s *PrefixSwitcher) matchStatusAndPrefix(key string) (PrefixSwitchStatus, string) {
 	if s.trie == nil {
-		return s.defaultT
+		return s.defaultT, ""
 	}
 
-	var v PrefixSwitchStatus
-	var match bool
+	var v PrefixSwitchRule
+	matched := -1
 
 	n := *(s.trie)
 
-	for _, c := range key {
+	for i, c := range key {
 		if n = n.TraceOne(c); n == nil {
 			break
 		}
 
 		if vv, ok := n.Terminal(); ok {
 			v = vv
-			match = true
+			matched = i + utf8.RuneLen(c)
 		}
 	}
 
-	if match {
-		return v
+	if matched >= 0 {
+		return v.statusOf(key), key[:matched]
 	} else {
-		return s.defaultT
+		return s.defaultT, ""
 	}
 }
 
+// GetStatusAndPrefix return status of key and the prefix it matches
+func (s *PrefixSwitcher) GetStatusAndPrefix(key string) (PrefixSwitchStatus, string) {
+	if !s.bdbEnabled && s.cstarEnabled {
+		return PrefixSwitchCrw, ""
+	}
+
+	if !s.cstarEnabled {
+		return PrefixSwitchBrw, ""
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+	return s.matchStatusAndPrefix(key)
+}
+
 func (s *PrefixSwitcher) GetStatus(key string) PrefixSwitchStatus {
 	if !s.bdbEnabled && s.cstarEnabled {
 		return PrefixSwitchCrw
@@ -335,22 +372,17 @@ func (s *PrefixSwitcher) LoadCfg(cfg *config.CassandraStoreCfg, cqlStore *Cassan
 	s.trie = pTrie
 	s.defaultT = defaultS
 	s.currentTrieMap = nowMap
+	s.version = switcherCfgVersion(nowMap, cfg)
+	s.loadedAt = time.Now()
 	return nil
 }
 
 func (s *PrefixSwitcher) Upsert(cfg *config.CassandraStoreCfg, data map[string][]string, cqlStore *CassandraStore) error {
-	for rwStatus := range data {
-		if _, ok := allowRWStatus[rwStatus]; !ok {
-			return fmt.Errorf("%s is not a validate rwstatus", rwStatus)
-		}
-	}
-	dispatcherCfg := DisPatcherCfg(cfg.PrefixRWDispatcherCfg)
-	return dispatcherCfg.SaveToDB(data, cqlStore)
+	return s.UpsertBy(cfg, data, cqlStore, SwitchOperator{})
 }
 
 func (s *PrefixSwitcher) DeletePrefix(cfg *config.CassandraStoreCfg, prefix string, cqlStore *CassandraStore) error {
-	dispatcherCfg := DisPatcherCfg(cfg.PrefixRWDispatcherCfg)
-	return dispatcherCfg.DeletePrefixCfg(prefix, cqlStore)
+	return s.DeletePrefixBy(cfg, prefix, cqlStore, SwitchOperator{})
 }
 
 func (s *PrefixSwitcher) GetCurrentMap() map[string]string {
@@ -0,0 +1,344 @@
+package cassandra
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/douban/gobeansproxy/config"
+)
+
+func newTestPrefixSwitcher(t *testing.T, static map[string][]string) *PrefixSwitcher {
+	cfg := &config.ProxyConfig{}
+	cfg.DStoreConfig.Enable = true
+	cfg.CassandraStoreCfg = config.CassandraStoreCfg{
+		Enable: true,
+		PrefixRWDispatcherCfg: config.PrefixDisPatcherCfg{
+			Enable:    true,
+			StaticCfg: static,
+		},
+		SwitchToKeyDefault: statusBrw,
+	}
+	s, err := NewPrefixSwitcher(cfg, nil)
+	if err != nil {
+		t.Fatalf("init prefix switcher err: %s", err)
+	}
+	return s
+}
+
+func TestPrefixSwitcherVerify(t *testing.T) {
+	s := newTestPrefixSwitcher(t, map[string][]string{
+		statusBrwCw:       {"/dual/"},
+		statusBrwCwVerify: {"/dual/verify/", "/验证/"},
+	})
+
+	tests := []struct {
+		key    string
+		status PrefixSwitchStatus
+		prefix string
+	}{
+		{"/dual/a", PrefixSwitchBrwCw, "/dual/"},
+		{"/dual/verify/a", PrefixSwitchBrwCwVerify, "/dual/verify/"},
+		{"/验证/a", PrefixSwitchBrwCwVerify, "/验证/"},
+		{"/other/a", PrefixSwitchBrw, ""},
+	}
+	for _, tt := range tests {
+		status, prefix := s.GetStatusAndPrefix(tt.key)
+		if status != tt.status || prefix != tt.prefix {
+			t.Errorf("key %s: got (%d, %s), want (%d, %s)",
+				tt.key, status, prefix, tt.status, tt.prefix)
+		}
+		if s.GetStatus(tt.key) != tt.status {
+			t.Errorf("key %s: GetStatus differs from GetStatusAndPrefix", tt.key)
+		}
+	}
+
+	v := PrefixSwitchBrwCwVerify
+	if !v.IsReadOnBeansdb() || v.IsReadOnCstar() || !v.IsWriteOnBeansdb() || !v.IsWriteOnCstar() || !v.IsVerify() {
+		t.Errorf("verify status should read on beansdb and write on both")
+	}
+	if PrefixSwitchBrwCw.IsVerify() {
+		t.Errorf("dual write status should not verify")
+	}
+
+	bkeys, ckeys := s.ReadEnableOnKeys([]string{"/dual/verify/a", "/other/a"})
+	if len(bkeys) != 2 || len(ckeys) != 0 {
+		t.Errorf("verify keys should be read from beansdb, got %v %v", bkeys, ckeys)
+	}
+}
+
+func TestPrefixSwitcherTransition(t *testing.T) {
+	s := newTestPrefixSwitcher(t, map[string][]string{
+		statusBrwCw: {"/dual/"},
+		statusCrw:   {"/dual/cstar/"},
+	})
+
+	// skip dual write
+	_, _, err := s.checkUpsert(map[string][]string{statusCrw: {"/new/"}}, SwitchOperator{})
+	if _, ok := err.(*IllegalTransitionError); !ok {
+		t.Fatalf("switch brw to crw should be rejected, got %v", err)
+	}
+	_, ts, err := s.checkUpsert(map[string][]string{statusCrw: {"/new/"}}, SwitchOperator{Who: "ops", Force: true})
+	if err != nil || len(ts) != 1 || !ts[0].Forced || ts[0].From != statusBrw || ts[0].Who != "ops" {
+		t.Fatalf("forced switch should pass, got %v %v", ts, err)
+	}
+
+	// next and previous stages, a new sub prefix starts from its parent
+	_, ts, err = s.checkUpsert(map[string][]string{
+		statusBwCrw:       {"/dual/", "/dual/cstar/"},
+		statusBrwCwVerify: {"/dual/sub/"},
+	}, SwitchOperator{Who: "ops"})
+	if err != nil || len(ts) != 3 {
+		t.Fatalf("adjacent switch should pass, got %v", err)
+	}
+	if ts[1].Prefix != "/dual/cstar/" || ts[1].From != statusCrw || ts[1].Forced {
+		t.Errorf("bad transition %+v", ts[1])
+	}
+	if ts[2].Prefix != "/dual/sub/" || ts[2].From != statusBrwCw {
+		t.Errorf("bad transition %+v", ts[2])
+	}
+
+	// unknown status
+	if _, _, err := s.checkUpsert(map[string][]string{"bad": {"/dual/"}}, SwitchOperator{Force: true}); err == nil {
+		t.Errorf("unknown status should be rejected")
+	}
+
+	// deleting /dual/cstar/ falls back to /dual/, which skips a stage
+	if _, err := s.checkDelete("/dual/cstar/", SwitchOperator{}); err == nil {
+		t.Errorf("delete crw prefix under brwcw should be rejected")
+	}
+	if tr, err := s.checkDelete("/dual/", SwitchOperator{}); err != nil || tr.To != statusBrw {
+		t.Errorf("delete brwcw prefix should pass, got %v %v", tr, err)
+	}
+	if tr, err := s.checkDelete("/unknown/", SwitchOperator{}); err != nil || tr != nil {
+		t.Errorf("delete unknown prefix should be noop, got %v %v", tr, err)
+	}
+
+	s.recordTransitions(DisPatcherCfg{}, nil, ts...)
+	got, err := s.GetTransitions(&config.CassandraStoreCfg{}, nil)
+	if err != nil {
+		t.Fatalf("get transitions err: %s", err)
+	}
+	if got := got["/dual/"]; got == nil || got.To != statusBwCrw || got.Who != "ops" {
+		t.Errorf("transition of /dual/ not recorded, got %+v", got)
+	}
+}
+
+func TestPrefixSwitcherRollout(t *testing.T) {
+	r, err := parseSwitchRule("br1w1cr0w1->br0w1cr1w1@10")
+	if err != nil || r.From != PrefixSwitchBrwCw || r.To != PrefixSwitchBwCrw || r.Percent != 10 {
+		t.Fatalf("parse rollout rule got %+v %v", r, err)
+	}
+	if r.String() != "br1w1cr0w1->br0w1cr1w1@10" {
+		t.Errorf("format rollout rule got %s", r)
+	}
+	for _, v := range []string{"br0w1cr1w1@101", "br0w1cr1w1@x", "bad@10", "bad->br0w1cr1w1@10"} {
+		if _, err := parseSwitchRule(v); err == nil {
+			t.Errorf("%s should be rejected", v)
+		}
+	}
+	if r, _ := parseSwitchRule("br1w1cr0w1->br0w1cr1w1@100"); r.IsRollout() || r.String() != statusBwCrw {
+		t.Errorf("100%% rollout should be a full rule, got %s", r)
+	}
+
+	s := newTestPrefixSwitcher(t, map[string][]string{
+		"br1w1cr0w1->br0w1cr1w1@10": {"/ramp/"},
+		statusBrwCw:                 {"/dual/"},
+	})
+
+	// about 10% keys are switched, and the result is stable
+	switched := 0
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("/ramp/%d", i)
+		status := s.GetStatus(key)
+		if status == PrefixSwitchBwCrw {
+			switched++
+		} else if status != PrefixSwitchBrwCw {
+			t.Fatalf("key %s got status %s", key, status)
+		}
+		if s.GetStatus(key) != status {
+			t.Fatalf("status of %s is not stable", key)
+		}
+	}
+	if switched < 800 || switched > 1200 {
+		t.Errorf("about 1000 keys should be switched, got %d", switched)
+	}
+
+	// start, ramp, complete and rollback
+	data, _, err := s.checkUpsert(map[string][]string{"br0w1cr1w1@1": {"/dual/"}}, SwitchOperator{})
+	if err != nil || len(data["br1w1cr0w1->br0w1cr1w1@1"]) != 1 {
+		t.Errorf("start rollout got %v %v", data, err)
+	}
+	data, _, err = s.checkUpsert(map[string][]string{"br0w1cr1w1@50": {"/ramp/"}}, SwitchOperator{})
+	if err != nil || len(data["br1w1cr0w1->br0w1cr1w1@50"]) != 1 {
+		t.Errorf("ramp rollout got %v %v", data, err)
+	}
+	for _, v := range []string{statusBwCrw, statusBrwCw} {
+		if _, _, err := s.checkUpsert(map[string][]string{v: {"/ramp/"}}, SwitchOperator{}); err != nil {
+			t.Errorf("switch rollout to %s got %v", v, err)
+		}
+	}
+	for _, v := range []string{statusCrw, statusBrw, "br0w0cr1w1@10"} {
+		if _, _, err := s.checkUpsert(map[string][]string{v: {"/ramp/"}}, SwitchOperator{}); err == nil {
+			t.Errorf("switch rollout to %s should be rejected", v)
+		}
+	}
+}
+
+func TestCfgVersion(t *testing.T) {
+	a := cfgVersion(map[string]string{"/a/": statusBrw, "/b/": statusCrw}, statusBrw)
+	b := cfgVersion(map[string]string{"/b/": statusCrw, "/a/": statusBrw}, statusBrw)
+	if a != b {
+		t.Errorf("version should not depend on map order")
+	}
+	if a == cfgVersion(map[string]string{"/a/": statusBrwCw, "/b/": statusCrw}, statusBrw) {
+		t.Errorf("version should change with value")
+	}
+	if a == cfgVersion(map[string]string{"/a/": statusBrw, "/b/": statusCrw}, statusBrwCw) {
+		t.Errorf("version should change with default")
+	}
+
+	s := newTestPrefixSwitcher(t, map[string][]string{statusBrwCw: {"/dual/"}})
+	cfg := &config.CassandraStoreCfg{
+		Enable: true,
+		PrefixRWDispatcherCfg: config.PrefixDisPatcherCfg{
+			Enable:    true,
+			StaticCfg: map[string][]string{statusBrwCw: {"/dual/"}},
+		},
+		SwitchToKeyDefault: statusBrw,
+	}
+	loaded, _ := s.CfgVersion()
+	remote, err := s.RemoteCfgVersion(cfg, nil)
+	if err != nil || loaded != remote {
+		t.Errorf("version of the same cfg should be equal, got %d %d %v", loaded, remote, err)
+	}
+	cfg.PrefixRWDispatcherCfg.StaticCfg[statusBwCrw] = []string{"/new/"}
+	if remote, _ := s.RemoteCfgVersion(cfg, nil); remote == loaded {
+		t.Errorf("version should change with cfg")
+	}
+}
+
+func TestCoordinatedSwitchLagging(t *testing.T) {
+	proxies := []*ProxyHeartbeat{
+		{Proxy: "a:7905", Acked: "2@a", Applied: "1@a"},
+		{Proxy: "b:7905", Acked: "1@a", Applied: "1@a"},
+		{Proxy: "c:7905", Acked: "2@a", Applied: "2@a"},
+	}
+	staged := &StagedSwitch{ID: "2@a", State: StagedPending}
+	if got := laggingProxies(staged, proxies); len(got) != 1 || got[0] != "b:7905" {
+		t.Errorf("pending switch lagging got %v", got)
+	}
+	staged.State = StagedActive
+	if got := laggingProxies(staged, proxies); len(got) != 2 || got[0] != "a:7905" || got[1] != "b:7905" {
+		t.Errorf("active switch lagging got %v", got)
+	}
+	staged.State = StagedAborted
+	if got := laggingProxies(staged, proxies); len(got) != 0 {
+		t.Errorf("aborted switch lagging got %v", got)
+	}
+
+	c := &SwitchCoordinator{}
+	if c.Holding() {
+		t.Errorf("should not hold without staged switch")
+	}
+	c.staged = &StagedSwitch{ID: "2@a", State: StagedPending}
+	if !c.Holding() {
+		t.Errorf("should hold while switch pending")
+	}
+	c.staged.State = StagedActive
+	if !c.Holding() {
+		t.Errorf("should hold until switch applied")
+	}
+	c.applied = "2@a"
+	if c.Holding() {
+		t.Errorf("should not hold after switch applied")
+	}
+}
+
+func TestCfgHistoryRollback(t *testing.T) {
+	before := map[string]string{"/a/": statusBrw, "/b/": statusBrwCw}
+	after := map[string]string{"/a/": statusBrwCw, "/c/": statusBrwCw}
+	changes := diffCfgMap(before, after)
+	want := []CfgChange{
+		{Prefix: "/a/", Old: statusBrw, New: statusBrwCw},
+		{Prefix: "/b/", Old: statusBrwCw},
+		{Prefix: "/c/", New: statusBrwCw},
+	}
+	if len(changes) != len(want) {
+		t.Fatalf("diff got %d changes, want %d", len(changes), len(want))
+	}
+	for i, ch := range changes {
+		if ch.Prefix != want[i].Prefix || ch.Old != want[i].Old || ch.New != want[i].New {
+			t.Errorf("change %d got %+v, want %+v", i, ch, want[i])
+		}
+	}
+
+	// undo newest first: /a/ brw -> brwcw -> bwcrw, then /c/ added
+	current := map[string]string{"/a/": statusBwCrw, "/c/": statusBrwCw}
+	newer := []*CfgChange{
+		{Prefix: "/c/", New: statusBrwCw},
+		{Prefix: "/a/", Old: statusBrwCw, New: statusBwCrw},
+		{Prefix: "/b/", Old: statusBrwCw},
+	}
+	target := undoCfgChanges(current, newer)
+	if len(target) != 2 || target["/a/"] != statusBrwCw || target["/b/"] != statusBrwCw {
+		t.Errorf("undo got %v", target)
+	}
+	if len(current) != 2 || current["/a/"] != statusBwCrw {
+		t.Errorf("undo should not change the current cfg, got %v", current)
+	}
+}
+
+func TestCfgExportImport(t *testing.T) {
+	s := newTestPrefixSwitcher(t, map[string][]string{
+		statusBrwCw: {"/dual/", "/a/"},
+		statusCrw:   {"/cstar/"},
+	})
+	cfg := &config.CassandraStoreCfg{
+		PrefixRWDispatcherCfg: config.PrefixDisPatcherCfg{Enable: true},
+	}
+	exported := ExportCfg(cfg, s, nil)
+	if len(exported.RWSwitcher[statusBrwCw]) != 2 || exported.RWSwitcher[statusBrwCw][0] != "/a/" || exported.TableFinder != nil {
+		t.Fatalf("export got %+v", exported)
+	}
+	for _, format := range []string{"yaml", "json"} {
+		b, err := exported.Marshal(format)
+		if err != nil {
+			t.Fatalf("marshal %s err: %s", format, err)
+		}
+		parsed, err := ParseDispatcherCfgs(b)
+		if err != nil || len(parsed.RWSwitcher) != 2 || parsed.RWSwitcher[statusCrw][0] != "/cstar/" {
+			t.Errorf("parse %s got %+v %v", format, parsed, err)
+		}
+	}
+
+	if _, err := desiredCfgMap(map[string][]string{"bad": {"/a/"}}, normalizeSwitchRule); err == nil {
+		t.Errorf("bad status should be rejected")
+	}
+	if _, err := desiredCfgMap(map[string][]string{"br0w1cr1w1@10": {"/a/"}}, normalizeSwitchRule); err == nil {
+		t.Errorf("rollout without from status should be rejected")
+	}
+	if _, err := desiredCfgMap(map[string][]string{statusBrw: {"/a/"}, statusBrwCw: {"/a/"}}, normalizeSwitchRule); err == nil {
+		t.Errorf("prefix with two status should be rejected")
+	}
+	desired, err := desiredCfgMap(map[string][]string{
+		statusBwCrw:                 {"/dual/"},
+		"br1w1cr0w1->br0w1cr1w1@10": {"/new/"},
+		statusCrw:                   {"/cstar/"},
+	}, normalizeSwitchRule)
+	if err != nil {
+		t.Fatalf("desired cfg err: %s", err)
+	}
+
+	dc := DisPatcherCfg{Enable: true, CfgFromCstarKeySpace: "ks", CfgFromCstarTable: "cfg"}
+	changes, err := planDispatcherImport("rwswitcher", dc, s.GetCurrentMap(), desired)
+	if err != nil || len(changes) != 3 {
+		t.Fatalf("plan got %v %v", changes, err)
+	}
+	if changes[0].Prefix != "/a/" || changes[0].New != "" || changes[1].New != statusBwCrw || changes[2].Op != CfgChangeImport {
+		t.Errorf("bad changes %+v %+v %+v", changes[0], changes[1], changes[2])
+	}
+	dc.StaticCfg = map[string][]string{statusBrwCw: {"/dual/"}}
+	if _, err := planDispatcherImport("rwswitcher", dc, s.GetCurrentMap(), desired); err == nil {
+		t.Errorf("prefix in static cfg should not be imported")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"sync"
+	"time"
 
 	"github.com/acomagu/trie/v2"
 	"gopkg.in/yaml.v3"
@@ -16,6 +17,8 @@ var (
 	selectQTpl string
 	insertQTpl string
 	deleteQTpl string
+	casUpdateQTpl string
+	insertNXQTpl string
 )
 
 type KeyTableFinder struct {
@@ -23,6 +26,25 @@ type KeyTableFinder struct {
 	defaultT string
 	lock sync.RWMutex
 	currentMap map[string]string
+	// default ttl of keys by prefix
+	ttlTrie *trie.Tree[rune, int]
+	// version of cfg loaded, see cfgVersion
+	version uint32
+	loadedAt time.Time
+}
+
+func getTTLTrieFromCfg(ccfg *config.CassandraStoreCfg) *trie.Tree[rune, int] {
+	if len(ccfg.PrefixTTLCfg) == 0 {
+		return nil
+	}
+	prefixes := make([][]rune, 0, len(ccfg.PrefixTTLCfg))
+	ttls := make([]int, 0, len(ccfg.PrefixTTLCfg))
+	for prefix, ttl := range ccfg.PrefixTTLCfg {
+		prefixes = append(prefixes, []rune(prefix))
+		ttls = append(ttls, ttl)
+	}
+	tr := trie.New[rune, int](prefixes, ttls)
+	return &tr
 }
 
 func getTableTrieFromCfg(
@@ -102,6 +124,9 @@ func NewKeyTableFinder(config *config.CassandraStoreCfg, cqlStore *CassandraStor
 	f.trie = t
 	f.defaultT = config.DefaultTable
 	f.currentMap = nowMap
+	f.ttlTrie = getTTLTrieFromCfg(config)
+	f.version = tableFinderCfgVersion(nowMap, config)
+	f.loadedAt = time.Now()
 
 	// init sql str
 	selectQTpl = fmt.Sprintf(
@@ -109,13 +134,21 @@ func NewKeyTableFinder(config *config.CassandraStoreCfg, cqlStore *CassandraStor
 		config.DefaultKeySpace,
 	)
 	insertQTpl = fmt.Sprintf(
-		"insert into %s.%%s (key, value) values (?, ?)",
+		"insert into %s.%%s (key, value) values (?, ?) using ttl ?",
 		config.DefaultKeySpace,
 	)
 	deleteQTpl = fmt.Sprintf(
 		"delete from %s.%%s where key = ?",
 		config.DefaultKeySpace,
 	)
+	casUpdateQTpl = fmt.Sprintf(
+		"update %s.%%s using ttl ? set value = ? where key = ? if value.body = ?",
+		config.DefaultKeySpace,
+	)
+	insertNXQTpl = fmt.Sprintf(
+		"insert into %s.%%s (key, value) values (?, ?) if not exists using ttl ?",
+		config.DefaultKeySpace,
+	)
 
 	return f, nil
 }
@@ -151,12 +184,37 @@ func (f *KeyTableFinder) GetTableByKey(key string) string {
 	}
 }
 
+// GetTTLByKey return the default ttl of the longest prefix matching key, 0 if no match
+func (f *KeyTableFinder) GetTTLByKey(key string) int {
+	f.lock.RLock()
+	defer f.lock.RUnlock()
+	if f.ttlTrie == nil {
+		return 0
+	}
+
+	var ttl int
+	n := *(f.ttlTrie)
+	for _, c := range key {
+		if n = n.TraceOne(c); n == nil {
+			break
+		}
+		if v, ok := n.Terminal(); ok {
+			ttl = v
+		}
+	}
+	return ttl
+}
+
 func (f *KeyTableFinder) GetSqlTpl(sqlType string, key string) string {
 	switch sqlType {
 	case "select":
 		return fmt.Sprintf(selectQTpl, f.GetTableByKey(key))
 	case "delete":
 		return fmt.Sprintf(deleteQTpl, f.GetTableByKey(key))
+	case "cas_update":
+		return fmt.Sprintf(casUpdateQTpl, f.GetTableByKey(key))
+	case "insert_nx":
+		return fmt.Sprintf(insertNXQTpl, f.GetTableByKey(key))
 	default:
 		return fmt.Sprintf(insertQTpl, f.GetTableByKey(key))
 	}
@@ -199,6 +257,9 @@ func (f *KeyTableFinder) LoadCfg(cfg *config.CassandraStoreCfg, cqlStore *Cassan
 	f.trie = pTrie
 	f.defaultT = defaultS
 	f.currentMap = nowMap
+	f.ttlTrie = getTTLTrieFromCfg(cfg)
+	f.version = tableFinderCfgVersion(nowMap, cfg)
+	f.loadedAt = time.Now()
 	cqlStore.staticTable = !cfg.PrefixTableDispatcherCfg.Enable
 	return nil
 }
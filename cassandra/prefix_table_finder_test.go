@@ -9,25 +9,32 @@ import (
 
 var (
 	cstarCfgTest = &config.CassandraStoreCfg{
-		TableToKeyPrefix: map[string][]string{
-			"a": []string{
-				"/a",
-				"/a/b/c",
-				"/d/e/ffff",
-				"/d/f/eeee",
-			},
+		PrefixTableDispatcherCfg: config.PrefixDisPatcherCfg{
+			Enable: true,
+			StaticCfg: map[string][]string{
+				"a": []string{
+					"/a",
+					"/a/b/c",
+					"/d/e/ffff",
+					"/d/f/eeee",
+				},
 
-			"and": []string{
-				"/and/anding",
-				"/a/kkkk",
+				"and": []string{
+					"/and/anding",
+					"/a/kkkk",
+				},
 			},
 		},
+		PrefixTTLCfg: map[string]int{
+			"/cache/": 60,
+			"/cache/long/": 3600,
+		},
 		DefaultTable: "misc",
 	}
 )
 
 func TestKeyTableFinder(t *testing.T) {
-	tree, err := NewKeyTableFinder(cstarCfgTest)
+	tree, err := NewKeyTableFinder(cstarCfgTest, nil)
 	if err != nil {
 		t.Fatalf("init keytable finder err %s", err)
 	}
@@ -48,8 +55,27 @@ func TestKeyTableFinder(t *testing.T) {
 	}
 }
 
+func TestKeyTableFinderTTL(t *testing.T) {
+	f, err := NewKeyTableFinder(cstarCfgTest, nil)
+	if err != nil {
+		t.Fatalf("init keytable finder err %s", err)
+	}
+
+	testData := map[string]int{
+		"/cache/a": 60,
+		"/cache/long/a": 3600,
+		"/cache": 0,
+		"/a/b": 0,
+	}
+	for k, v := range testData {
+		if ttl := f.GetTTLByKey(k); ttl != v {
+			t.Fatalf("%s ttl should be %d, got %d", k, v, ttl)
+		}
+	}
+}
+
 func BenchmarkKeyTableFinder(b *testing.B) {
-	f, err := NewKeyTableFinder(cstarCfgTest)
+	f, err := NewKeyTableFinder(cstarCfgTest, nil)
 	if err != nil {
 		b.Failed()
 	}
@@ -0,0 +1,320 @@
+package cassandra
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/douban/gobeansproxy/config"
+)
+
+// a prefix is migrated from beansdb to c* stage by stage:
+// br1w1cr0w0 -> br1w1cr0w1 (-> verify) -> br0w1cr1w1 -> br0w0cr1w1 (-> br0w0cr1w0)
+// skipping a stage loses data, e.g. reading c* before dual write.
+// Rolling back to the previous stage is allowed.
+var allowedTransitions = map[PrefixSwitchStatus][]PrefixSwitchStatus{
+	PrefixSwitchBrw:         {PrefixSwitchBrwCw},
+	PrefixSwitchBrwCw:       {PrefixSwitchBrw, PrefixSwitchBrwCwVerify, PrefixSwitchBwCrw},
+	PrefixSwitchBrwCwVerify: {PrefixSwitchBrwCw, PrefixSwitchBwCrw},
+	PrefixSwitchBwCrw:       {PrefixSwitchBrwCw, PrefixSwitchBrwCwVerify, PrefixSwitchCrw},
+	PrefixSwitchCrw:         {PrefixSwitchBwCrw, PrefixSwitchCr},
+	PrefixSwitchCr:          {PrefixSwitchCrw},
+}
+
+func (s PrefixSwitchStatus) String() string {
+	switch s {
+	case PrefixSwitchBrw:
+		return statusBrw
+	case PrefixSwitchBrwCw:
+		return statusBrwCw
+	case PrefixSwitchBwCrw:
+		return statusBwCrw
+	case PrefixSwitchCrw:
+		return statusCrw
+	case PrefixSwitchCr:
+		return statusCr
+	case PrefixSwitchBrwCwVerify:
+		return statusBrwCwVerify
+	default:
+		return fmt.Sprintf("unknown(%d)", int(s))
+	}
+}
+
+// CanSwitchTo return true if a prefix can be switched from s to t without force
+func (s PrefixSwitchStatus) CanSwitchTo(t PrefixSwitchStatus) bool {
+	if s == t {
+		return true
+	}
+	for _, a := range allowedTransitions[s] {
+		if a == t {
+			return true
+		}
+	}
+	return false
+}
+
+// SwitchOperator is who changes the prefix status, Force skips the transition check,
+// Client is the address the change is requested from
+type SwitchOperator struct {
+	Who    string
+	Force  bool
+	Client string
+}
+
+// the last transition of each prefix is kept in this table in the keyspace
+// of the cfg table, see conf/prefix_transitions.cql
+const prefixTransitionTable = "prefix_transitions"
+
+// historyEnabled return true if the cfg table is in c*, then the history of
+// it is kept in the same keyspace
+func (c *DisPatcherCfg) historyEnabled() bool {
+	return c.CfgFromCstarKeySpace != "" && c.CfgFromCstarTable != ""
+}
+
+type PrefixTransition struct {
+	Prefix string    `json:"prefix"`
+	From   string    `json:"from"`
+	To     string    `json:"to"`
+	Who    string    `json:"who"`
+	Client string    `json:"client"`
+	When   time.Time `json:"when"`
+	Forced bool      `json:"forced"`
+}
+
+type IllegalTransitionError struct {
+	Prefix string
+	From   PrefixSwitchRule
+	To     PrefixSwitchRule
+}
+
+func (e *IllegalTransitionError) Error() string {
+	allowed := []string{}
+	if e.From.IsRollout() {
+		allowed = append(allowed, e.From.From.String(), e.From.To.String(), e.From.To.String()+"@<percent>")
+	} else {
+		for _, a := range allowedTransitions[e.From.To] {
+			allowed = append(allowed, a.String(), a.String()+"@<percent>")
+		}
+	}
+	return fmt.Sprintf(
+		"illegal switch of prefix %s from %s to %s, allowed: [%s], use force to skip stages",
+		e.Prefix, e.From, e.To, strings.Join(allowed, " "),
+	)
+}
+
+// canSwitch return true if a prefix can be switched from rule cur to next
+// without force. A prefix in rollout can only be ramped, completed or
+// rolled back.
+func canSwitch(cur, next PrefixSwitchRule) bool {
+	if cur.IsRollout() {
+		if next.IsRollout() {
+			return next.From == cur.From && next.To == cur.To
+		}
+		return next.To == cur.From || next.To == cur.To
+	}
+	if next.IsRollout() && next.From != cur.To {
+		return false
+	}
+	return cur.To.CanSwitchTo(next.To)
+}
+
+// currentRuleOf return the rule of prefix now, which is the rule of
+// the longest configured prefix of it, or the default one.
+// if exclude, prefix itself is not considered, i.e. the rule after it is deleted.
+// You should lock the s to prevent map update
+func (s *PrefixSwitcher) currentRuleOf(prefix string, exclude bool) PrefixSwitchRule {
+	longest := -1
+	rule := fullSwitchRule(s.defaultT)
+	for p, v := range s.currentTrieMap {
+		if !strings.HasPrefix(prefix, p) || len(p) <= longest || (exclude && p == prefix) {
+			continue
+		}
+		r, err := parseSwitchRule(v)
+		if err != nil || r.From < 0 {
+			continue
+		}
+		longest = len(p)
+		rule = r
+	}
+	return rule
+}
+
+// checkUpsert validate switching prefixes in data, which is {status: [prefix...]},
+// status may be "<to>@<percent>" to roll out from the current status of the prefix,
+// it returns the data to save with the from status filled.
+func (s *PrefixSwitcher) checkUpsert(data map[string][]string, op SwitchOperator) (
+	map[string][]string, []*PrefixTransition, error) {
+	rules := make(map[string]PrefixSwitchRule, len(data))
+	for v := range data {
+		r, err := parseSwitchRule(v)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s is not a validate rwstatus: %s", v, err)
+		}
+		rules[v] = r
+	}
+
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	now := time.Now()
+	resolved := make(map[string][]string)
+	transitions := []*PrefixTransition{}
+	for v, prefixes := range data {
+		for _, p := range prefixes {
+			cur := s.currentRuleOf(p, false)
+			next := rules[v]
+			if next.From < 0 {
+				next.From = cur.To
+				if cur.IsRollout() && cur.To == next.To {
+					// ramp
+					next.From = cur.From
+				}
+				if next.From == next.To {
+					next = fullSwitchRule(next.To)
+				}
+			}
+			ok := canSwitch(cur, next)
+			if !ok && !op.Force {
+				return nil, nil, &IllegalTransitionError{Prefix: p, From: cur, To: next}
+			}
+			resolved[next.String()] = append(resolved[next.String()], p)
+			transitions = append(transitions, &PrefixTransition{
+				Prefix: p, From: cur.String(), To: next.String(),
+				Who: op.Who, Client: op.Client, When: now, Forced: !ok,
+			})
+		}
+	}
+	sort.Slice(transitions, func(i, j int) bool {
+		return transitions[i].Prefix < transitions[j].Prefix
+	})
+	return resolved, transitions, nil
+}
+
+// checkDelete validate deleting prefix, keys of it fall back to the rule
+// of its parent prefix or the default one
+func (s *PrefixSwitcher) checkDelete(prefix string, op SwitchOperator) (*PrefixTransition, error) {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	if _, ok := s.currentTrieMap[prefix]; !ok {
+		return nil, nil
+	}
+	cur := s.currentRuleOf(prefix, false)
+	next := s.currentRuleOf(prefix, true)
+	ok := canSwitch(cur, next)
+	if !ok && !op.Force {
+		return nil, &IllegalTransitionError{Prefix: prefix, From: cur, To: next}
+	}
+	return &PrefixTransition{
+		Prefix: prefix, From: cur.String(), To: next.String(),
+		Who: op.Who, Client: op.Client, When: time.Now(), Forced: !ok,
+	}, nil
+}
+
+// recordTransitions keep transitions in memory, and save them to the keyspace
+// of cfg table dc so they survive restarts and are seen by all proxies
+func (s *PrefixSwitcher) recordTransitions(
+	dc DisPatcherCfg, cqlStore *CassandraStore, transitions ...*PrefixTransition) {
+	s.lock.Lock()
+	if s.transitions == nil {
+		s.transitions = make(map[string]*PrefixTransition)
+	}
+	for _, t := range transitions {
+		if t == nil {
+			continue
+		}
+		logger.Infof("prefix %s switched from %s to %s by %s, forced: %v",
+			t.Prefix, t.From, t.To, t.Who, t.Forced)
+		s.transitions[t.Prefix] = t
+	}
+	s.lock.Unlock()
+
+	if !dc.historyEnabled() {
+		return
+	}
+	for _, t := range transitions {
+		if t == nil {
+			continue
+		}
+		err := cqlStore.session.Query(
+			fmt.Sprintf(
+				"insert into %s.%s (cfg_table, prefix, from_rule, to_rule, who, client, forced, switched_at) "+
+					"values (?, ?, ?, ?, ?, ?, ?, ?)",
+				dc.CfgFromCstarKeySpace, prefixTransitionTable,
+			), dc.CfgFromCstarTable, t.Prefix, t.From, t.To, t.Who, t.Client, t.Forced, t.When,
+		).Exec()
+		if err != nil {
+			logger.Errorf("save transition of prefix %s %s -> %s err: %s", t.Prefix, t.From, t.To, err)
+		}
+	}
+}
+
+// UpsertBy validate and save prefix status in data, which is {status: [prefix...]},
+// status "<to>@<percent>" switch percent of keys of the prefix to status <to>
+func (s *PrefixSwitcher) UpsertBy(
+	cfg *config.CassandraStoreCfg, data map[string][]string,
+	cqlStore *CassandraStore, op SwitchOperator) error {
+	resolved, transitions, err := s.checkUpsert(data, op)
+	if err != nil {
+		return err
+	}
+	dispatcherCfg := DisPatcherCfg(cfg.PrefixRWDispatcherCfg)
+	if err := dispatcherCfg.SaveToDB(resolved, cqlStore); err != nil {
+		return err
+	}
+	s.recordTransitions(dispatcherCfg, cqlStore, transitions...)
+	return nil
+}
+
+// DeletePrefixBy validate and delete prefix status
+func (s *PrefixSwitcher) DeletePrefixBy(
+	cfg *config.CassandraStoreCfg, prefix string,
+	cqlStore *CassandraStore, op SwitchOperator) error {
+	transition, err := s.checkDelete(prefix, op)
+	if err != nil {
+		return err
+	}
+	dispatcherCfg := DisPatcherCfg(cfg.PrefixRWDispatcherCfg)
+	if err := dispatcherCfg.DeletePrefixCfg(prefix, cqlStore); err != nil {
+		return err
+	}
+	s.recordTransitions(dispatcherCfg, cqlStore, transition)
+	return nil
+}
+
+// GetTransitions return the last transition of each prefix, which is read from
+// the keyspace of cfg table if it is in c*, otherwise only transitions made
+// by this proxy since it started are known
+func (s *PrefixSwitcher) GetTransitions(
+	cfg *config.CassandraStoreCfg, cqlStore *CassandraStore) (map[string]*PrefixTransition, error) {
+	dc := DisPatcherCfg(cfg.PrefixRWDispatcherCfg)
+	if !dc.historyEnabled() {
+		s.lock.RLock()
+		defer s.lock.RUnlock()
+		r := make(map[string]*PrefixTransition, len(s.transitions))
+		for p, t := range s.transitions {
+			r[p] = t
+		}
+		return r, nil
+	}
+
+	scanner := cqlStore.session.Query(
+		fmt.Sprintf(
+			"select prefix, from_rule, to_rule, who, client, forced, switched_at from %s.%s where cfg_table = ?",
+			dc.CfgFromCstarKeySpace, prefixTransitionTable,
+		), dc.CfgFromCstarTable,
+	).Iter().Scanner()
+	r := make(map[string]*PrefixTransition)
+	for scanner.Next() {
+		t := &PrefixTransition{}
+		if err := scanner.Scan(&t.Prefix, &t.From, &t.To, &t.Who, &t.Client, &t.Forced, &t.When); err != nil {
+			return nil, fmt.Errorf("scan prefix transition err: %s", err)
+		}
+		r[t.Prefix] = t
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("list prefix transitions err: %s", err)
+	}
+	return r, nil
+}
@@ -8,6 +8,11 @@ import (
 	"github.com/gocql/gocql"
 )
 
+const (
+	// exptime larger than this is an absolute unix time, like memcache
+	MAX_RELATIVE_EXPTIME = 30 * 24 * 3600
+)
+
 type BDBValue struct {
 	ReceiveTime time.Time `cql:"rtime"`
 	Flag        int `cql:"flag"`
@@ -42,6 +47,40 @@ func (b *BDBValue) ToMCItem() (*mc.Item, error) {
 	return item, nil
 }
 
+// ExpireAt return the time when value expires by memcache exptime rules,
+// zero time means never expire
+func (b *BDBValue) ExpireAt() time.Time {
+	switch {
+	case b.Exptime == 0:
+		return time.Time{}
+	case b.Exptime < 0:
+		return b.ReceiveTime
+	case b.Exptime > MAX_RELATIVE_EXPTIME:
+		return time.Unix(int64(b.Exptime), 0)
+	default:
+		return b.ReceiveTime.Add(time.Duration(b.Exptime) * time.Second)
+	}
+}
+
+func (b *BDBValue) IsExpired(now time.Time) bool {
+	expireAt := b.ExpireAt()
+	return !expireAt.IsZero() && !now.Before(expireAt)
+}
+
+// TTL return seconds to live from now for `USING TTL`, 0 means never expire,
+// negative means expired already
+func (b *BDBValue) TTL(now time.Time) int {
+	expireAt := b.ExpireAt()
+	if expireAt.IsZero() {
+		return 0
+	}
+	left := expireAt.Sub(now)
+	if left <= 0 {
+		return -1
+	}
+	return int((left + time.Second - 1) / time.Second)
+}
+
 func (b BDBValue) MarshalUDT(name string, info gocql.TypeInfo) ([]byte, error) {
 	switch name {
 	case "rtime":
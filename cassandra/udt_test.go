@@ -0,0 +1,35 @@
+package cassandra
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBDBValueExpire(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+
+	testData := []struct {
+		exptime int
+		rtime   time.Time
+		expired bool
+		ttl     int
+	}{
+		{0, now.Add(-time.Hour), false, 0},
+		{10, now, false, 10},
+		{10, now.Add(-5 * time.Second), false, 5},
+		{10, now.Add(-10 * time.Second), true, -1},
+		{-1, now, true, -1},
+		// absolute unix time
+		{int(now.Unix()) + 100, now.Add(-time.Hour), false, 100},
+		{int(now.Unix()) - 1, now.Add(-time.Hour), true, -1},
+	}
+	for _, d := range testData {
+		v := &BDBValue{Exptime: d.exptime, ReceiveTime: d.rtime}
+		if v.IsExpired(now) != d.expired {
+			t.Errorf("exptime %d rtime %s expired should be %v", d.exptime, d.rtime, d.expired)
+		}
+		if ttl := v.TTL(now); ttl != d.ttl {
+			t.Errorf("exptime %d rtime %s ttl should be %d, got %d", d.exptime, d.rtime, d.ttl, ttl)
+		}
+	}
+}
@@ -42,6 +42,52 @@ type DStoreConfig struct {
 	ResponseTimeMin     float64 `yaml:"response_time_min,omitempty"`
 	Enable              bool    `yaml:"enable"`
 	Scheduler           string  `yaml:"scheduler,omitempty"`
+	// hedged read: fire the same get to next replica if the previous one
+	// does not answer in hedged_read_delay_ms, 0 means derive the delay
+	// from the latency of the host multiplied by hedged_read_latency_multiple
+	HedgedReadEnable          bool    `yaml:"hedged_read_enable,omitempty"`
+	HedgedReadDelayMs         int     `yaml:"hedged_read_delay_ms,omitempty"`
+	HedgedReadLatencyMultiple float64 `yaml:"hedged_read_latency_multiple,omitempty"`
+	// read repair: write the found item back to replicas which miss it,
+	// reads without missing replica check versions of replicas by chance
+	ReadRepairEnable      bool    `yaml:"read_repair_enable,omitempty"`
+	ReadRepairConcurrency int     `yaml:"read_repair_concurrency,omitempty"`
+	ReadRepairChance      float64 `yaml:"read_repair_chance,omitempty"`
+	// hinted handoff: record writes failed on main hosts under hinted_handoff_dir
+	// and replay them when the host is alive again
+	HintedHandoffEnable   bool   `yaml:"hinted_handoff_enable,omitempty"`
+	HintedHandoffDir      string `yaml:"hinted_handoff_dir,omitempty"`
+	HintedHandoffMaxHints int    `yaml:"hinted_handoff_max_hints,omitempty"`
+	HintedHandoffTTLSec   int    `yaml:"hinted_handoff_ttl_sec,omitempty"`
+	// quorum read: get versions of key from R replicas in parallel and
+	// return the newest value, stale replicas are repaired if quorum_read_repair
+	QuorumReadEnable bool `yaml:"quorum_read_enable,omitempty"`
+	QuorumReadRepair bool `yaml:"quorum_read_repair,omitempty"`
+	// how the host tried first is chosen in a bucket of buckets_manual scheduler:
+	// arc (default), least_outstanding, p2c_ewma or strict
+	BalanceStrategy string `yaml:"balance_strategy,omitempty"`
+	// windows of latency percentiles and error rates in /api/response_stats
+	// and /bucketinfo, hosts are scored by the latency of response_time_seconds:
+	// the average if score_percentile is 0, else its p50, p95 or p99
+	LatencyWindows  []int `yaml:"latency_windows_seconds,omitempty"`
+	ScorePercentile int   `yaml:"score_percentile,omitempty"`
+	// health check of each beansdb host, shared by all buckets of the host:
+	// health_check_cmd (get <key> or stats) is run every health_check_interval_ms,
+	// the host is down after health_check_fall failures in a row
+	// and up again after health_check_rise successes in a row
+	HealthCheckIntervalMs int    `yaml:"health_check_interval_ms,omitempty"`
+	HealthCheckTimeoutMs  int    `yaml:"health_check_timeout_ms,omitempty"`
+	HealthCheckCmd        string `yaml:"health_check_cmd,omitempty"`
+	HealthCheckRise       int    `yaml:"health_check_rise,omitempty"`
+	HealthCheckFall       int    `yaml:"health_check_fall,omitempty"`
+	// circuit breaker of each beansdb host: opened after circuit_breaker_failures
+	// timeouts or errors of requests in a row, requests to it fail fast for
+	// circuit_breaker_open_ms, then circuit_breaker_half_open_requests trial
+	// requests are sent and it is closed if all of them succeed
+	CircuitBreakerEnable           bool `yaml:"circuit_breaker_enable,omitempty"`
+	CircuitBreakerFailures         int  `yaml:"circuit_breaker_failures,omitempty"`
+	CircuitBreakerOpenMs           int  `yaml:"circuit_breaker_open_ms,omitempty"`
+	CircuitBreakerHalfOpenRequests int  `yaml:"circuit_breaker_half_open_requests,omitempty"`
 }
 
 type DualWErrCfg struct {
@@ -52,6 +98,11 @@ type DualWErrCfg struct {
 	Compress bool `yaml:"compress"`
 	MaxAges int `yaml:"max_ages"`
 	MaxBackups int `yaml:"max_backups"`
+	// retry failed c* writes by the value in beansdb, the queue is kept
+	// in segment files under dump_to_dir
+	RetryEnable bool `yaml:"retry_enable,omitempty"`
+	RetrySegmentSize int `yaml:"retry_segment_size,omitempty"`
+	RetryMaxBackoffSec int `yaml:"retry_max_backoff_sec,omitempty"`
 }
 
 type PrefixDisPatcherCfg struct {
@@ -79,9 +130,27 @@ type CassandraStoreCfg struct {
 	PasswordFile string `yaml:"password_file"`
 	Consistency string  `yaml:"consistency,omitempty"`
 	PrefixTableDispatcherCfg PrefixDisPatcherCfg `yaml:"prefix_table_dispatcher_cfg"`
+	// default TTL (seconds) of keys by prefix, used when exptime of item is 0
+	PrefixTTLCfg map[string]int `yaml:"prefix_ttl_cfg,omitempty"`
 	PrefixRWDispatcherCfg PrefixDisPatcherCfg `yaml:"prefix_rw_dispatcher_cfg"`
 	SwitchToKeyDefault string `yaml:"default_storage"`
 	DualWErrCfg DualWErrCfg `yaml:"dual_write_err_cfg"`
+	// write to c* with the time proxy received the request as timestamp,
+	// so an older write replayed later can not overwrite a newer one
+	UseReceiveTimeAsTimestamp bool `yaml:"use_receive_time_as_timestamp,omitempty"`
+	// shadow read for prefixes in verify status: sampled gets served by beansdb
+	// are also read from c* in background and compared
+	VerifyReadSampleRate float64 `yaml:"verify_read_sample_rate,omitempty"`
+	VerifyReadConcurrency int `yaml:"verify_read_concurrency,omitempty"`
+	VerifyMismatchLogSize int `yaml:"verify_mismatch_log_size,omitempty"`
+	// check prefix cfg in proxy.yaml and c* cfg table periodically,
+	// and reload it when changed, 0 means only reload by /cstar-cfg
+	CfgReloadIntervalSec int `yaml:"cfg_reload_interval_sec,omitempty"`
+	// coordinated prefix switch: proxies heartbeat into cfg_keyspace of
+	// prefix_rw_dispatcher_cfg, a switch PUT to /cstar-cfg is staged and
+	// activated after all alive proxies acknowledged it
+	CoordinatedSwitchEnable bool `yaml:"coordinated_switch_enable,omitempty"`
+	CoordinatedSwitchIntervalSec int `yaml:"coordinated_switch_interval_sec,omitempty"`
 }
 
 func (c *ProxyConfig) InitDefault() {
@@ -31,6 +31,21 @@ var (
 		ScoreDeviation:      10000, // 10000 Microseconds -> 10 Millisecond
 		ItemSizeStats:       4096,
 		ResponseTimeMin:     4000,
+		LatencyWindows:      []int{10, 60},
 		Enable:              true,
+
+		HedgedReadLatencyMultiple: 2,
+		ReadRepairConcurrency:     8,
+		HintedHandoffMaxHints:     100000,
+		HintedHandoffTTLSec:       3 * 3600,
+		HealthCheckIntervalMs:     5000,
+		HealthCheckTimeoutMs:      1000,
+		HealthCheckCmd:            "get @",
+		HealthCheckRise:           1,
+		HealthCheckFall:           3,
+
+		CircuitBreakerFailures:         5,
+		CircuitBreakerOpenMs:           10000,
+		CircuitBreakerHalfOpenRequests: 1,
 	}
 )
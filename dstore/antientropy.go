@@ -0,0 +1,296 @@
+package dstore
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	// hex digits of a child node in the htree listing of gobeansdb
+	htreeChildren = "0123456789abcdef"
+	// size of the header of record dumped by `@@keyhash`: crc, ts, flag, ver, ksz, vsz
+	recordHeaderSize = 24
+)
+
+// KeyVersion is the version of a key on one host, listed by `@path`
+type KeyVersion struct {
+	Ver   int `json:"ver"`
+	VHash int `json:"vhash"`
+}
+
+// KeyDiff is a key whose versions differ between the replicas of a bucket,
+// host missing the key is absent in Versions.
+type KeyDiff struct {
+	Key      string                 `json:"key"`
+	KeyHash  string                 `json:"keyhash"`
+	Versions map[string]*KeyVersion `json:"versions"`
+	Repaired []string               `json:"repaired,omitempty"`
+}
+
+type AntiEntropyReport struct {
+	Bucket string     `json:"bucket"`
+	Hosts  []string   `json:"hosts"`
+	Diffs  []*KeyDiff `json:"diffs"`
+	// number of `@path` listed on each host
+	Listed int      `json:"listed"`
+	Errors []string `json:"errors,omitempty"`
+}
+
+// htreeListing is the result of `@path`, a node of htree lists its children,
+// a leaf lists its items.
+type htreeListing struct {
+	nodes map[string]string
+	items map[string]*KeyVersion
+}
+
+func listHTree(host *Host, path string) (*htreeListing, error) {
+	l := &htreeListing{
+		nodes: make(map[string]string),
+		items: make(map[string]*KeyVersion),
+	}
+	item, err := host.Get("@" + path)
+	if err != nil {
+		return nil, err
+	}
+	if item == nil {
+		return l, nil
+	}
+	defer item.Free()
+
+	for _, line := range strings.Split(string(item.Body), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 {
+			continue
+		}
+		if strings.HasSuffix(fields[0], "/") {
+			// child: hash count
+			l.nodes[strings.TrimSuffix(fields[0], "/")] = fields[1] + " " + fields[2]
+			continue
+		}
+		vhash, err1 := strconv.Atoi(fields[1])
+		ver, err2 := strconv.Atoi(fields[2])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("bad listing line of @%s on %s: %q", path, host.Addr, line)
+		}
+		l.items[fields[0]] = &KeyVersion{Ver: ver, VHash: vhash}
+	}
+	return l, nil
+}
+
+// getKeyByHash get the key of keyhash from the record dumped by `@@keyhash`
+func getKeyByHash(host *Host, keyhash string) (string, error) {
+	item, err := host.Get("@@" + keyhash)
+	if err != nil {
+		return "", err
+	}
+	if item == nil {
+		return "", fmt.Errorf("keyhash %s not found on %s", keyhash, host.Addr)
+	}
+	defer item.Free()
+
+	body := item.Body
+	if len(body) < recordHeaderSize {
+		return "", fmt.Errorf("bad record of keyhash %s on %s", keyhash, host.Addr)
+	}
+	ksz := int(binary.LittleEndian.Uint32(body[16:20]))
+	if len(body) < recordHeaderSize+ksz {
+		return "", fmt.Errorf("bad record of keyhash %s on %s", keyhash, host.Addr)
+	}
+	return string(body[recordHeaderSize : recordHeaderSize+ksz]), nil
+}
+
+type antiEntropyChecker struct {
+	hosts  []*Host
+	report *AntiEntropyReport
+}
+
+func (ae *antiEntropyChecker) list(path string) ([]*htreeListing, bool) {
+	listings := make([]*htreeListing, len(ae.hosts))
+	for i, host := range ae.hosts {
+		l, err := listHTree(host, path)
+		if err != nil {
+			ae.report.Errors = append(ae.report.Errors, fmt.Sprintf("list @%s on %s: %s", path, host.Addr, err))
+			return nil, false
+		}
+		listings[i] = l
+	}
+	ae.report.Listed++
+	return listings, true
+}
+
+// collectItems list all items under path on host, descending into the children
+// when the node lists children instead of items.
+func (ae *antiEntropyChecker) collectItems(host *Host, path string, l *htreeListing, items map[string]*KeyVersion) bool {
+	for k, v := range l.items {
+		items[k] = v
+	}
+	for child, hashCount := range l.nodes {
+		if strings.HasSuffix(hashCount, " 0") {
+			continue
+		}
+		cl, err := listHTree(host, path+child)
+		if err != nil {
+			ae.report.Errors = append(ae.report.Errors, fmt.Sprintf("list @%s on %s: %s", path+child, host.Addr, err))
+			return false
+		}
+		if !ae.collectItems(host, path+child, cl, items) {
+			return false
+		}
+	}
+	return true
+}
+
+// compare the subtree of path on all hosts, only descend into the differing children
+func (ae *antiEntropyChecker) compare(path string) {
+	listings, ok := ae.list(path)
+	if !ok {
+		return
+	}
+
+	allNodes := true
+	for _, l := range listings {
+		if len(l.nodes) == 0 {
+			allNodes = false
+			break
+		}
+	}
+	if allNodes {
+		for _, c := range htreeChildren {
+			child := string(c)
+			for _, l := range listings[1:] {
+				if l.nodes[child] != listings[0].nodes[child] {
+					ae.compare(path + child)
+					break
+				}
+			}
+		}
+		return
+	}
+
+	// leaf on some host, the number of items under a node decides
+	// whether items or children are listed, so compare items of all hosts
+	hostItems := make([]map[string]*KeyVersion, len(ae.hosts))
+	keyhashes := make(map[string]struct{})
+	for i, host := range ae.hosts {
+		hostItems[i] = make(map[string]*KeyVersion)
+		if !ae.collectItems(host, path, listings[i], hostItems[i]) {
+			return
+		}
+		for kh := range hostItems[i] {
+			keyhashes[kh] = struct{}{}
+		}
+	}
+	for kh := range keyhashes {
+		diff := &KeyDiff{KeyHash: kh, Versions: make(map[string]*KeyVersion)}
+		same := true
+		var first *KeyVersion
+		for i, host := range ae.hosts {
+			v, ok := hostItems[i][kh]
+			if !ok {
+				same = false
+				continue
+			}
+			diff.Versions[host.Addr] = v
+			if first == nil {
+				first = v
+			} else if *v != *first {
+				same = false
+			}
+		}
+		if same {
+			continue
+		}
+		for _, host := range ae.hosts {
+			if _, ok := diff.Versions[host.Addr]; ok {
+				key, err := getKeyByHash(host, kh)
+				if err != nil {
+					ae.report.Errors = append(ae.report.Errors, err.Error())
+				}
+				diff.Key = key
+				break
+			}
+		}
+		ae.report.Diffs = append(ae.report.Diffs, diff)
+	}
+}
+
+// repair copy the newest version of key in diff to the other hosts,
+// keys with same version but different values are left alone.
+func (ae *antiEntropyChecker) repair(diff *KeyDiff) {
+	if diff.Key == "" {
+		return
+	}
+	var src *Host
+	var newest *ItemMeta
+	conflict := false
+	for _, host := range ae.hosts {
+		v, ok := diff.Versions[host.Addr]
+		if !ok {
+			continue
+		}
+		if newest != nil && abs(v.Ver) == abs(newest.Ver) && v.VHash != newest.VHash {
+			conflict = true
+		}
+		if newest == nil || abs(v.Ver) > abs(newest.Ver) {
+			meta, err := host.GetMeta(diff.Key)
+			if err != nil || meta == nil {
+				ae.report.Errors = append(ae.report.Errors, fmt.Sprintf("get meta of %s on %s: %v", diff.Key, host.Addr, err))
+				return
+			}
+			src, newest = host, meta
+			conflict = false
+		}
+	}
+	if newest == nil || conflict {
+		return
+	}
+	for _, host := range ae.hosts {
+		if host == src {
+			continue
+		}
+		if v, ok := diff.Versions[host.Addr]; ok && abs(v.Ver) >= abs(newest.Ver) {
+			continue
+		}
+		if err := syncKeyTo(diff.Key, src, newest, host); err != nil {
+			ae.report.Errors = append(ae.report.Errors, fmt.Sprintf("repair %s from %s to %s: %s", diff.Key, src.Addr, host.Addr, err))
+			continue
+		}
+		diff.Repaired = append(diff.Repaired, host.Addr)
+	}
+}
+
+// CheckBucket compare the hash trees of the main replicas of bucket, report
+// the differing keys, and copy the newest version to others if repair is true.
+func CheckBucket(bucketID int, repair bool) (*AntiEntropyReport, error) {
+	sch, ok := GetScheduler().(*ManualScheduler)
+	if !ok {
+		return nil, fmt.Errorf("anti-entropy needs scheduler %s", BucketsManualSchduler)
+	}
+	if bucketID < 0 || bucketID >= len(sch.bucketsCon) {
+		return nil, fmt.Errorf("bucket %x not exists", bucketID)
+	}
+
+	path := fmt.Sprintf("%0*x", sch.bucketWidth/4, bucketID)
+	ae := &antiEntropyChecker{
+		report: &AntiEntropyReport{Bucket: path, Hosts: []string{}, Diffs: []*KeyDiff{}},
+	}
+	for i, host := range sch.GetHostsByKey("@" + path) {
+		if i < sch.N && host != nil {
+			ae.hosts = append(ae.hosts, host)
+			ae.report.Hosts = append(ae.report.Hosts, host.Addr)
+		}
+	}
+	if len(ae.hosts) < 2 {
+		return ae.report, nil
+	}
+
+	ae.compare(path)
+	if repair {
+		for _, diff := range ae.report.Diffs {
+			ae.repair(diff)
+		}
+	}
+	return ae.report, nil
+}
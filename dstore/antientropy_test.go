@@ -0,0 +1,65 @@
+package dstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func findKeyDiff(report *AntiEntropyReport, key string) *KeyDiff {
+	for _, diff := range report.Diffs {
+		if diff.Key == key {
+			return diff
+		}
+	}
+	return nil
+}
+
+func TestAntiEntropy(t *testing.T) {
+	teardown := setupSuite(t)
+	defer teardown(t)
+	assert := assert.New(t)
+
+	c := newDStoreOnlyClient()
+	sch := GetScheduler().(*ManualScheduler)
+
+	key := fmt.Sprintf("/test/antientropy/%d", time.Now().UnixNano())
+	bucketID := getBucketByKey(sch.hashMethod, sch.bucketWidth, key)
+	hosts := sch.GetHostsByKey(key)[:c.N]
+	item := newItem(0, []byte("antientropy"))
+	for _, host := range hosts[1:] {
+		ok, err := host.Set(key, item, false)
+		assert.True(ok)
+		assert.Nil(err)
+	}
+	item.Free()
+
+	report, err := CheckBucket(bucketID, false)
+	assert.Nil(err)
+	assert.Equal(c.N, len(report.Hosts))
+	diff := findKeyDiff(report, key)
+	if assert.NotNil(diff) {
+		assert.Equal(c.N-1, len(diff.Versions))
+		assert.Nil(diff.Versions[hosts[0].Addr])
+	}
+	meta, _ := hosts[0].GetMeta(key)
+	assert.Nil(meta)
+
+	report, err = CheckBucket(bucketID, true)
+	assert.Nil(err)
+	diff = findKeyDiff(report, key)
+	if assert.NotNil(diff) {
+		assert.Equal([]string{hosts[0].Addr}, diff.Repaired)
+	}
+	meta, _ = hosts[0].GetMeta(key)
+	assert.NotNil(meta)
+
+	report, err = CheckBucket(bucketID, false)
+	assert.Nil(err)
+	assert.Nil(findKeyDiff(report, key))
+
+	_, err = CheckBucket(len(sch.bucketsCon), false)
+	assert.NotNil(err)
+}
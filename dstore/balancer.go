@@ -0,0 +1,198 @@
+package dstore
+
+import (
+	"math"
+	"math/rand"
+)
+
+// strategies to choose the host tried first in a bucket, set by balance_strategy
+const (
+	// the host owning key by arcs, which are moved from slow hosts to fast ones
+	BalanceArc = "arc"
+	// the alive host with the least outstanding requests
+	BalanceLeastOutstanding = "least_outstanding"
+	// the better of two random alive hosts by EWMA latency and outstanding requests
+	BalanceP2CEWMA = "p2c_ewma"
+	// the fixed owner of key, never moved by latencies, or the next alive
+	// host after it in partition order if it is down
+	BalanceStrict = "strict"
+
+	// weight of the newest latency in EWMA
+	EWMA_ALPHA = 0.3
+)
+
+// Balancer choose the host of a bucket to try first for a key
+type Balancer interface {
+	Name() string
+	// Pick return the index of host in bucket.hostsList
+	Pick(bucket *Bucket, key string) int
+	// ReBalance is called by the scheduler periodically
+	ReBalance(bucket *Bucket)
+}
+
+func IsValidBalanceStrategy(name string) bool {
+	switch name {
+	case "", BalanceArc, BalanceLeastOutstanding, BalanceP2CEWMA, BalanceStrict:
+		return true
+	}
+	return false
+}
+
+// newBalancer return the balancer of strategy name, arc if unknown
+func newBalancer(name string) Balancer {
+	switch name {
+	case BalanceLeastOutstanding:
+		return leastOutstandingBalancer{}
+	case BalanceP2CEWMA:
+		return p2cEWMABalancer{}
+	case BalanceStrict:
+		return strictBalancer{}
+	}
+	return arcBalancer{}
+}
+
+type arcBalancer struct{}
+
+func (arcBalancer) Name() string {
+	return BalanceArc
+}
+
+func (arcBalancer) Pick(bucket *Bucket, key string) int {
+	return bucket.partition.offsetGet(key)
+}
+
+func (arcBalancer) ReBalance(bucket *Bucket) {
+	bucket.reScore()
+	bucket.balance()
+}
+
+type strictBalancer struct{}
+
+func (strictBalancer) Name() string {
+	return BalanceStrict
+}
+
+// Pick return the first alive host from the owner of key in partition order,
+// so keys of a down host fail over to the same host, or the owner if all are down
+func (strictBalancer) Pick(bucket *Bucket, key string) int {
+	owner := bucket.partition.ownerGet(key)
+	n := len(bucket.hostsList)
+	for i := 0; i < n; i++ {
+		if idx := (owner + i) % n; bucket.hostsList[idx].isAlive() {
+			return idx
+		}
+	}
+	return owner
+}
+
+func (strictBalancer) ReBalance(bucket *Bucket) {
+	bucket.reScore()
+}
+
+type leastOutstandingBalancer struct{}
+
+func (leastOutstandingBalancer) Name() string {
+	return BalanceLeastOutstanding
+}
+
+// Pick prefer the owner of key if it is one of the least loaded
+func (leastOutstandingBalancer) Pick(bucket *Bucket, key string) int {
+	owner := bucket.partition.ownerGet(key)
+	picked := -1
+	var least int64
+	for i, host := range bucket.hostsList {
+		if !host.isAlive() {
+			continue
+		}
+		n := host.host.Outstanding()
+		if picked < 0 || n < least || (n == least && i == owner) {
+			picked, least = i, n
+		}
+	}
+	if picked < 0 {
+		return owner
+	}
+	return picked
+}
+
+func (leastOutstandingBalancer) ReBalance(bucket *Bucket) {
+	bucket.reScore()
+}
+
+type p2cEWMABalancer struct{}
+
+func (p2cEWMABalancer) Name() string {
+	return BalanceP2CEWMA
+}
+
+func (p2cEWMABalancer) Pick(bucket *Bucket, key string) int {
+	alive := make([]int, 0, len(bucket.hostsList))
+	for i, host := range bucket.hostsList {
+		if host.isAlive() {
+			alive = append(alive, i)
+		}
+	}
+	switch len(alive) {
+	case 0:
+		return bucket.partition.ownerGet(key)
+	case 1:
+		return alive[0]
+	}
+	a := rand.Intn(len(alive))
+	b := rand.Intn(len(alive) - 1)
+	if b >= a {
+		b++
+	}
+	x, y := alive[a], alive[b]
+	if bucket.hostsList[y].cost() < bucket.hostsList[x].cost() {
+		return y
+	}
+	return x
+}
+
+func (p2cEWMABalancer) ReBalance(bucket *Bucket) {
+	bucket.reScore()
+}
+
+// EWMA latency (Microsecond) of host in bucket
+func (hb *HostInBucket) EWMA() float64 {
+	return math.Float64frombits(hb.ewma.Load())
+}
+
+// updateEWMA is only called by the feedback goroutine of scheduler
+func (hb *HostInBucket) updateEWMA(latency float64) {
+	old := hb.EWMA()
+	if old == 0 {
+		hb.ewma.Store(math.Float64bits(latency))
+		return
+	}
+	hb.ewma.Store(math.Float64bits(old*(1-EWMA_ALPHA) + latency*EWMA_ALPHA))
+}
+
+// cost of sending a request to host, requests queued wait for each other
+func (hb *HostInBucket) cost() float64 {
+	return hb.EWMA() * float64(hb.host.Outstanding()+1)
+}
+
+// HostBalanceStats is the status of a host in bucket used by balancers
+type HostBalanceStats struct {
+	Alive       bool    `json:"alive"`
+	Arc         int     `json:"arc"`
+	Score       float64 `json:"score"`
+	EWMA        float64 `json:"ewma"`
+	Outstanding int64   `json:"outstanding"`
+}
+
+func (bucket *Bucket) balanceStats() map[string]*HostBalanceStats {
+	r := make(map[string]*HostBalanceStats, len(bucket.hostsList))
+	for i, host := range bucket.hostsList {
+		r[host.host.Addr] = &HostBalanceStats{
+			Alive:       host.isAlive(),
+			Arc:         bucket.partition.getArc(i),
+			Score:       host.score,
+			EWMA:        host.EWMA(),
+			Outstanding: host.host.Outstanding(),
+		}
+	}
+	return r
+}
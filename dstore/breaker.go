@@ -0,0 +1,195 @@
+package dstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// states of circuit breaker
+const (
+	// requests are sent to the host
+	BreakerClosed = "closed"
+	// requests fail fast without sending, until circuit_breaker_open_ms passed
+	BreakerOpen = "open"
+	// a few trial requests are sent, the breaker is closed if all of them
+	// succeed, or opened again if any fails
+	BreakerHalfOpen = "half_open"
+)
+
+var breakerStateValues = map[string]float64{
+	BreakerClosed:   0,
+	BreakerHalfOpen: 1,
+	BreakerOpen:     2,
+}
+
+// CircuitBreaker stop sending requests to a host failing continuously,
+// a nil breaker is always closed
+type CircuitBreaker struct {
+	addr     string
+	failures int
+	openFor  time.Duration
+	trials   int
+
+	sync.Mutex
+	state string
+	// consecutive failures in closed state
+	failed int
+	// trial requests sent and succeeded in half open state
+	sent      int
+	succeeded int
+	openUntil time.Time
+}
+
+// newCircuitBreaker return nil if circuit breaker is not enabled
+func newCircuitBreaker(addr string) *CircuitBreaker {
+	if !proxyConf.CircuitBreakerEnable {
+		return nil
+	}
+	b := &CircuitBreaker{
+		addr:     addr,
+		failures: proxyConf.CircuitBreakerFailures,
+		openFor:  time.Duration(proxyConf.CircuitBreakerOpenMs) * time.Millisecond,
+		trials:   proxyConf.CircuitBreakerHalfOpenRequests,
+		state:    BreakerClosed,
+	}
+	if b.failures <= 0 {
+		b.failures = 5
+	}
+	if b.openFor <= 0 {
+		b.openFor = 10 * time.Second
+	}
+	if b.trials <= 0 {
+		b.trials = 1
+	}
+	circuitBreakerState.WithLabelValues(addr).Set(breakerStateValues[BreakerClosed])
+	return b
+}
+
+func (b *CircuitBreaker) State() string {
+	if b == nil {
+		return BreakerClosed
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.state == BreakerOpen && !time.Now().Before(b.openUntil) {
+		// will be half open on the next request
+		return BreakerHalfOpen
+	}
+	return b.state
+}
+
+// IsOpen return true if requests to the host fail fast now
+func (b *CircuitBreaker) IsOpen() bool {
+	return b.State() == BreakerOpen
+}
+
+// setState must be called with lock held
+func (b *CircuitBreaker) setState(state string) {
+	if b.state == state {
+		return
+	}
+	logger.Infof("circuit breaker of %s: %s -> %s", b.addr, b.state, state)
+	b.state = state
+	circuitBreakerTransitions.WithLabelValues(b.addr, state).Inc()
+	circuitBreakerState.WithLabelValues(b.addr).Set(breakerStateValues[state])
+}
+
+// Allow return an error starts with WAIT_FOR_RETRY if the request should not be sent,
+// otherwise Done must be called with the result of the request
+func (b *CircuitBreaker) Allow() error {
+	if b == nil {
+		return nil
+	}
+	b.Lock()
+	defer b.Unlock()
+	switch b.state {
+	case BreakerOpen:
+		if time.Now().Before(b.openUntil) {
+			return fmt.Errorf("%s: circuit breaker open until %s",
+				WAIT_FOR_RETRY, b.openUntil.Format("2006-01-02T15:04:05.999"))
+		}
+		b.setState(BreakerHalfOpen)
+		b.sent, b.succeeded = 0, 0
+		fallthrough
+	case BreakerHalfOpen:
+		if b.sent >= b.trials {
+			return fmt.Errorf("%s: circuit breaker half open, waiting for %d trial requests",
+				WAIT_FOR_RETRY, b.trials)
+		}
+		b.sent++
+	}
+	return nil
+}
+
+// Done record the result of a request allowed
+func (b *CircuitBreaker) Done(err error) {
+	if b == nil {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	if isWaitForRetry(err) {
+		// not sent, e.g. dial is silenced, give the trial back
+		if b.state == BreakerHalfOpen && b.sent > 0 {
+			b.sent--
+		}
+		return
+	}
+	switch b.state {
+	case BreakerClosed:
+		if err == nil {
+			b.failed = 0
+			return
+		}
+		b.failed++
+		if b.failed >= b.failures {
+			b.open()
+		}
+	case BreakerHalfOpen:
+		if err != nil {
+			b.open()
+			return
+		}
+		b.succeeded++
+		if b.succeeded >= b.trials {
+			b.failed = 0
+			b.setState(BreakerClosed)
+		}
+	}
+}
+
+// open must be called with lock held
+func (b *CircuitBreaker) open() {
+	b.openUntil = time.Now().Add(b.openFor)
+	b.setState(BreakerOpen)
+}
+
+// closedFirst move hosts whose circuit breaker is open to the end, keeping the order
+func closedFirst(hosts []*Host) []*Host {
+	if !proxyConf.CircuitBreakerEnable {
+		return hosts
+	}
+	open := make([]bool, len(hosts))
+	n := 0
+	for i, host := range hosts {
+		if open[i] = host.breaker.IsOpen(); open[i] {
+			n++
+		}
+	}
+	if n == 0 || n == len(hosts) {
+		return hosts
+	}
+	r := make([]*Host, 0, len(hosts))
+	for i, host := range hosts {
+		if !open[i] {
+			r = append(r, host)
+		}
+	}
+	for i, host := range hosts {
+		if open[i] {
+			r = append(r, host)
+		}
+	}
+	return r
+}
@@ -0,0 +1,114 @@
+package dstore
+
+import (
+	"errors"
+	"net"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/douban/gobeansproxy/config"
+	"github.com/douban/gobeansproxy/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCircuitBreaker(t *testing.T) {
+	assert := assert.New(t)
+	b := &CircuitBreaker{
+		addr:     "10.0.0.1:1234",
+		failures: 3,
+		openFor:  50 * time.Millisecond,
+		trials:   2,
+		state:    BreakerClosed,
+	}
+	timeout := errors.New("i/o timeout")
+
+	// a success resets consecutive failures
+	for _, err := range []error{timeout, timeout, nil, timeout, timeout} {
+		assert.Nil(b.Allow())
+		b.Done(err)
+	}
+	assert.Equal(BreakerClosed, b.State())
+	assert.Nil(b.Allow())
+	b.Done(timeout)
+	assert.Equal(BreakerOpen, b.State())
+	assert.True(b.IsOpen())
+	err := b.Allow()
+	assert.True(isWaitForRetry(err), "%v", err)
+
+	// half open after open_ms, only trials are allowed
+	time.Sleep(60 * time.Millisecond)
+	assert.Equal(BreakerHalfOpen, b.State())
+	assert.Nil(b.Allow())
+	assert.Nil(b.Allow())
+	assert.True(isWaitForRetry(b.Allow()))
+	// a trial not sent is given back
+	b.Done(err)
+	assert.Nil(b.Allow())
+	// any failed trial opens it again
+	b.Done(nil)
+	b.Done(timeout)
+	assert.Equal(BreakerOpen, b.State())
+
+	// closed after all trials succeed
+	time.Sleep(60 * time.Millisecond)
+	assert.Nil(b.Allow())
+	assert.Nil(b.Allow())
+	b.Done(nil)
+	assert.Equal(BreakerHalfOpen, b.State())
+	b.Done(nil)
+	assert.Equal(BreakerClosed, b.State())
+
+	// nil breaker is always closed
+	var disabled *CircuitBreaker
+	assert.Nil(disabled.Allow())
+	disabled.Done(timeout)
+	assert.Equal(BreakerClosed, disabled.State())
+}
+
+func TestHostCircuitBreaker(t *testing.T) {
+	homeDir := utils.GetProjectHomeDir()
+	confdir := path.Join(homeDir, "conf")
+	proxyConf := &config.Proxy
+	proxyConf.Load(confdir)
+	assert := assert.New(t)
+
+	old := proxyConf.DStoreConfig
+	defer func() { proxyConf.DStoreConfig = old }()
+	proxyConf.CircuitBreakerEnable = true
+	proxyConf.CircuitBreakerFailures = 2
+	proxyConf.CircuitBreakerOpenMs = 60000
+	proxyConf.ReadTimeoutMs = 50
+
+	// accept connections but never answer
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	hung := NewHost(ln.Addr().String())
+	defer hung.Close()
+	for i := 0; i < 2; i++ {
+		_, err = hung.Get("key")
+		assert.NotNil(err)
+		assert.False(isWaitForRetry(err))
+	}
+	assert.Equal(BreakerOpen, hung.CircuitState())
+	start := time.Now()
+	_, err = hung.Get("key")
+	assert.True(isWaitForRetry(err), "%v", err)
+	assert.True(time.Since(start) < 10*time.Millisecond, "fail fast")
+
+	// open hosts are tried last
+	a, c := NewHost("10.0.0.1:1234"), NewHost("10.0.0.3:1234")
+	assert.Equal([]*Host{a, c, hung}, closedFirst([]*Host{a, hung, c}))
+	assert.Equal([]*Host{hung}, closedFirst([]*Host{hung}))
+}
@@ -2,23 +2,26 @@ package dstore
 
 import (
 	"sort"
+	"sync/atomic"
 	"time"
 )
 
-const RINGLEN = 60
 const CONSISTENTLEN = 100
 
 type HostInBucket struct {
 	status   bool
 	score    float64
 	host     *Host
-	lantency *RingQueue
+	latency  *LatencyTracker
+	// float64 bits of EWMA latency, see updateEWMA
+	ewma atomic.Uint64
 }
 
 type Bucket struct {
 	ID        int
 	hostsList []*HostInBucket
 	partition *Partition
+	balancer  Balancer
 }
 
 type ByName []*HostInBucket
@@ -44,6 +47,7 @@ func newBucket(id int, hosts ...*Host) *Bucket {
 	}
 	sort.Sort(ByName(bucket.hostsList))
 	bucket.partition = NewPartition(CONSISTENTLEN, len(bucket.hostsList))
+	bucket.balancer = newBalancer(proxyConf.BalanceStrategy)
 	return bucket
 }
 
@@ -52,13 +56,16 @@ func newHostInBucket(host *Host) *HostInBucket {
 		status:   true,
 		score:    0,
 		host:     host,
-		lantency: NewRingQueue(),
+		latency:  NewLatencyTracker(latencySeconds()),
 	}
 }
 
-// get host by key
+// get host by key, the one picked by balancer is the first
 func (bucket *Bucket) GetHosts(key string) (hosts []*Host) {
-	hostIndex := bucket.partition.offsetGet(key)
+	if len(bucket.hostsList) == 0 {
+		return
+	}
+	hostIndex := bucket.balancer.Pick(bucket, key)
 	for i, host := range bucket.hostsList {
 		if i != hostIndex {
 			hosts = append(hosts, host.host)
@@ -69,29 +76,26 @@ func (bucket *Bucket) GetHosts(key string) (hosts []*Host) {
 	return
 }
 
+// GetPrimaryHost return the owner of key by the initial partition of bucket
+func (bucket *Bucket) GetPrimaryHost(key string) (*Host, bool) {
+	if len(bucket.hostsList) == 0 {
+		return nil, false
+	}
+	hostBucket := bucket.hostsList[bucket.partition.ownerGet(key)]
+	return hostBucket.host, hostBucket.status
+}
+
 func (bucket *Bucket) ReBalance() {
-	bucket.reScore()
-	bucket.balance()
+	bucket.balancer.ReBalance(bucket)
 }
 
 func (bucket *Bucket) reScore() {
 	for _, host := range bucket.hostsList {
-		var Sum float64
-		var count int
 		// while the host is down/
 		if host.status == false {
 			host.score = 0
 		} else {
-			latencies := host.lantency.Get(proxyConf.ResTimeSeconds, latencyDataType)
-			for _, latency := range latencies {
-				Sum += latency.Sum
-				count += latency.Count
-			}
-			if count > 0 {
-				host.score = Sum / float64(count)
-			} else {
-				host.score = 0
-			}
+			host.score = scoreOf(host.latency.Stats(proxyConf.ResTimeSeconds))
 		}
 	}
 }
@@ -153,22 +157,23 @@ func (bucket *Bucket) getModify() (fromHost, toHost int) {
 // return false if have too much connection errors
 func (bucket *Bucket) isHostAlive(addr string) bool {
 	_, host := bucket.getHostByAddr(addr)
-	errs := host.lantency.Get(proxyConf.ErrorSeconds, errorDataType)
-	count := 0
-	for _, err := range errs {
-		count += err.Count
-	}
-	return count < proxyConf.MaxConnectErrors
+	return host.latency.Stats(proxyConf.ErrorSeconds).Errors < proxyConf.MaxConnectErrors
 }
 
 func (bucket *Bucket) riseHost(addr string) {
 	// TODO 清除历史上的 Errors
 	// 还需要清除 response time
 	// TODO Lock
-	_, hostBucket := bucket.getHostByAddr(addr)
+	index, hostBucket := bucket.getHostByAddr(addr)
 	if hostBucket.status == false {
 		hostBucket.status = true
-		hostBucket.lantency.clear()
+		hostBucket.latency.clear()
+		if index >= 0 {
+			bucket.partition.add(index)
+		}
+		if hints := GetHintStore(); hints != nil {
+			hints.Wakeup(addr)
+		}
 	}
 }
 
@@ -178,13 +183,14 @@ func (bucket *Bucket) addLatency(host string, startTime time.Time, latency float
 	if latency > 0 && !hostBucket.isAlive() {
 		bucket.riseHost(host)
 	}
-	hostBucket.lantency.Push(startTime, latency, latencyDataType)
+	hostBucket.latency.Record(startTime, latency)
+	hostBucket.updateEWMA(latency)
 }
 
 func (bucket *Bucket) addConErr(host string, startTime time.Time, error float64) {
 	_, hostBucket := bucket.getHostByAddr(host)
 	if hostBucket.isAlive() {
-		hostBucket.lantency.Push(startTime, error, errorDataType)
+		hostBucket.latency.RecordError(startTime)
 		hostisalive := bucket.isHostAlive(host)
 		if !hostisalive {
 			bucket.downHost(host)
@@ -210,7 +216,8 @@ func (bucket *Bucket) downHost(addr string) {
 
 func (hb *HostInBucket) down() {
 	hb.status = false
-	hb.lantency.clear()
+	hb.latency.clear()
+	hb.ewma.Store(0)
 }
 
 func (hb *HostInBucket) isAlive() bool {
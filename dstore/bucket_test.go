@@ -1,6 +1,7 @@
 package dstore
 
 import (
+	"fmt"
 	"path"
 	"sync"
 	"testing"
@@ -121,3 +122,82 @@ func TestDownHost(t *testing.T) {
 		}
 	}
 }
+
+func TestBalancers(t *testing.T) {
+	hosts := []*Host{
+		NewHost("10.0.0.1:1234"),
+		NewHost("10.0.0.2:1234"),
+		NewHost("10.0.0.3:1234"),
+	}
+	keys := []string{}
+	for i := 0; i < 100; i++ {
+		keys = append(keys, fmt.Sprintf("/test/balance/%d", i))
+	}
+
+	bucket := newBucket(0, hosts...)
+	bucket.balancer = newBalancer(BalanceStrict)
+	bucket.partition.reBalance(0, 1, 20)
+	for _, key := range keys {
+		owner := bucket.partition.ownerGet(key)
+		if got := bucket.GetHosts(key)[0]; got != bucket.hostsList[owner].host {
+			t.Errorf("strict should pick owner %d of %s, got %s", owner, key, got.Addr)
+		}
+	}
+	// keys of a down owner go to the next alive host
+	bucket.hostsList[1].down()
+	for _, key := range keys {
+		owner := bucket.partition.ownerGet(key)
+		want := owner
+		if owner == 1 {
+			want = 2
+		}
+		if got := bucket.balancer.Pick(bucket, key); got != want {
+			t.Errorf("strict should pick %d for %s owned by %d, got %d", want, key, owner, got)
+		}
+	}
+	bucket.hostsList[2].down()
+	bucket.hostsList[0].down()
+	if got, owner := bucket.balancer.Pick(bucket, keys[0]), bucket.partition.ownerGet(keys[0]); got != owner {
+		t.Errorf("strict should pick owner %d if all are down, got %d", owner, got)
+	}
+
+	bucket = newBucket(0, hosts...)
+	bucket.balancer = newBalancer(BalanceLeastOutstanding)
+	bucket.hostsList[0].host.outstanding.Add(3)
+	bucket.hostsList[1].host.outstanding.Add(1)
+	bucket.hostsList[2].host.outstanding.Add(2)
+	for _, key := range keys {
+		if got := bucket.GetHosts(key); got[0] != bucket.hostsList[1].host || len(got) != 3 {
+			t.Fatalf("least outstanding should pick host 1 first, got %v", got)
+		}
+	}
+	bucket.hostsList[1].down()
+	if got := bucket.balancer.Pick(bucket, keys[0]); got != 2 {
+		t.Errorf("down host should not be picked, got %d", got)
+	}
+	for _, h := range hosts {
+		h.outstanding.Store(0)
+	}
+
+	bucket = newBucket(0, hosts...)
+	bucket.balancer = newBalancer(BalanceP2CEWMA)
+	bucket.hostsList[0].updateEWMA(1000)
+	bucket.hostsList[1].updateEWMA(100)
+	bucket.hostsList[2].updateEWMA(5000)
+	picked := make(map[int]int)
+	for i := 0; i < 1000; i++ {
+		picked[bucket.balancer.Pick(bucket, keys[0])]++
+	}
+	// the slowest host never wins, the fastest wins all its pairs
+	if picked[2] != 0 || picked[1] < picked[0] {
+		t.Errorf("p2c picked %v", picked)
+	}
+	bucket.hostsList[1].updateEWMA(100000)
+	if e := bucket.hostsList[1].EWMA(); e != 100*(1-EWMA_ALPHA)+100000*EWMA_ALPHA {
+		t.Errorf("ewma got %f", e)
+	}
+
+	if newBalancer("unknown").Name() != BalanceArc || IsValidBalanceStrategy("unknown") {
+		t.Errorf("unknown strategy should fallback to arc")
+	}
+}
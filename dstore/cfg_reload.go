@@ -0,0 +1,175 @@
+package dstore
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/douban/gobeansproxy/cassandra"
+	"github.com/douban/gobeansproxy/config"
+)
+
+const (
+	CFG_RWSWITCHER  = "rwswitcher"
+	CFG_TABLEFINDER = "tablefinder"
+)
+
+var cfgReloaders = map[string]*CfgReloader{}
+
+// reloadableDispatcher is a prefix dispatcher whose cfg can be compared
+// with the cfg in proxy.yaml and c* cfg table by version
+type reloadableDispatcher interface {
+	cassandra.PrefixDisPatcher
+	CfgVersion() (uint32, time.Time)
+	RemoteCfgVersion(*config.CassandraStoreCfg, *cassandra.CassandraStore) (uint32, error)
+}
+
+type CfgReloadStatus struct {
+	Version   uint32    `json:"version"`
+	LoadedAt  time.Time `json:"loaded_at"`
+	LastCheck time.Time `json:"last_check"`
+	LastError string    `json:"last_error"`
+	Interval  string    `json:"interval"`
+}
+
+// CfgReloader check the cfg of a prefix dispatcher periodically,
+// and reload it when the cfg in proxy.yaml or c* cfg table is changed,
+// so all proxies get the same cfg without POST /cstar-cfg to each of them.
+type CfgReloader struct {
+	name       string
+	confdir    string
+	interval   time.Duration
+	dispatcher reloadableDispatcher
+	cqlStore   *cassandra.CassandraStore
+	// do not reload if hold returns true
+	hold func() bool
+
+	sync.Mutex
+	lastCheck time.Time
+	lastErr   string
+	quit      chan struct{}
+}
+
+func GetCfgReloader(name string) *CfgReloader {
+	return cfgReloaders[name]
+}
+
+// StartCfgReloader check the cfg every interval unless hold, which may be nil, returns true
+func StartCfgReloader(name, confdir string, interval time.Duration,
+	dispatcher reloadableDispatcher, cqlStore *cassandra.CassandraStore, hold func() bool) *CfgReloader {
+	r := &CfgReloader{
+		name:       name,
+		confdir:    confdir,
+		interval:   interval,
+		dispatcher: dispatcher,
+		cqlStore:   cqlStore,
+		hold:       hold,
+		quit:       make(chan struct{}),
+	}
+	r.updateMetrics()
+	cfgReloaders[name] = r
+	go r.run()
+	return r
+}
+
+func (r *CfgReloader) run() {
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.quit:
+			return
+		case <-ticker.C:
+			if _, err := r.Check(); err != nil {
+				logger.Errorf("check %s cfg err: %s", r.name, err)
+			}
+		}
+	}
+}
+
+func (r *CfgReloader) Stop() {
+	close(r.quit)
+}
+
+// Check reload the cfg if it is changed, return true if reloaded
+func (r *CfgReloader) Check() (reloaded bool, err error) {
+	defer func() {
+		r.Lock()
+		r.lastCheck = time.Now()
+		r.lastErr = ""
+		if err != nil {
+			r.lastErr = err.Error()
+		}
+		r.Unlock()
+		switch {
+		case err != nil:
+			cstarCfgReloads.WithLabelValues(r.name, "failed").Inc()
+		case reloaded:
+			cstarCfgReloads.WithLabelValues(r.name, "reloaded").Inc()
+		default:
+			cstarCfgReloads.WithLabelValues(r.name, "unchanged").Inc()
+		}
+		r.updateMetrics()
+	}()
+
+	if r.hold != nil && r.hold() {
+		return false, nil
+	}
+	cfg, err := r.dispatcher.LoadStaticCfg(r.confdir)
+	if err != nil {
+		return false, fmt.Errorf("load static cfg err: %s", err)
+	}
+	remote, err := r.dispatcher.RemoteCfgVersion(cfg, r.cqlStore)
+	if err != nil {
+		return false, fmt.Errorf("get cfg version err: %s", err)
+	}
+	if local, _ := r.dispatcher.CfgVersion(); local == remote {
+		return false, nil
+	}
+	if err := r.dispatcher.LoadCfg(cfg, r.cqlStore); err != nil {
+		return false, fmt.Errorf("load cfg err: %s", err)
+	}
+	version, _ := r.dispatcher.CfgVersion()
+	logger.Infof("%s cfg reloaded, version: %d", r.name, version)
+	return true, nil
+}
+
+func (r *CfgReloader) updateMetrics() {
+	version, loadedAt := r.dispatcher.CfgVersion()
+	cstarCfgVersion.WithLabelValues(r.name).Set(float64(version))
+	cstarCfgLoadedTime.WithLabelValues(r.name).Set(float64(loadedAt.Unix()))
+}
+
+func (r *CfgReloader) Status() *CfgReloadStatus {
+	version, loadedAt := r.dispatcher.CfgVersion()
+	r.Lock()
+	defer r.Unlock()
+	return &CfgReloadStatus{
+		Version:   version,
+		LoadedAt:  loadedAt,
+		LastCheck: r.lastCheck,
+		LastError: r.lastErr,
+		Interval:  r.interval.String(),
+	}
+}
+
+// startCfgReloaders reload prefix cfg every cfg_reload_interval_sec if set
+func startCfgReloaders(pCfg *config.ProxyConfig, cstar *cassandra.CassandraStore, switcher *cassandra.PrefixSwitcher) {
+	ccfg := pCfg.CassandraStoreCfg
+	if ccfg.CfgReloadIntervalSec <= 0 || pCfg.Confdir == "" {
+		return
+	}
+	interval := time.Duration(ccfg.CfgReloadIntervalSec) * time.Second
+	if ccfg.PrefixRWDispatcherCfg.Enable {
+		var hold func() bool
+		if PrefixSwitchCoordinator != nil {
+			// switches are applied by the coordinator at the same time on all proxies
+			hold = PrefixSwitchCoordinator.Holding
+		}
+		StartCfgReloader(CFG_RWSWITCHER, pCfg.Confdir, interval, switcher, cstar, hold)
+	}
+	if ccfg.PrefixTableDispatcherCfg.Enable {
+		StartCfgReloader(CFG_TABLEFINDER, pCfg.Confdir, interval, cstar.GetPrefixTableFinder(), cstar, nil)
+	}
+	logger.Infof("reload c* prefix cfg every %s", interval)
+}
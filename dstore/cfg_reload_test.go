@@ -0,0 +1,103 @@
+package dstore
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/douban/gobeansproxy/cassandra"
+	"github.com/douban/gobeansproxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeDispatcher has cfg version remote in proxy.yaml and c* cfg table
+type fakeDispatcher struct {
+	version  uint32
+	loadedAt time.Time
+	remote   uint32
+	loads    int
+	err      error
+}
+
+func (d *fakeDispatcher) LoadStaticCfg(string) (*config.CassandraStoreCfg, error) {
+	return &config.CassandraStoreCfg{}, nil
+}
+
+func (d *fakeDispatcher) LoadCfg(*config.CassandraStoreCfg, *cassandra.CassandraStore) error {
+	if d.err != nil {
+		return d.err
+	}
+	d.loads++
+	d.version = d.remote
+	d.loadedAt = time.Now()
+	return nil
+}
+
+func (d *fakeDispatcher) Upsert(*config.CassandraStoreCfg, map[string][]string, *cassandra.CassandraStore) error {
+	return nil
+}
+
+func (d *fakeDispatcher) DeletePrefix(*config.CassandraStoreCfg, string, *cassandra.CassandraStore) error {
+	return nil
+}
+
+func (d *fakeDispatcher) GetCurrentMap() map[string]string {
+	return nil
+}
+
+func (d *fakeDispatcher) CfgVersion() (uint32, time.Time) {
+	return d.version, d.loadedAt
+}
+
+func (d *fakeDispatcher) RemoteCfgVersion(*config.CassandraStoreCfg, *cassandra.CassandraStore) (uint32, error) {
+	return d.remote, nil
+}
+
+func TestCfgReloader(t *testing.T) {
+	assert := assert.New(t)
+	d := &fakeDispatcher{version: 1, remote: 1}
+	r := StartCfgReloader("test", "conf", time.Hour, d, nil, nil)
+	defer r.Stop()
+	assert.Equal(r, GetCfgReloader("test"))
+
+	reloaded, err := r.Check()
+	assert.Nil(err)
+	assert.False(reloaded)
+	assert.Equal(0, d.loads)
+
+	d.remote = 2
+	reloaded, err = r.Check()
+	assert.Nil(err)
+	assert.True(reloaded)
+	assert.Equal(uint32(2), r.Status().Version)
+	assert.Equal("", r.Status().LastError)
+
+	d.remote = 3
+	d.err = errors.New("c* down")
+	reloaded, err = r.Check()
+	assert.NotNil(err)
+	assert.False(reloaded)
+	assert.Equal(uint32(2), r.Status().Version)
+	assert.Contains(r.Status().LastError, "c* down")
+
+	// reloaded once recovered
+	d.err = nil
+	reloaded, err = r.Check()
+	assert.Nil(err)
+	assert.True(reloaded)
+	assert.Equal(uint32(3), r.Status().Version)
+	assert.Equal(2, d.loads)
+
+	// not reloaded while held
+	holding := true
+	held := StartCfgReloader("test_held", "conf", time.Hour, d, nil, func() bool { return holding })
+	defer held.Stop()
+	d.remote = 4
+	reloaded, err = held.Check()
+	assert.Nil(err)
+	assert.False(reloaded)
+	holding = false
+	reloaded, err = held.Check()
+	assert.Nil(err)
+	assert.True(reloaded)
+}
@@ -11,11 +11,16 @@ const (
 )
 
 // 一致性哈希变种
+// 环 [0, count) 按 offsets 切分给各节点，未摘除的节点 i 负责
+// [offsets[p], offsets[i])，p 是 i 之前最近的未摘除节点。
 type Partition struct {
 	sync.RWMutex
 
 	count   int
 	offsets []int
+	removed []bool
+	// 初始 (未经 rebalance 和摘除) 的 offsets
+	initial []int
 }
 
 /* --- Partition -------------------------------------------------------------- */
@@ -23,12 +28,13 @@ func NewPartition(count int, nodesNum int) *Partition {
 	partition := &Partition{
 		count:   count,
 		offsets: []int{},
+		removed: make([]bool, nodesNum),
 	}
-	lenNodes := partition.count / nodesNum
 
 	for i := 0; i < nodesNum; i++ {
-		partition.offsets = append(partition.offsets, lenNodes*i)
+		partition.offsets = append(partition.offsets, count*i/nodesNum)
 	}
+	partition.initial = append([]int{}, partition.offsets...)
 	return partition
 }
 
@@ -39,34 +45,73 @@ func (partition *Partition) hash(key string) int {
 	return int(hash.Sum32()) % partition.count
 }
 
+// 之前最近的未摘除节点，没有则返回 index
 func (partition *Partition) getPre(index int) (pre int) {
-	return (index - 1 + 3) % 3
+	return preAlive(partition.removed, len(partition.offsets), index)
 }
 
+// 之后最近的未摘除节点，没有则返回 index
 func (partition *Partition) getNext(index int) (next int) {
-	return (index + 1 + 3) % 3
+	n := len(partition.offsets)
+	for next = (index + 1) % n; next != index; next = (next + 1) % n {
+		if !partition.removed[next] {
+			return
+		}
+	}
+	return
+}
+
+// removed 为 nil 时所有节点都未摘除
+func preAlive(removed []bool, n int, index int) (pre int) {
+	for pre = (index - 1 + n) % n; pre != index; pre = (pre - 1 + n) % n {
+		if removed == nil || !removed[pre] {
+			return
+		}
+	}
+	return
 }
 
+// 摘除节点：前一半弧分给前一个节点，后一半分给后一个节点。
 func (partition *Partition) remove(host int) {
 	partition.Lock()
 	defer partition.Unlock()
-	//TODO 只允许有三个节点
-	preIndex := partition.getPre(host)        //(host - 1 + 3) % 3
-	offsetsPre := partition.offsets[preIndex] //partition.offsets[preIndex]
-	offsetsCount := 0
-	if offsetsPre > partition.offsets[host] {
-		offsetsCount = (partition.offsets[host] + partition.count - offsetsPre)
-	} else {
-		offsetsCount = (partition.offsets[host] - offsetsPre)
+	if partition.removed[host] {
+		return
+	}
+	pre := partition.getPre(host)
+	if pre != host {
+		mid := partition.offsets[pre] + partition.getArc(host)/2
+		partition.offsets[pre] = partition.clearOffset(mid)
 	}
-	prevalue := partition.offsets[preIndex] + (offsetsCount / 2)
-	partition.offsets[preIndex] = partition.clearOffset(prevalue)
-	partition.offsets[host] = partition.offsets[preIndex]
+	partition.removed[host] = true
 }
 
-// 获取某一段弧长
+// 恢复已摘除的节点：分走后一个节点的前一半弧。
+func (partition *Partition) add(host int) {
+	partition.Lock()
+	defer partition.Unlock()
+	if !partition.removed[host] {
+		return
+	}
+	pre, next := partition.getPre(host), partition.getNext(host)
+	arc := partition.getArc(next)
+	partition.removed[host] = false
+	if next == host {
+		// 其他节点都已摘除
+		return
+	}
+	partition.offsets[host] = partition.clearOffset(partition.offsets[pre] + arc/2)
+}
+
+// 获取某一段弧长，已摘除的节点为 0
 func (partition *Partition) getArc(index int) int {
+	if partition.removed[index] {
+		return 0
+	}
 	indexPre := partition.getPre(index)
+	if indexPre == index {
+		return partition.count
+	}
 	arc := partition.offsets[index] - partition.offsets[indexPre]
 	if arc < 0 {
 		arc += partition.count
@@ -74,29 +119,41 @@ func (partition *Partition) getArc(index int) int {
 	return arc
 }
 
+// 把 from 节点 step 长度的弧移给 to 节点，
+// 两者不相邻时经过的节点弧长不变，只是整体平移。
 func (partition *Partition) reBalance(indexFrom, indexTo int, step int) {
 	partition.Lock()
 	defer partition.Unlock()
-	// from 节点的下一个节点
-	fromNext := partition.getNext(indexFrom) //(indexFrom + 1 + 3) % 3
-
-	if indexTo == fromNext {
-		fromPre := partition.getPre(indexFrom) //(indexFrom - 1 + 3) % 3
-		step = partition.clearStep(indexFrom, fromPre, step)
-		value := partition.offsets[indexFrom] - step
-		partition.offsets[indexFrom] = partition.clearOffset(value)
+	if indexFrom == indexTo || partition.removed[indexFrom] || partition.removed[indexTo] {
+		return
+	}
+	step = partition.clearStep(indexFrom, step)
+	// 顺时针和逆时针方向上 from 到 to 之间的节点数
+	forward, backward := 0, 0
+	for i := indexFrom; i != indexTo; i = partition.getNext(i) {
+		forward++
+	}
+	for i := indexTo; i != indexFrom; i = partition.getNext(i) {
+		backward++
+	}
+	if forward <= backward {
+		// from 和之后节点的终点往回移
+		for i := indexFrom; i != indexTo; i = partition.getNext(i) {
+			partition.offsets[i] = partition.clearOffset(partition.offsets[i] - step)
+		}
 	} else {
-		toNext := partition.getNext(indexTo) //(indexTo + 1 + 3) % 3
-		step = partition.clearStep(toNext, indexTo, step)
-		value := partition.offsets[indexTo] + step
-		partition.offsets[indexTo] = partition.clearOffset(value)
+		// to 和之后节点的终点往前移
+		for i := indexTo; i != indexFrom; i = partition.getNext(i) {
+			partition.offsets[i] = partition.clearOffset(partition.offsets[i] + step)
+		}
 	}
 }
 
-func (partition *Partition) clearStep(modify, indexPre, step int) int {
-	interval := partition.offsets[modify] - partition.offsets[indexPre] - MINKEYS
+// 至少在 modify 节点保留 MINKEYS
+func (partition *Partition) clearStep(modify, step int) int {
+	interval := partition.getArc(modify) - MINKEYS
 	if interval < 0 {
-		interval += partition.count
+		interval = 0
 	}
 	if step > interval {
 		step = interval
@@ -107,74 +164,37 @@ func (partition *Partition) clearStep(modify, indexPre, step int) int {
 func (partition *Partition) clearOffset(offset int) int {
 	if offset < 0 {
 		offset += partition.count
-	} else if offset > partition.count {
+	} else if offset >= partition.count {
 		offset = offset % partition.count
 	}
 	return offset
 }
 
+// locate 返回 offsets 切分下负责 index 的节点
+func locate(offsets []int, removed []bool, index int) int {
+	for i := range offsets {
+		if removed != nil && removed[i] {
+			continue
+		}
+		pre := preAlive(removed, len(offsets), i)
+		start, end := offsets[pre], offsets[i]
+		if pre == i || (start <= end && start <= index && index < end) ||
+			// 跨过 0 点
+			(start > end && (index >= start || index < end)) {
+			return i
+		}
+	}
+	return 0
+}
+
+// 按初始 (未经 rebalance) 的弧长获取匹配主键，不随节点的延迟和宕机变化。
+func (partition *Partition) ownerGet(key string) int {
+	return locate(partition.initial, nil, partition.hash(key))
+}
+
 // 获取匹配主键。
 func (partition *Partition) offsetGet(key string) int {
 	partition.RLock()
 	defer partition.RUnlock()
-
-	//       A    0
-	//            |
-	//     	   -------
-	//     	 /         \   B
-	//      /   		\
-	//     /             \
-	//    |              | -- 1
-	//     \             /
-	//      \   		/
-	//     	 \         /
-	//   2--  ---------
-	//              C
-	//  A: 2<-A->0
-	//  B: 0<-B->1
-	//  C: 1<-C->2
-
-	index := partition.hash(key)
-	// like offset[0] == 98, offset[1] == 32, offset [2] ==66
-	// [98, 32, 66]
-	// [98, 32, 98]
-	// [98, 32, 32]
-	if partition.offsets[0] > partition.offsets[1] {
-		if index < partition.offsets[1] {
-			return 1
-		} else if index < partition.offsets[2] {
-			return 2
-		} else if index < partition.offsets[0] {
-			return 0
-		} else {
-			return 1
-		}
-
-		// like offset 0 == 23, offset 1 == 88, offset 2 == 1
-		// [23, 88, 1]
-		// [32, 88 ,32]
-		// [88, 88, 32]
-	} else if partition.offsets[2] < partition.offsets[1] {
-		if index < partition.offsets[2] {
-			return 2
-		} else if index < partition.offsets[0] {
-			return 0
-		} else if index < partition.offsets[1] {
-			return 1
-		} else {
-			return 2
-		}
-
-		// offset 0 = 3 ,offset 1 = 34, offset 2 == 67
-		// [3, 34, 67]
-		// [3, 3, 67]
-		// [3, 67, 67]
-	} else {
-		for i, value := range partition.offsets {
-			if index < value {
-				return i
-			}
-		}
-		return 0
-	}
+	return locate(partition.offsets, partition.removed, partition.hash(key))
 }
@@ -2,6 +2,7 @@ package dstore
 
 import (
 	"fmt"
+	"math/rand"
 	"strconv"
 	"testing"
 
@@ -71,6 +72,125 @@ func TestConsistentMulti(t *testing.T) {
 
 }
 
+// 初始主键与 offsetGet 一致，且不随 rebalance 和故障变化。
+func TestConsistentOwner(t *testing.T) {
+	assert := assert.New(t)
+	hashs := NewPartition(100, 3)
+	owners := make(map[string]int)
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owners[key] = hashs.ownerGet(key)
+		assert.Equal(hashs.offsetGet(key), owners[key])
+	}
+
+	hashs.reBalance(0, 2, 20)
+	hashs.remove(1)
+	for key, owner := range owners {
+		assert.Equal(owner, hashs.ownerGet(key))
+	}
+}
+
+// 检查弧长之和为 count，且每个 key 都落在弧长不为 0 的节点上
+func checkPartition(t *testing.T, hashs *Partition, keys []string) map[string]int {
+	sum := 0
+	for i := range hashs.offsets {
+		sum += hashs.getArc(i)
+	}
+	if sum != hashs.count {
+		t.Fatalf("sum of arcs %d != %d, offsets %v removed %v", sum, hashs.count, hashs.offsets, hashs.removed)
+	}
+	owners := make(map[string]int, len(keys))
+	for _, key := range keys {
+		s := hashs.offsetGet(key)
+		if hashs.getArc(s) == 0 {
+			t.Fatalf("key %s got host %d without arc, offsets %v removed %v", key, s, hashs.offsets, hashs.removed)
+		}
+		owners[key] = s
+	}
+	return owners
+}
+
+// 任意节点数，摘除、恢复和 rebalance 后弧长之和不变，且只影响相关节点的 key
+func TestConsistentAnyNodes(t *testing.T) {
+	assert := assert.New(t)
+	keys := []string{}
+	for i := 0; i < 2000; i++ {
+		keys = append(keys, fmt.Sprintf("key%d", i))
+	}
+	r := rand.New(rand.NewSource(1))
+
+	for n := 1; n <= 7; n++ {
+		hashs := NewPartition(CONSISTENTLEN, n)
+		for i := 0; i < n; i++ {
+			arc := hashs.getArc(i)
+			assert.True(arc >= CONSISTENTLEN/n && arc <= CONSISTENTLEN/n+1, "n %d arc %d", n, arc)
+		}
+		initial := checkPartition(t, hashs, keys)
+		for _, key := range keys {
+			assert.Equal(initial[key], hashs.ownerGet(key))
+		}
+
+		for round := 0; round < 200; round++ {
+			before := checkPartition(t, hashs, keys)
+			host := r.Intn(n)
+			switch op := r.Intn(3); op {
+			case 0:
+				alive := 0
+				for i := range hashs.removed {
+					if !hashs.removed[i] {
+						alive++
+					}
+				}
+				if alive == 1 {
+					continue
+				}
+				hashs.remove(host)
+				after := checkPartition(t, hashs, keys)
+				for key, owner := range before {
+					if owner != host {
+						assert.Equal(owner, after[key], "n %d remove %d moved key %s", n, host, key)
+					}
+					assert.NotEqual(host, after[key])
+				}
+			case 1:
+				wasRemoved := hashs.removed[host]
+				hashs.add(host)
+				after := checkPartition(t, hashs, keys)
+				for key, owner := range before {
+					if after[key] != owner {
+						assert.True(wasRemoved)
+						assert.Equal(host, after[key], "n %d add %d moved key %s", n, host, key)
+					}
+				}
+			case 2:
+				to := r.Intn(n)
+				arcs := make([]int, n)
+				for i := range arcs {
+					arcs[i] = hashs.getArc(i)
+				}
+				step := r.Intn(10)
+				hashs.reBalance(host, to, step)
+				checkPartition(t, hashs, keys)
+				for i := range arcs {
+					if i != host && i != to {
+						assert.Equal(arcs[i], hashs.getArc(i), "n %d rebalance %d -> %d", n, host, to)
+					}
+				}
+				if host != to && !hashs.removed[host] && !hashs.removed[to] {
+					moved := arcs[host] - hashs.getArc(host)
+					assert.Equal(moved, hashs.getArc(to)-arcs[to])
+					assert.True(hashs.getArc(host) >= MINKEYS || arcs[host] < MINKEYS)
+				}
+			}
+		}
+
+		// 主键不随 rebalance 和故障变化
+		for _, key := range keys {
+			assert.Equal(initial[key], hashs.ownerGet(key))
+		}
+	}
+}
+
 // 哈希函数性能。
 func BenchmarkConsistentHash(b *testing.B) {
 	h := NewPartition(100, 3)
@@ -0,0 +1,544 @@
+package dstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	mc "github.com/douban/gobeansdb/memcache"
+)
+
+const (
+	DUALW_RETRY_SEGMENT_PREFIX = "dualw_retry_"
+	DUALW_RETRY_SEGMENT_SUFFIX = ".seg"
+	DUALW_RETRY_CHECKPOINT     = "dualw_retry.checkpoint"
+	// entries of a segment file when retry_segment_size is not set
+	DUALW_RETRY_SEGMENT_SIZE = 10000
+	DUALW_RETRY_MIN_BACKOFF  = time.Second
+	// max backoff when retry_max_backoff_sec is not set
+	DUALW_RETRY_MAX_BACKOFF = 5 * time.Minute
+	// check the queue periodically even if no wakeup
+	DUALW_RETRY_IDLE_INTERVAL = 10 * time.Second
+	// save checkpoint every n entries done
+	DUALW_RETRY_CHECKPOINT_EVERY = 100
+)
+
+var (
+	globalDualWRetryQueue *DualWRetryQueue
+
+	errDualWRetryPaused = errors.New("dual write retry queue is paused")
+)
+
+// DualWRetryEntry is a c* write of key failed in dual write, the value is
+// not saved, the value in beansdb is written to c* when retrying.
+type DualWRetryEntry struct {
+	Key  string    `json:"key"`
+	Op   string    `json:"op"`
+	Time time.Time `json:"time"`
+}
+
+type DualWRetryStats struct {
+	Pending      int     `json:"pending"`
+	Segments     int     `json:"segments"`
+	OldestAgeSec float64 `json:"oldest_age_sec"`
+	Paused       bool    `json:"paused"`
+	Backoff      string  `json:"backoff"`
+	LastError    string  `json:"last_error"`
+}
+
+// DualWRetryQueue is a durable queue of failed dual writes, entries are
+// appended to segment files <dir>/dualw_retry_<seq>.seg, and the progress
+// of the oldest segment is saved in <dir>/dualw_retry.checkpoint.
+type DualWRetryQueue struct {
+	dir         string
+	segmentSize int
+	maxBackoff  time.Duration
+	// apply retry an entry, it is applyDualWRetry except in tests
+	apply func(*DualWRetryEntry) error
+
+	sync.Mutex
+	segments   []int
+	counts     map[int]int
+	nextSeq    int
+	writer     *os.File
+	writerSeq  int
+	readOffset int
+	oldest     time.Time
+	paused     bool
+	backoff    time.Duration
+	lastErr    string
+
+	// only one of worker and Drain processes the queue at a time
+	procLock sync.Mutex
+	wakeup   chan struct{}
+	quit     chan struct{}
+}
+
+func GetDualWRetryQueue() *DualWRetryQueue {
+	return globalDualWRetryQueue
+}
+
+func InitGlobalDualWRetryQueue(dir string, segmentSize int, maxBackoff time.Duration) (*DualWRetryQueue, error) {
+	q, err := NewDualWRetryQueue(dir, segmentSize, maxBackoff)
+	if err != nil {
+		return nil, err
+	}
+	globalDualWRetryQueue = q
+	go q.run()
+	return q, nil
+}
+
+func NewDualWRetryQueue(dir string, segmentSize int, maxBackoff time.Duration) (*DualWRetryQueue, error) {
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a dir or not exists", dir)
+	}
+	if segmentSize <= 0 {
+		segmentSize = DUALW_RETRY_SEGMENT_SIZE
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = DUALW_RETRY_MAX_BACKOFF
+	}
+	q := &DualWRetryQueue{
+		dir:         dir,
+		segmentSize: segmentSize,
+		maxBackoff:  maxBackoff,
+		apply:       applyDualWRetry,
+		counts:      make(map[int]int),
+		wakeup:      make(chan struct{}, 1),
+		quit:        make(chan struct{}),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, DUALW_RETRY_SEGMENT_PREFIX+"*"+DUALW_RETRY_SEGMENT_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		name := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(p), DUALW_RETRY_SEGMENT_PREFIX), DUALW_RETRY_SEGMENT_SUFFIX)
+		seq, err := strconv.Atoi(name)
+		if err != nil {
+			logger.Warnf("skip bad dual write retry segment %s", p)
+			continue
+		}
+		entries, err := q.readSegment(seq)
+		if err != nil {
+			return nil, err
+		}
+		q.segments = append(q.segments, seq)
+		q.counts[seq] = len(entries)
+	}
+	sort.Ints(q.segments)
+	if len(q.segments) > 0 {
+		q.nextSeq = q.segments[len(q.segments)-1] + 1
+		q.readOffset = q.loadCheckpoint(q.segments[0])
+		entries, _ := q.readSegment(q.segments[0])
+		if q.readOffset < len(entries) {
+			q.oldest = entries[q.readOffset].Time
+		}
+	}
+	q.updateGauges()
+	return q, nil
+}
+
+func (q *DualWRetryQueue) segmentPath(seq int) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%s%d%s", DUALW_RETRY_SEGMENT_PREFIX, seq, DUALW_RETRY_SEGMENT_SUFFIX))
+}
+
+func (q *DualWRetryQueue) readSegment(seq int) ([]*DualWRetryEntry, error) {
+	f, err := os.Open(q.segmentPath(seq))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	entries := []*DualWRetryEntry{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		e := new(DualWRetryEntry)
+		if err := json.Unmarshal(scanner.Bytes(), e); err != nil {
+			// the last line may be broken when proxy crashed
+			continue
+		}
+		entries = append(entries, e)
+	}
+	return entries, scanner.Err()
+}
+
+// loadCheckpoint return the number of entries done in segment seq
+func (q *DualWRetryQueue) loadCheckpoint(seq int) int {
+	data, err := os.ReadFile(filepath.Join(q.dir, DUALW_RETRY_CHECKPOINT))
+	if err != nil {
+		return 0
+	}
+	var cseq, offset int
+	if _, err := fmt.Sscanf(string(data), "%d %d", &cseq, &offset); err != nil || cseq != seq {
+		return 0
+	}
+	return offset
+}
+
+// saveCheckpoint must hold the lock
+func (q *DualWRetryQueue) saveCheckpoint() {
+	if len(q.segments) == 0 {
+		os.Remove(filepath.Join(q.dir, DUALW_RETRY_CHECKPOINT))
+		return
+	}
+	path := filepath.Join(q.dir, DUALW_RETRY_CHECKPOINT)
+	tmp := path + ".tmp"
+	data := fmt.Sprintf("%d %d\n", q.segments[0], q.readOffset)
+	if err := os.WriteFile(tmp, []byte(data), 0644); err != nil {
+		logger.Errorf("save dual write retry checkpoint err: %s", err)
+		return
+	}
+	if err := os.Rename(tmp, path); err != nil {
+		logger.Errorf("save dual write retry checkpoint err: %s", err)
+	}
+}
+
+// pending must hold the lock
+func (q *DualWRetryQueue) pending() int {
+	n := -q.readOffset
+	for _, c := range q.counts {
+		n += c
+	}
+	return n
+}
+
+// updateGauges must hold the lock
+func (q *DualWRetryQueue) updateGauges() {
+	dualWRetryQueueDepth.Set(float64(q.pending()))
+	if q.oldest.IsZero() {
+		dualWRetryQueueAge.Set(0)
+	} else {
+		dualWRetryQueueAge.Set(time.Since(q.oldest).Seconds())
+	}
+}
+
+// closeWriter must hold the lock
+func (q *DualWRetryQueue) closeWriter() {
+	if q.writer != nil {
+		q.writer.Close()
+		q.writer = nil
+	}
+}
+
+// Add record a c* write of key failed in dual write
+func (q *DualWRetryQueue) Add(key, op string) {
+	q.Lock()
+	defer q.Unlock()
+
+	if q.writer == nil || q.counts[q.writerSeq] >= q.segmentSize {
+		q.closeWriter()
+		seq := q.nextSeq
+		f, err := os.OpenFile(q.segmentPath(seq), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			logger.Errorf("create dual write retry segment err: %s, drop %s %s", err, op, key)
+			return
+		}
+		q.nextSeq++
+		q.writer, q.writerSeq = f, seq
+		q.segments = append(q.segments, seq)
+		q.counts[seq] = 0
+	}
+
+	e := &DualWRetryEntry{Key: key, Op: op, Time: time.Now()}
+	b, _ := json.Marshal(e)
+	if _, err := q.writer.Write(append(b, '\n')); err != nil {
+		logger.Errorf("write dual write retry segment err: %s, drop %s %s", err, op, key)
+		return
+	}
+	if q.pending() == 0 {
+		q.oldest = e.Time
+	}
+	q.counts[q.writerSeq]++
+	q.updateGauges()
+
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// List return at most limit pending entries from the oldest
+func (q *DualWRetryQueue) List(limit int) []*DualWRetryEntry {
+	q.Lock()
+	segments := append([]int{}, q.segments...)
+	offset := q.readOffset
+	q.Unlock()
+
+	r := []*DualWRetryEntry{}
+	for i, seq := range segments {
+		entries, err := q.readSegment(seq)
+		if err != nil {
+			continue
+		}
+		if i == 0 && offset <= len(entries) {
+			entries = entries[offset:]
+		}
+		for _, e := range entries {
+			if len(r) >= limit {
+				return r
+			}
+			r = append(r, e)
+		}
+	}
+	return r
+}
+
+func (q *DualWRetryQueue) Stats() *DualWRetryStats {
+	q.Lock()
+	defer q.Unlock()
+	q.updateGauges()
+	s := &DualWRetryStats{
+		Pending:   q.pending(),
+		Segments:  len(q.segments),
+		Paused:    q.paused,
+		Backoff:   q.backoff.String(),
+		LastError: q.lastErr,
+	}
+	if !q.oldest.IsZero() {
+		s.OldestAgeSec = time.Since(q.oldest).Seconds()
+	}
+	return s
+}
+
+func (q *DualWRetryQueue) Pause() {
+	q.Lock()
+	defer q.Unlock()
+	q.paused = true
+}
+
+func (q *DualWRetryQueue) Resume() {
+	q.Lock()
+	q.paused = false
+	q.backoff = 0
+	q.Unlock()
+	select {
+	case q.wakeup <- struct{}{}:
+	default:
+	}
+}
+
+// Drain retry all pending entries at once even if the queue is paused,
+// stop at the first failure.
+func (q *DualWRetryQueue) Drain() (int, error) {
+	return q.process(true)
+}
+
+func (q *DualWRetryQueue) Close() {
+	close(q.quit)
+	q.Lock()
+	defer q.Unlock()
+	q.closeWriter()
+}
+
+func (q *DualWRetryQueue) run() {
+	wait := DUALW_RETRY_IDLE_INTERVAL
+	for {
+		select {
+		case <-q.quit:
+			return
+		case <-q.wakeup:
+		case <-time.After(wait):
+		}
+
+		_, err := q.process(false)
+		q.Lock()
+		if err != nil && err != errDualWRetryPaused {
+			if q.backoff == 0 {
+				q.backoff = DUALW_RETRY_MIN_BACKOFF
+			} else if q.backoff *= 2; q.backoff > q.maxBackoff {
+				q.backoff = q.maxBackoff
+			}
+			wait = q.backoff
+		} else {
+			q.backoff = 0
+			wait = DUALW_RETRY_IDLE_INTERVAL
+		}
+		q.Unlock()
+		if err != nil && err != errDualWRetryPaused {
+			// do not retry at once when woken up by new entries
+			select {
+			case <-q.quit:
+				return
+			case <-time.After(wait):
+			}
+		}
+	}
+}
+
+// process retry pending entries in order until the queue is empty,
+// stop at the first failure and keep the entry in queue.
+func (q *DualWRetryQueue) process(ignorePause bool) (done int, err error) {
+	q.procLock.Lock()
+	defer q.procLock.Unlock()
+
+	for {
+		q.Lock()
+		if q.paused && !ignorePause {
+			q.Unlock()
+			return done, errDualWRetryPaused
+		}
+		if len(q.segments) == 0 {
+			q.Unlock()
+			return done, nil
+		}
+		seq := q.segments[0]
+		if seq == q.writerSeq {
+			// new entries go to the next segment, so the one read is immutable
+			q.closeWriter()
+		}
+		offset := q.readOffset
+		q.Unlock()
+
+		entries, err := q.readSegment(seq)
+		if err != nil {
+			return done, err
+		}
+		for i := offset; i < len(entries); i++ {
+			q.Lock()
+			paused := q.paused && !ignorePause
+			q.Unlock()
+			if paused {
+				return done, errDualWRetryPaused
+			}
+
+			if err := q.apply(entries[i]); err != nil {
+				logger.Warnf("retry dual write %s %s err: %s", entries[i].Op, entries[i].Key, err)
+				dualWRetries.WithLabelValues("failed").Inc()
+				q.Lock()
+				q.lastErr = err.Error()
+				q.saveCheckpoint()
+				q.Unlock()
+				return done, err
+			}
+			done++
+			dualWRetries.WithLabelValues("applied").Inc()
+
+			q.Lock()
+			q.readOffset = i + 1
+			if i+1 < len(entries) {
+				q.oldest = entries[i+1].Time
+			}
+			if q.readOffset%DUALW_RETRY_CHECKPOINT_EVERY == 0 {
+				q.saveCheckpoint()
+			}
+			q.updateGauges()
+			q.Unlock()
+		}
+
+		q.Lock()
+		q.segments = q.segments[1:]
+		delete(q.counts, seq)
+		q.readOffset = 0
+		q.oldest = time.Time{}
+		if len(q.segments) > 0 {
+			if next, err := q.readSegment(q.segments[0]); err == nil && len(next) > 0 {
+				q.oldest = next[0].Time
+			}
+		}
+		if err := os.Remove(q.segmentPath(seq)); err != nil {
+			logger.Errorf("remove dual write retry segment %d err: %s", seq, err)
+		}
+		q.saveCheckpoint()
+		q.updateGauges()
+		q.Unlock()
+	}
+}
+
+// getNewestFromBeansdb get key from the main host holding the newest version,
+// item is nil if key not exists or is deleted, and meta is the newest version,
+// nil if key never exists on beansdb
+func getNewestFromBeansdb(key string) (*mc.Item, *ItemMeta, error) {
+	hosts := GetScheduler().GetHostsByKey(key)
+	if len(hosts) > proxyConf.N {
+		hosts = hosts[:proxyConf.N]
+	}
+	var src *Host
+	var newest *ItemMeta
+	var lastErr error
+	answered := 0
+	for _, host := range hosts {
+		if host == nil {
+			continue
+		}
+		meta, err := host.GetMeta(key)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		answered++
+		if newerMeta(meta, newest) {
+			src, newest = host, meta
+		}
+	}
+	if answered == 0 {
+		return nil, nil, fmt.Errorf("no beansdb host available for %s: %v", key, lastErr)
+	}
+	if newest == nil || newest.Ver < 0 {
+		return nil, newest, nil
+	}
+	item, err := src.Get(key)
+	return item, newest, err
+}
+
+// cstarWriter is the writes of CassandraStore used to sync keys from beansdb
+type cstarWriter interface {
+	Set(key string, item *mc.Item) (bool, error)
+	DeleteAt(key string, receiveTime time.Time) (bool, error)
+}
+
+// syncKeyToCstar write item got from beansdb to c* at time at, delete key if
+// item is nil. at should be when the write to sync failed, so a newer write
+// to c* is not overwritten when use_receive_time_as_timestamp is enabled.
+func syncKeyToCstar(cstar cstarWriter, key string, item *mc.Item, at time.Time) error {
+	if item == nil {
+		_, err := cstar.DeleteAt(key, at)
+		return err
+	}
+	item.ReceiveTime = at
+	_, err := cstar.Set(key, item)
+	return err
+}
+
+// isDualWriteKey return true if key is written to both beansdb and c*,
+// only then beansdb is the truth for c*
+func isDualWriteKey(key string) bool {
+	if PrefixStorageSwitcher == nil {
+		return true
+	}
+	status := PrefixStorageSwitcher.GetStatus(key)
+	return status.IsWriteOnBeansdb() && status.IsWriteOnCstar()
+}
+
+// applyDualWRetry make c* the same as beansdb for key
+func applyDualWRetry(e *DualWRetryEntry) error {
+	if CqlStore == nil {
+		return fmt.Errorf("cstar store is not enabled")
+	}
+	if !isDualWriteKey(e.Key) {
+		// not dual write any more, beansdb is not the truth
+		dualWRetries.WithLabelValues("skipped").Inc()
+		return nil
+	}
+
+	item, meta, err := getNewestFromBeansdb(e.Key)
+	if err != nil {
+		return err
+	}
+	if meta == nil {
+		// the write failed on beansdb as well, nothing to sync
+		return nil
+	}
+	if item != nil {
+		defer freeGotItem(item)
+	}
+	return syncKeyToCstar(CqlStore, e.Key, item, e.Time)
+}
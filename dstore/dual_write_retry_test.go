@@ -0,0 +1,153 @@
+package dstore
+
+import (
+	"errors"
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mc "github.com/douban/gobeansdb/memcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDualWRetryQueue(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	q, err := NewDualWRetryQueue(dir, 3, time.Minute)
+	assert.Nil(err)
+	for i := 0; i < 7; i++ {
+		q.Add(fmt.Sprintf("/test/dualw/%d", i), "set")
+	}
+	assert.Equal(7, q.Stats().Pending)
+	assert.Equal(3, q.Stats().Segments)
+	q.Close()
+
+	// survive restart
+	q, err = NewDualWRetryQueue(dir, 3, time.Minute)
+	assert.Nil(err)
+	assert.Equal(7, q.Stats().Pending)
+	entries := q.List(2)
+	assert.Equal(2, len(entries))
+	assert.Equal("/test/dualw/0", entries[0].Key)
+
+	// stop at the first failure and keep it in queue
+	applied := []string{}
+	q.apply = func(e *DualWRetryEntry) error {
+		if e.Key == "/test/dualw/4" {
+			return errors.New("c* down")
+		}
+		applied = append(applied, e.Key)
+		return nil
+	}
+	n, err := q.Drain()
+	assert.NotNil(err)
+	assert.Equal(4, n)
+	assert.Equal(3, q.Stats().Pending)
+	assert.Equal(2, q.Stats().Segments)
+	assert.Equal("c* down", q.Stats().LastError)
+	segs, _ := filepath.Glob(filepath.Join(dir, DUALW_RETRY_SEGMENT_PREFIX+"*"))
+	assert.Equal(2, len(segs))
+	q.Close()
+
+	// progress is kept by checkpoint
+	q, err = NewDualWRetryQueue(dir, 3, time.Minute)
+	assert.Nil(err)
+	assert.Equal(3, q.Stats().Pending)
+	assert.Equal("/test/dualw/4", q.List(1)[0].Key)
+
+	// paused queue is not processed by worker, but can be drained
+	q.apply = func(e *DualWRetryEntry) error {
+		applied = append(applied, e.Key)
+		return nil
+	}
+	q.Pause()
+	_, err = q.process(false)
+	assert.Equal(errDualWRetryPaused, err)
+	n, err = q.Drain()
+	assert.Nil(err)
+	assert.Equal(3, n)
+	assert.Equal(0, q.Stats().Pending)
+	assert.Equal(7, len(applied))
+	assert.Equal("/test/dualw/6", applied[6])
+	segs, _ = filepath.Glob(filepath.Join(dir, "dualw_retry*"))
+	assert.Equal(0, len(segs))
+
+	// new entries after drained
+	q.Add("/test/dualw/7", "del")
+	assert.Equal(1, q.Stats().Pending)
+	assert.Equal("del", q.List(10)[0].Op)
+	q.Close()
+}
+
+// fakeCstar keep the write with the newest timestamp like c*,
+// a delete wins a write of the same timestamp
+type fakeCstar struct {
+	values map[string]string
+	ts     map[string]time.Time
+}
+
+func newFakeCstar() *fakeCstar {
+	return &fakeCstar{values: map[string]string{}, ts: map[string]time.Time{}}
+}
+
+func (f *fakeCstar) Set(key string, item *mc.Item) (bool, error) {
+	if item.ReceiveTime.After(f.ts[key]) {
+		f.values[key] = string(item.Body)
+		f.ts[key] = item.ReceiveTime
+	}
+	return true, nil
+}
+
+func (f *fakeCstar) DeleteAt(key string, receiveTime time.Time) (bool, error) {
+	if !receiveTime.Before(f.ts[key]) {
+		delete(f.values, key)
+		f.ts[key] = receiveTime
+	}
+	return true, nil
+}
+
+// retries are written to c* at the time the write failed
+func TestSyncKeyToCstar(t *testing.T) {
+	assert := assert.New(t)
+	cstar := newFakeCstar()
+	set := func(key, body string, at time.Time) {
+		item := newItem(0, []byte(body))
+		item.ReceiveTime = at
+		cstar.Set(key, item)
+		item.Free()
+	}
+	sync := func(key, body string, at time.Time) {
+		var item *mc.Item
+		if body != "" {
+			item = newItem(0, []byte(body))
+			defer item.Free()
+		}
+		assert.Nil(syncKeyToCstar(cstar, key, item, at))
+	}
+	second := time.Unix(time.Now().Unix()-60, 0)
+
+	// A is written at .5s, B failed on c* at .7s of the same second
+	key := "/test/dualw/samesecond"
+	set(key, "A", second.Add(500*time.Millisecond))
+	sync(key, "B", second.Add(700*time.Millisecond))
+	assert.Equal("B", cstar.values[key])
+
+	// a newer write after the failed one is not overwritten by the retry
+	key = "/test/dualw/older"
+	failed := second.Add(700 * time.Millisecond)
+	set(key, "newer", failed.Add(200*time.Millisecond))
+	sync(key, "older", failed)
+	assert.Equal("newer", cstar.values[key])
+	// neither by an older delete
+	sync(key, "", failed)
+	assert.Equal("newer", cstar.values[key])
+
+	// a delete failed on c* is retried
+	key = "/test/dualw/delete"
+	set(key, "A", second.Add(500*time.Millisecond))
+	sync(key, "", second.Add(700*time.Millisecond))
+	_, ok := cstar.values[key]
+	assert.False(ok)
+}
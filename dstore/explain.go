@@ -0,0 +1,110 @@
+package dstore
+
+// KeyHostExplain is a beansdb host of key in routing order
+type KeyHostExplain struct {
+	Addr string `json:"addr"`
+	// main or backup
+	Role string `json:"role"`
+	// the fixed owner of key in partition of the bucket
+	Owner bool      `json:"owner"`
+	Meta  *ItemMeta `json:"meta,omitempty"`
+	Error string    `json:"error,omitempty"`
+}
+
+// KeyExplain tells where a key lives
+type KeyExplain struct {
+	Key string `json:"key"`
+
+	// prefix switch, empty prefix means the default status
+	Prefix         string `json:"prefix"`
+	Status         string `json:"status"`
+	ReadOnBeansdb  bool   `json:"read_on_beansdb"`
+	ReadOnCstar    bool   `json:"read_on_cstar"`
+	WriteOnBeansdb bool   `json:"write_on_beansdb"`
+	WriteOnCstar   bool   `json:"write_on_cstar"`
+
+	// c* table
+	Keyspace   string    `json:"keyspace,omitempty"`
+	Table      string    `json:"table,omitempty"`
+	CstarMeta  *ItemMeta `json:"cstar_meta,omitempty"`
+	CstarError string    `json:"cstar_error,omitempty"`
+
+	// beansdb bucket, -1 if the scheduler has no buckets
+	Bucket     int               `json:"bucket"`
+	Owner      string            `json:"owner"`
+	OwnerAlive bool              `json:"owner_alive"`
+	Hosts      []*KeyHostExplain `json:"hosts"`
+}
+
+// ExplainKey return the prefix status, c* table and beansdb hosts of key,
+// and the metadata of key on each backend if live
+func ExplainKey(key string, live bool) *KeyExplain {
+	e := &KeyExplain{Key: key, Bucket: -1, Hosts: []*KeyHostExplain{}}
+
+	if PrefixStorageSwitcher != nil {
+		status, prefix := PrefixStorageSwitcher.GetStatusAndPrefix(key)
+		e.Prefix = prefix
+		e.Status = status.String()
+		e.ReadOnBeansdb = status.IsReadOnBeansdb()
+		e.ReadOnCstar = status.IsReadOnCstar()
+		e.WriteOnBeansdb = status.IsWriteOnBeansdb()
+		e.WriteOnCstar = status.IsWriteOnCstar()
+	} else {
+		// beansdb only
+		e.ReadOnBeansdb = true
+		e.WriteOnBeansdb = true
+	}
+
+	if PrefixTableFinder != nil {
+		e.Keyspace = proxyConf.CassandraStoreCfg.DefaultKeySpace
+		e.Table = PrefixTableFinder.GetTableByKey(key)
+	}
+	if live && CqlStore != nil {
+		e.CstarMeta, e.CstarError = explainCstarMeta(key)
+	}
+
+	sch := GetScheduler()
+	if sch == nil {
+		return e
+	}
+	if msch, ok := sch.(*ManualScheduler); ok {
+		e.Bucket = getBucketByKey(msch.hashMethod, msch.bucketWidth, key)
+	}
+	if owner, alive := sch.GetPrimaryHost(key); owner != nil {
+		e.Owner = owner.Addr
+		e.OwnerAlive = alive
+	}
+	for i, host := range sch.GetHostsByKey(key) {
+		if host == nil {
+			continue
+		}
+		h := &KeyHostExplain{Addr: host.Addr, Role: "main", Owner: host.Addr == e.Owner}
+		if i >= proxyConf.N {
+			h.Role = "backup"
+		}
+		if live {
+			meta, err := host.GetMeta(key)
+			if err != nil {
+				h.Error = err.Error()
+			}
+			h.Meta = meta
+		}
+		e.Hosts = append(e.Hosts, h)
+	}
+	return e
+}
+
+func explainCstarMeta(key string) (*ItemMeta, string) {
+	item, err := CqlStore.GetMeta(key, false)
+	if err != nil {
+		return nil, err.Error()
+	}
+	if item == nil {
+		return nil, ""
+	}
+	meta, err := parseItemMeta(item.Body)
+	if err != nil {
+		return nil, err.Error()
+	}
+	return meta, ""
+}
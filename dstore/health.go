@@ -0,0 +1,229 @@
+package dstore
+
+import (
+	"fmt"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	mc "github.com/douban/gobeansdb/memcache"
+)
+
+// the cmd checked health of hosts before health_check_cmd
+const DEFAULT_HEALTH_CHECK_CMD = "get @"
+
+// HostHealth is the health state of a host, shared by all buckets of it
+type HostHealth struct {
+	Addr                 string    `json:"addr"`
+	Healthy              bool      `json:"healthy"`
+	ConsecutiveSuccesses int       `json:"consecutive_successes"`
+	ConsecutiveFailures  int       `json:"consecutive_failures"`
+	LastCheck            time.Time `json:"last_check"`
+	LastError            string    `json:"last_error"`
+	LastChange           time.Time `json:"last_change"`
+	// state of circuit breaker by errors of requests
+	Circuit string `json:"circuit"`
+	// buckets the host is in, main or backup
+	Buckets []int `json:"buckets"`
+}
+
+// parseHealthCheckCmd parse health_check_cmd, only `get <key>...` and `stats`
+// are supported as the responses of them can be read by mc.Response
+func parseHealthCheckCmd(s string) (cmd string, keys []string, err error) {
+	if s == "" {
+		s = DEFAULT_HEALTH_CHECK_CMD
+	}
+	fields := strings.Fields(s)
+	if len(fields) == 0 {
+		return "", nil, fmt.Errorf("empty health check cmd")
+	}
+	cmd, keys = fields[0], fields[1:]
+	switch cmd {
+	case "get":
+		if len(keys) == 0 {
+			return "", nil, fmt.Errorf("health check cmd %q has no key", s)
+		}
+	case "stats":
+	default:
+		return "", nil, fmt.Errorf("unsupported health check cmd %q, must be get <key> or stats", s)
+	}
+	return cmd, keys, nil
+}
+
+// Probe run a health check cmd on host, even if its circuit breaker is open
+func (host *Host) Probe(cmd string, keys []string, timeout time.Duration) error {
+	req := &mc.Request{Cmd: cmd, Keys: keys}
+	resp, err := host.execute(req, timeout)
+	if err != nil {
+		return err
+	}
+	defer resp.CleanBuffer()
+	switch resp.Status {
+	case "ERROR", "SERVER_ERROR", "CLIENT_ERROR":
+		return fmt.Errorf("%s %s", resp.Status, resp.Msg)
+	}
+	return nil
+}
+
+// HealthProber check a host periodically, and down or rise it in
+// all buckets containing it when it fails or succeeds enough times in a row
+type HealthProber struct {
+	host     *Host
+	buckets  []*Bucket
+	interval time.Duration
+	rise     int
+	fall     int
+	probe    func() error
+
+	sync.Mutex
+	healthy    bool
+	successes  int
+	failures   int
+	lastCheck  time.Time
+	lastErr    string
+	lastChange time.Time
+	quit       chan struct{}
+}
+
+func newHealthProber(host *Host, buckets []*Bucket) (*HealthProber, error) {
+	cmd, keys, err := parseHealthCheckCmd(proxyConf.HealthCheckCmd)
+	if err != nil {
+		return nil, err
+	}
+	timeout := time.Duration(proxyConf.HealthCheckTimeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = time.Duration(proxyConf.ReadTimeoutMs) * time.Millisecond
+	}
+	p := &HealthProber{
+		host:     host,
+		buckets:  buckets,
+		interval: time.Duration(proxyConf.HealthCheckIntervalMs) * time.Millisecond,
+		rise:     proxyConf.HealthCheckRise,
+		fall:     proxyConf.HealthCheckFall,
+		healthy:  true,
+		quit:     make(chan struct{}),
+	}
+	if p.interval <= 0 {
+		p.interval = 5 * time.Second
+	}
+	if p.rise <= 0 {
+		p.rise = 1
+	}
+	if p.fall <= 0 {
+		p.fall = 1
+	}
+	p.probe = func() error {
+		return host.Probe(cmd, keys, timeout)
+	}
+	hostHealthy.WithLabelValues(host.Addr).Set(1)
+	return p, nil
+}
+
+func (p *HealthProber) run() {
+	// spread checks of hosts over the interval
+	select {
+	case <-p.quit:
+		return
+	case <-time.After(time.Duration(rand.Int63n(int64(p.interval)))):
+	}
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+	for {
+		p.Check()
+		select {
+		case <-p.quit:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (p *HealthProber) Stop() {
+	close(p.quit)
+}
+
+// Check probe the host once and apply the result to its buckets
+func (p *HealthProber) Check() {
+	err := p.probe()
+
+	p.Lock()
+	p.lastCheck = time.Now()
+	if err == nil {
+		p.successes++
+		p.failures = 0
+		p.lastErr = ""
+	} else {
+		p.failures++
+		p.successes = 0
+		p.lastErr = err.Error()
+	}
+	changed := false
+	if !p.healthy && p.successes >= p.rise {
+		p.healthy, changed = true, true
+	} else if p.healthy && p.failures >= p.fall {
+		p.healthy, changed = false, true
+	}
+	if changed {
+		p.lastChange = p.lastCheck
+	}
+	healthy := p.healthy
+	p.Unlock()
+
+	if changed {
+		state := "down"
+		if healthy {
+			state = "up"
+			hostHealthy.WithLabelValues(p.host.Addr).Set(1)
+			logger.Infof("beansdb server %s is up after %d successful health checks", p.host.Addr, p.rise)
+		} else {
+			hostHealthy.WithLabelValues(p.host.Addr).Set(0)
+			logger.Errorf("beansdb server %s is down after %d failed health checks, err: %s",
+				p.host.Addr, p.fall, err)
+		}
+		healthStateChanges.WithLabelValues(p.host.Addr, state).Inc()
+	}
+	// buckets may have downed the host by errors of requests, so the state
+	// is applied after each check, not only when it is changed
+	if err == nil && healthy {
+		p.riseInBuckets()
+	} else if !healthy {
+		p.downInBuckets()
+	}
+}
+
+func (p *HealthProber) riseInBuckets() {
+	for _, bucket := range p.buckets {
+		bucket.riseHost(p.host.Addr)
+	}
+}
+
+func (p *HealthProber) downInBuckets() {
+	for _, bucket := range p.buckets {
+		if _, hb := bucket.getHostByAddr(p.host.Addr); hb.isAlive() {
+			bucket.downHost(p.host.Addr)
+		}
+	}
+}
+
+func (p *HealthProber) Health() *HostHealth {
+	buckets := make([]int, 0, len(p.buckets))
+	for _, bucket := range p.buckets {
+		buckets = append(buckets, bucket.ID)
+	}
+	sort.Ints(buckets)
+	p.Lock()
+	defer p.Unlock()
+	return &HostHealth{
+		Addr:                 p.host.Addr,
+		Healthy:              p.healthy,
+		ConsecutiveSuccesses: p.successes,
+		ConsecutiveFailures:  p.failures,
+		LastCheck:            p.lastCheck,
+		LastError:            p.lastErr,
+		LastChange:           p.lastChange,
+		Circuit:              p.host.CircuitState(),
+		Buckets:              buckets,
+	}
+}
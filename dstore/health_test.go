@@ -0,0 +1,98 @@
+package dstore
+
+import (
+	"errors"
+	"path"
+	"testing"
+
+	"github.com/douban/gobeansproxy/config"
+	"github.com/douban/gobeansproxy/utils"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseHealthCheckCmd(t *testing.T) {
+	assert := assert.New(t)
+	cmd, keys, err := parseHealthCheckCmd("get @")
+	assert.Nil(err)
+	assert.Equal("get", cmd)
+	assert.Equal([]string{"@"}, keys)
+
+	cmd, keys, err = parseHealthCheckCmd(" stats ")
+	assert.Nil(err)
+	assert.Equal("stats", cmd)
+	assert.Empty(keys)
+
+	cmd, keys, err = parseHealthCheckCmd("")
+	assert.Nil(err)
+	assert.Equal("get", cmd)
+	assert.Equal([]string{"@"}, keys)
+
+	for _, bad := range []string{" ", "get", "version", "set @ 0 0 1"} {
+		_, _, err = parseHealthCheckCmd(bad)
+		assert.NotNil(err, bad)
+	}
+}
+
+func TestHealthProber(t *testing.T) {
+	homeDir := utils.GetProjectHomeDir()
+	confdir := path.Join(homeDir, "conf")
+	proxyConf := &config.Proxy
+	proxyConf.Load(confdir)
+	assert := assert.New(t)
+
+	hosts := []*Host{
+		NewHost("10.0.0.1:1234"),
+		NewHost("10.0.0.2:1234"),
+		NewHost("10.0.0.3:1234"),
+	}
+	target := hosts[1]
+	buckets := []*Bucket{newBucket(0, hosts...), newBucket(1, hosts...), newBucket(2, hosts[0], hosts[2])}
+
+	p, err := newHealthProber(target, buckets[:2])
+	assert.Nil(err)
+	p.rise, p.fall = 2, 3
+	var probeErr error
+	p.probe = func() error { return probeErr }
+
+	aliveIn := func() (n int) {
+		for _, bucket := range buckets[:2] {
+			if _, hb := bucket.getHostByAddr(target.Addr); hb.isAlive() {
+				n++
+			}
+		}
+		return
+	}
+
+	probeErr = errors.New("connection refused")
+	for i := 0; i < 2; i++ {
+		p.Check()
+		assert.Equal(2, aliveIn(), "down before %d failures", p.fall)
+	}
+	p.Check()
+	assert.Equal(0, aliveIn())
+	h := p.Health()
+	assert.False(h.Healthy)
+	assert.Equal(3, h.ConsecutiveFailures)
+	assert.Equal("connection refused", h.LastError)
+	assert.Equal([]int{0, 1}, h.Buckets)
+	// the bucket without the host is not touched
+	for _, hb := range buckets[2].hostsList {
+		assert.True(hb.isAlive())
+	}
+
+	probeErr = nil
+	p.Check()
+	assert.Equal(0, aliveIn(), "up before %d successes", p.rise)
+	p.Check()
+	assert.Equal(2, aliveIn())
+	h = p.Health()
+	assert.True(h.Healthy)
+	assert.Equal(2, h.ConsecutiveSuccesses)
+	assert.Equal("", h.LastError)
+
+	// downed in a bucket by errors of requests, risen by the next success
+	buckets[0].downHost(target.Addr)
+	assert.Equal(1, aliveIn())
+	p.Check()
+	assert.Equal(2, aliveIn())
+}
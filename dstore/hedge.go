@@ -0,0 +1,129 @@
+package dstore
+
+import (
+	"time"
+
+	"github.com/douban/gobeansdb/cmem"
+	mc "github.com/douban/gobeansdb/memcache"
+)
+
+// getReturnType 用来在 hedgedGet 的 goroutine 之间传递 get 的结果
+type getReturnType struct {
+	host      *Host
+	item      *mc.Item
+	err       error
+	startTime time.Time
+	// hedged is true when the get was fired because the previous host was slow
+	hedged bool
+}
+
+// hedgeDelay return how long we wait for host before firing the get to next replica
+func (c *StorageClient) hedgeDelay(host *Host, key string) time.Duration {
+	if proxyConf.HedgedReadDelayMs > 0 {
+		return time.Duration(proxyConf.HedgedReadDelayMs) * time.Millisecond
+	}
+	latency := c.sched.GetHostLatency(host, key)
+	if latency < proxyConf.ResponseTimeMin {
+		latency = proxyConf.ResponseTimeMin
+	}
+	// latency is in Microsecond
+	return time.Duration(latency*proxyConf.HedgedReadLatencyMultiple) * time.Microsecond
+}
+
+func feedbackGet(sched Scheduler, key string, res getReturnType) {
+	if res.err == nil {
+		if res.item != nil && res.item.Cap < proxyConf.ItemSizeStats {
+			sched.FeedbackLatency(res.host, key, res.startTime, time.Now().Sub(res.startTime))
+		}
+	} else if isWaitForRetry(res.err) {
+		sched.FeedbackError(res.host, key, res.startTime, FeedbackConnectErrDefault)
+	} else {
+		sched.FeedbackError(res.host, key, res.startTime, FeedbackNonConnectErrDefault)
+	}
+}
+
+// discardGets wait for the gets still running after hedgedGet returned,
+// feed their results to scheduler and free the items. Hosts answered
+// not found too late are repaired from the winner.
+func discardGets(sched Scheduler, key string, winner *Host, results chan getReturnType, pending int) {
+	for i := 0; i < pending; i++ {
+		res := <-results
+		feedbackGet(sched, key, res)
+		if res.err == nil && res.item == nil {
+			tryReadRepair(key, winner, []*Host{winner, res.host}, true)
+		}
+		if res.item != nil {
+			cmem.DBRL.GetData.SubSizeAndCount(res.item.Cap)
+			res.item.Free()
+		}
+	}
+}
+
+// hedgedGet get key from hosts in order like the sequential get, but when
+// the host does not answer within hedgeDelay, the get is also sent to next
+// host, and the first found item wins. cnt is the number of hosts which
+// answered without error before returning.
+func (c *StorageClient) hedgedGet(hosts []*Host, key string) (item *mc.Item, cnt int, err error) {
+	results := make(chan getReturnType, len(hosts))
+	next := 0
+	pending := 0
+	launch := func(hedged bool) {
+		host := hosts[next]
+		next++
+		pending++
+		go func() {
+			start := time.Now()
+			item, err := host.Get(key)
+			results <- getReturnType{host: host, item: item, err: err, startTime: start, hedged: hedged}
+		}()
+	}
+
+	launch(false)
+	timer := time.NewTimer(c.hedgeDelay(hosts[0], key))
+	defer timer.Stop()
+	resetTimer := func() {
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+		timer.Reset(c.hedgeDelay(hosts[next-1], key))
+	}
+
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			if next < len(hosts) {
+				hedgedReqs.WithLabelValues("get", "fired").Inc()
+				launch(true)
+				timer.Reset(c.hedgeDelay(hosts[next-1], key))
+			}
+		case res := <-results:
+			pending--
+			feedbackGet(c.sched, key, res)
+			err = res.err
+			if err == nil {
+				cnt++
+				if res.item != nil {
+					if res.hedged {
+						hedgedReqs.WithLabelValues("get", "won").Inc()
+					}
+					c.SuccessedTargets = []string{res.host.Addr}
+					tryReadRepair(key, res.host, hosts, cnt > 1)
+					if pending > 0 {
+						go discardGets(c.sched, key, res.host, results, pending)
+					}
+					return res.item, cnt, nil
+				}
+				c.SuccessedTargets = append(c.SuccessedTargets, res.host.Addr)
+			}
+			// nothing in flight, go on with next host at once
+			if pending == 0 && next < len(hosts) {
+				launch(false)
+				resetTimer()
+			}
+		}
+	}
+	return
+}
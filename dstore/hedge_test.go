@@ -0,0 +1,126 @@
+package dstore
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"strings"
+	"testing"
+	"time"
+
+	dbcfg "github.com/douban/gobeansdb/config"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/douban/gobeansproxy/config"
+	"github.com/douban/gobeansproxy/utils"
+)
+
+// startFakeBeansdb start a server which answer every get with value after delay,
+// nil value means not found.
+func startFakeBeansdb(tb testing.TB, delay time.Duration, value []byte) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("listen err: %s", err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					parts := strings.Fields(line)
+					if len(parts) < 2 || parts[0] != "get" {
+						conn.Write([]byte("ERROR\r\n"))
+						continue
+					}
+					time.Sleep(delay)
+					if value != nil {
+						fmt.Fprintf(conn, "VALUE %s 0 %d\r\n%s\r\n", parts[1], len(value), value)
+					}
+					conn.Write([]byte("END\r\n"))
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+func newHedgeTestClient(tb testing.TB, addrs ...string) (*StorageClient, []*Host) {
+	homeDir := utils.GetProjectHomeDir()
+	confdir := path.Join(homeDir, "conf")
+	proxyConf := &config.Proxy
+	proxyConf.Load(confdir)
+
+	route := new(dbcfg.RouteTable)
+	hosts := []*Host{}
+	for _, addr := range addrs {
+		route.Main = append(route.Main, dbcfg.Server{Addr: addr})
+		hosts = append(hosts, NewHost(addr))
+	}
+	c := &StorageClient{N: len(hosts), W: 1, R: 1}
+	c.sched = NewRRReadScheduler(route)
+	return c, hosts
+}
+
+func TestHedgedGetSlowPrimary(t *testing.T) {
+	assert := assert.New(t)
+	slow := startFakeBeansdb(t, time.Second, []byte("slow"))
+	fast := startFakeBeansdb(t, 0, []byte("fast"))
+	c, hosts := newHedgeTestClient(t, slow, fast)
+	proxyConf.HedgedReadDelayMs = 10
+	defer func() { proxyConf.HedgedReadDelayMs = 0 }()
+
+	start := time.Now()
+	item, cnt, err := c.hedgedGet(hosts, "/test/hedge/slow")
+	assert.Nil(err)
+	assert.Equal(1, cnt)
+	assert.Equal([]byte("fast"), item.Body)
+	assert.Equal([]string{fast}, c.SuccessedTargets)
+	assert.True(time.Since(start) < 500*time.Millisecond)
+	item.Free()
+}
+
+func TestHedgedGetNotFound(t *testing.T) {
+	assert := assert.New(t)
+	empty := startFakeBeansdb(t, 0, nil)
+	found := startFakeBeansdb(t, 0, []byte("found"))
+	c, hosts := newHedgeTestClient(t, empty, found)
+
+	// primary answer not found in time, so no hedge is needed
+	item, cnt, err := c.hedgedGet(hosts, "/test/hedge/notfound")
+	assert.Nil(err)
+	assert.Equal(2, cnt)
+	assert.Equal([]byte("found"), item.Body)
+	item.Free()
+
+	c, hosts = newHedgeTestClient(t, empty, empty)
+	item, cnt, err = c.hedgedGet(hosts, "/test/hedge/notfound")
+	assert.Nil(err)
+	assert.Nil(item)
+	assert.Equal(2, cnt)
+	assert.Equal([]string{empty, empty}, c.SuccessedTargets)
+}
+
+func TestHedgeDelay(t *testing.T) {
+	assert := assert.New(t)
+	c, hosts := newHedgeTestClient(t, "127.0.0.1:1")
+
+	proxyConf.HedgedReadDelayMs = 30
+	assert.Equal(30*time.Millisecond, c.hedgeDelay(hosts[0], "key"))
+
+	// rrr scheduler knows nothing about latency, fall back to response_time_min
+	proxyConf.HedgedReadDelayMs = 0
+	expected := time.Duration(proxyConf.ResponseTimeMin*proxyConf.HedgedReadLatencyMultiple) * time.Microsecond
+	assert.Equal(expected, c.hedgeDelay(hosts[0], "key"))
+}
@@ -0,0 +1,362 @@
+package dstore
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	HINT_FILE_SUFFIX = ".hints"
+	// replay hints of all hosts periodically, besides the replay
+	// triggered when a host is rised by scheduler
+	HINT_REPLAY_INTERVAL = 30 * time.Second
+)
+
+var (
+	globalHintStore *HintStore
+
+	errHintNoSource = errors.New("no replica available to replay hint")
+)
+
+// Hint record a write which failed on a main host, the value is not saved,
+// the newest version on other replicas is copied to the host when replaying.
+type Hint struct {
+	Key  string    `json:"key"`
+	Op   string    `json:"op"`
+	Time time.Time `json:"time"`
+}
+
+// HintStore is the hinted handoff queue, hints of each host are kept
+// in memory and appended to <dir>/<addr>.hints
+type HintStore struct {
+	dir      string
+	maxHints int
+	ttl      time.Duration
+
+	sync.Mutex
+	hints map[string][]*Hint
+	files map[string]*os.File
+
+	wakeup chan string
+	quit   chan struct{}
+}
+
+func GetHintStore() *HintStore {
+	return globalHintStore
+}
+
+func InitGlobalHintStore(dir string, maxHints int, ttl time.Duration) error {
+	s, err := NewHintStore(dir, maxHints, ttl)
+	if err != nil {
+		return err
+	}
+	globalHintStore = s
+	go s.run()
+	return nil
+}
+
+func NewHintStore(dir string, maxHints int, ttl time.Duration) (*HintStore, error) {
+	if stat, err := os.Stat(dir); err != nil || !stat.IsDir() {
+		return nil, fmt.Errorf("%s is not a dir or not exists", dir)
+	}
+	s := &HintStore{
+		dir:      dir,
+		maxHints: maxHints,
+		ttl:      ttl,
+		hints:    make(map[string][]*Hint),
+		files:    make(map[string]*os.File),
+		wakeup:   make(chan string, 64),
+		quit:     make(chan struct{}),
+	}
+
+	paths, err := filepath.Glob(filepath.Join(dir, "*"+HINT_FILE_SUFFIX))
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range paths {
+		addr := strings.TrimSuffix(filepath.Base(p), HINT_FILE_SUFFIX)
+		hints, err := loadHints(p)
+		if err != nil {
+			return nil, fmt.Errorf("load hints from %s err: %s", p, err)
+		}
+		s.hints[addr] = s.unexpired(hints)
+		if err = s.rewrite(addr); err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+func loadHints(path string) ([]*Hint, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	hints := []*Hint{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		hint := new(Hint)
+		if err := json.Unmarshal(scanner.Bytes(), hint); err != nil {
+			// the last line may be broken when proxy crashed
+			logger.Warnf("skip bad hint line in %s: %s", path, err)
+			continue
+		}
+		hints = append(hints, hint)
+	}
+	return hints, scanner.Err()
+}
+
+func (s *HintStore) path(addr string) string {
+	return filepath.Join(s.dir, addr+HINT_FILE_SUFFIX)
+}
+
+// unexpired return the hints not older than ttl
+func (s *HintStore) unexpired(hints []*Hint) []*Hint {
+	if s.ttl <= 0 {
+		return append([]*Hint{}, hints...)
+	}
+	deadline := time.Now().Add(-s.ttl)
+	kept := make([]*Hint, 0, len(hints))
+	for _, h := range hints {
+		if h.Time.After(deadline) {
+			kept = append(kept, h)
+		}
+	}
+	return kept
+}
+
+// rewrite the hint file of addr by the hints in memory, must hold the lock
+func (s *HintStore) rewrite(addr string) error {
+	if f, ok := s.files[addr]; ok {
+		f.Close()
+		delete(s.files, addr)
+	}
+	hintsQueued.WithLabelValues(addr).Set(float64(len(s.hints[addr])))
+	if len(s.hints[addr]) == 0 {
+		delete(s.hints, addr)
+		err := os.Remove(s.path(addr))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+	}
+
+	tmp := s.path(addr) + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, h := range s.hints[addr] {
+		if err = enc.Encode(h); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err = w.Flush(); err != nil {
+		f.Close()
+		return err
+	}
+	f.Close()
+	return os.Rename(tmp, s.path(addr))
+}
+
+// Add record a write of key failed on host addr
+func (s *HintStore) Add(addr, key, op string) {
+	s.Lock()
+	defer s.Unlock()
+
+	if s.maxHints > 0 && len(s.hints[addr]) >= s.maxHints {
+		hintedHandoffs.WithLabelValues("dropped").Inc()
+		logger.Warnf("hints of %s is full, drop hint %s %s", addr, op, key)
+		return
+	}
+
+	hint := &Hint{Key: key, Op: op, Time: time.Now()}
+	f, ok := s.files[addr]
+	if !ok {
+		var err error
+		f, err = os.OpenFile(s.path(addr), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			logger.Errorf("open hint file for %s err: %s", addr, err)
+			return
+		}
+		s.files[addr] = f
+	}
+	b, _ := json.Marshal(hint)
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		logger.Errorf("write hint for %s err: %s", addr, err)
+		return
+	}
+	s.hints[addr] = append(s.hints[addr], hint)
+	hintedHandoffs.WithLabelValues("added").Inc()
+	hintsQueued.WithLabelValues(addr).Set(float64(len(s.hints[addr])))
+}
+
+// List return hints of addr, or hints of all hosts when addr is empty
+func (s *HintStore) List(addr string) map[string][]*Hint {
+	s.Lock()
+	defer s.Unlock()
+
+	r := make(map[string][]*Hint)
+	for a, hints := range s.hints {
+		if addr == "" || a == addr {
+			r[a] = s.unexpired(hints)
+		}
+	}
+	return r
+}
+
+// Purge drop hints of addr, or hints of all hosts when addr is empty,
+// return the number of hints dropped
+func (s *HintStore) Purge(addr string) (n int, err error) {
+	s.Lock()
+	defer s.Unlock()
+
+	for a := range s.hints {
+		if addr == "" || a == addr {
+			n += len(s.hints[a])
+			s.hints[a] = nil
+			if err = s.rewrite(a); err != nil {
+				return
+			}
+		}
+	}
+	return
+}
+
+// Wakeup replay hints of addr at once, it is called when host is rised
+func (s *HintStore) Wakeup(addr string) {
+	select {
+	case s.wakeup <- addr:
+	default:
+	}
+}
+
+func (s *HintStore) Close() {
+	close(s.quit)
+}
+
+func (s *HintStore) run() {
+	ticker := time.NewTicker(HINT_REPLAY_INTERVAL)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.quit:
+			return
+		case addr := <-s.wakeup:
+			s.replay(addr)
+		case <-ticker.C:
+			for addr := range s.List("") {
+				s.replay(addr)
+			}
+		}
+	}
+}
+
+// replay hints of addr in order, stop at the first failure and keep the rest
+func (s *HintStore) replay(addr string) {
+	sch, ok := GetScheduler().(*ManualScheduler)
+	if !ok {
+		return
+	}
+	dst := sch.getHostByAddr(addr)
+	if dst == nil {
+		// host is removed from route, hints are useless
+		s.Purge(addr)
+		return
+	}
+
+	s.Lock()
+	hints := s.unexpired(s.hints[addr])
+	s.Unlock()
+
+	done := 0
+	replayed := make(map[string]struct{}, len(hints))
+	for _, hint := range hints {
+		if _, ok := replayed[hint.Key]; !ok {
+			if err := replayHint(sch, dst, hint.Key); err != nil {
+				logger.Warnf("replay hint %s %s to %s err: %s", hint.Op, hint.Key, addr, err)
+				break
+			}
+			replayed[hint.Key] = struct{}{}
+			hintedHandoffs.WithLabelValues("replayed").Inc()
+		}
+		done++
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	current := s.unexpired(s.hints[addr])
+	expired := len(s.hints[addr]) - len(current)
+	if done == 0 && expired == 0 {
+		return
+	}
+	hintedHandoffs.WithLabelValues("expired").Add(float64(expired))
+
+	// hints added while replaying are kept
+	var last time.Time
+	if done > 0 {
+		last = hints[done-1].Time
+	}
+	kept := []*Hint{}
+	for _, h := range current {
+		if _, ok := replayed[h.Key]; !ok || h.Time.After(last) {
+			kept = append(kept, h)
+		}
+	}
+	s.hints[addr] = kept
+	if err := s.rewrite(addr); err != nil {
+		logger.Errorf("rewrite hints of %s err: %s", addr, err)
+	}
+}
+
+// replayHint copy the newest version of key on the other replicas to dst
+func replayHint(sch *ManualScheduler, dst *Host, key string) error {
+	var src *Host
+	var newest *ItemMeta
+	var srcErr error
+	for _, peer := range sch.GetHostsByKey(key) {
+		if peer == nil || peer == dst {
+			continue
+		}
+		meta, err := peer.GetMeta(key)
+		if err != nil {
+			srcErr = err
+			continue
+		}
+		if meta != nil && (newest == nil || abs(meta.Ver) > abs(newest.Ver)) {
+			src, newest = peer, meta
+		}
+	}
+	if newest == nil {
+		if srcErr != nil {
+			return errHintNoSource
+		}
+		// key never exists on other replicas, nothing to replay
+		return nil
+	}
+
+	return syncKeyTo(key, src, newest, dst)
+}
+
+// addHints record the write of key failed on hosts, if hinted handoff enabled
+func addHints(hosts []*Host, key, op string) {
+	hints := GetHintStore()
+	if hints == nil {
+		return
+	}
+	for _, host := range hosts {
+		hints.Add(host.Addr, key, op)
+	}
+}
@@ -0,0 +1,113 @@
+package dstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func hintKeys(hints map[string][]*Hint) map[string][]string {
+	r := make(map[string][]string)
+	for addr, hs := range hints {
+		for _, h := range hs {
+			r[addr] = append(r[addr], h.Op+" "+h.Key)
+		}
+	}
+	return r
+}
+
+func TestHintStore(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	s, err := NewHintStore(dir, 3, time.Hour)
+	assert.Nil(err)
+	s.Add("127.0.0.1:7980", "/test/hint/1", "set")
+	s.Add("127.0.0.1:7980", "/test/hint/2", "del")
+	s.Add("127.0.0.1:7981", "/test/hint/1", "set")
+	assert.Equal(2, len(s.List("127.0.0.1:7980")["127.0.0.1:7980"]))
+	assert.Equal(2, len(s.List("")))
+
+	// bounded
+	s.Add("127.0.0.1:7980", "/test/hint/3", "set")
+	s.Add("127.0.0.1:7980", "/test/hint/4", "set")
+	hints := s.List("127.0.0.1:7980")["127.0.0.1:7980"]
+	assert.Equal(3, len(hints))
+	assert.Equal("/test/hint/2", hints[1].Key)
+	assert.Equal("del", hints[1].Op)
+
+	// hints survive restart
+	s2, err := NewHintStore(dir, 3, time.Hour)
+	assert.Nil(err)
+	assert.Equal(hintKeys(s.List("")), hintKeys(s2.List("")))
+
+	n, err := s2.Purge("127.0.0.1:7981")
+	assert.Nil(err)
+	assert.Equal(1, n)
+	assert.Equal(1, len(s2.List("")))
+
+	s3, err := NewHintStore(dir, 3, time.Hour)
+	assert.Nil(err)
+	assert.Equal(1, len(s3.List("")))
+}
+
+func TestHintStoreTTL(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	s, err := NewHintStore(dir, 0, time.Millisecond*100)
+	assert.Nil(err)
+	s.Add("127.0.0.1:7980", "/test/hint/1", "set")
+	assert.Equal(1, len(s.List("")["127.0.0.1:7980"]))
+
+	time.Sleep(time.Millisecond * 200)
+	assert.Equal(0, len(s.List("")["127.0.0.1:7980"]))
+	s2, err := NewHintStore(dir, 0, time.Millisecond*100)
+	assert.Nil(err)
+	assert.Equal(0, len(s2.List("")))
+}
+
+func TestHintReplay(t *testing.T) {
+	teardown := setupSuite(t)
+	defer teardown(t)
+	assert := assert.New(t)
+
+	c := newDStoreOnlyClient()
+	s, err := NewHintStore(t.TempDir(), 0, time.Hour)
+	assert.Nil(err)
+
+	key := fmt.Sprintf("/test/hint/replay/%d", time.Now().UnixNano())
+	hosts := GetScheduler().GetHostsByKey(key)[:c.N]
+	item := newItem(0, []byte("hinted"))
+	for _, host := range hosts[1:] {
+		ok, err := host.Set(key, item, false)
+		assert.True(ok)
+		assert.Nil(err)
+	}
+	item.Free()
+
+	s.Add(hosts[0].Addr, key, "set")
+	s.replay(hosts[0].Addr)
+	assert.Equal(0, len(s.List("")))
+
+	meta, err := hosts[0].GetMeta(key)
+	assert.Nil(err)
+	if assert.NotNil(meta) {
+		peerMeta, _ := hosts[1].GetMeta(key)
+		assert.Equal(peerMeta.Ver, meta.Ver)
+	}
+
+	// delete is replayed as well
+	for _, host := range hosts[1:] {
+		ok, _ := host.Delete(key)
+		assert.True(ok)
+	}
+	s.Add(hosts[0].Addr, key, "del")
+	s.replay(hosts[0].Addr)
+	meta, _ = hosts[0].GetMeta(key)
+	if assert.NotNil(meta) {
+		assert.True(meta.Ver < 0)
+	}
+}
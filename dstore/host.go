@@ -8,6 +8,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	mc "github.com/douban/gobeansdb/memcache"
@@ -30,6 +31,12 @@ type Host struct {
 	// conns is a free list of connections
 	conns chan net.Conn
 
+	// outstanding is the number of requests in flight
+	outstanding atomic.Int64
+
+	// breaker is nil if circuit breaker is not enabled
+	breaker *CircuitBreaker
+
 	sync.Mutex
 }
 
@@ -37,6 +44,7 @@ func NewHost(addr string) *Host {
 	host := new(Host)
 	host.Addr = addr
 	host.conns = make(chan net.Conn, proxyConf.MaxFreeConnsPerHost)
+	host.breaker = newCircuitBreaker(addr)
 	return host
 }
 
@@ -108,7 +116,29 @@ func (host *Host) releaseConn(conn net.Conn) {
 	}
 }
 
+// Outstanding return the number of requests in flight
+func (host *Host) Outstanding() int64 {
+	return host.outstanding.Load()
+}
+
+// CircuitState return the state of circuit breaker of host
+func (host *Host) CircuitState() string {
+	return host.breaker.State()
+}
+
 func (host *Host) executeWithTimeout(req *mc.Request, timeout time.Duration) (resp *mc.Response, err error) {
+	if err = host.breaker.Allow(); err != nil {
+		return
+	}
+	resp, err = host.execute(req, timeout)
+	host.breaker.Done(err)
+	return
+}
+
+// execute send req to host without circuit breaker
+func (host *Host) execute(req *mc.Request, timeout time.Duration) (resp *mc.Response, err error) {
+	host.outstanding.Add(1)
+	defer host.outstanding.Add(-1)
 	conn, err := host.getConn()
 	if err != nil {
 		return
@@ -179,6 +209,36 @@ func (host *Host) Get(key string) (*mc.Item, error) {
 	return item, nil
 }
 
+// ItemMeta is the metadata of a key returned by `get ?key` of gobeansdb,
+// Ver < 0 means the key was deleted.
+type ItemMeta struct {
+	Ver    int
+	VHash  int
+	Flag   int
+	Length int
+	TS     int64
+}
+
+func parseItemMeta(body []byte) (*ItemMeta, error) {
+	var meta ItemMeta
+	_, err := fmt.Sscanf(string(body), "%d %d %d %d %d",
+		&meta.Ver, &meta.VHash, &meta.Flag, &meta.Length, &meta.TS)
+	if err != nil {
+		return nil, fmt.Errorf("bad meta %q: %s", body, err)
+	}
+	return &meta, nil
+}
+
+// GetMeta return nil meta when key never exists on the host
+func (host *Host) GetMeta(key string) (*ItemMeta, error) {
+	item, err := host.Get("?" + key)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	defer item.Free()
+	return parseItemMeta(item.Body)
+}
+
 func (host *Host) GetMulti(keys []string) (map[string]*mc.Item, error) {
 	req := &mc.Request{Cmd: "get", Keys: keys}
 	resp, err := host.executeWithTimeout(req, time.Duration(proxyConf.ReadTimeoutMs)*time.Millisecond)
@@ -0,0 +1,254 @@
+package dstore
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+const (
+	// latencies (Microsecond) are counted in bins whose upper bounds are
+	// LATENCY_BIN_BASE * 2^(i/2), the last bin also holds larger ones
+	LATENCY_BIN_BASE = 16
+	LATENCY_BINS     = 48
+
+	// seconds kept by a tracker when no window is configured
+	DEFAULT_LATENCY_SECONDS = 60
+)
+
+// latencyBinBound return the upper bound of bin i
+func latencyBinBound(i int) float64 {
+	return LATENCY_BIN_BASE * math.Pow(2, float64(i)/2)
+}
+
+func latencyBin(latency float64) int {
+	if latency <= LATENCY_BIN_BASE {
+		return 0
+	}
+	i := int(math.Ceil(2 * math.Log2(latency/LATENCY_BIN_BASE)))
+	if i >= LATENCY_BINS {
+		return LATENCY_BINS - 1
+	}
+	return i
+}
+
+// Response is the latencies and errors in one second
+type Response struct {
+	ReqTime time.Time
+	Count   int
+	Sum     float64
+	Errors  int
+}
+
+// LatencyStats is the latencies (Microsecond) and errors of a host in a window
+type LatencyStats struct {
+	Window    int     `json:"window_seconds"`
+	Count     int     `json:"count"`
+	Errors    int     `json:"errors"`
+	ErrorRate float64 `json:"error_rate"`
+	Avg       float64 `json:"avg"`
+	P50       float64 `json:"p50"`
+	P95       float64 `json:"p95"`
+	P99       float64 `json:"p99"`
+	Max       float64 `json:"max"`
+}
+
+type latencySlot struct {
+	// unix second of the slot, data of other seconds are stale
+	sec    int64
+	count  int
+	errors int
+	sum    float64
+	min    float64
+	max    float64
+	bins   [LATENCY_BINS]uint32
+}
+
+func (s *latencySlot) reset(sec int64) {
+	*s = latencySlot{sec: sec}
+}
+
+// LatencyTracker count latencies and errors of a host by seconds,
+// stats of any window up to the capacity are merged from the slots.
+type LatencyTracker struct {
+	sync.Mutex
+	slots []latencySlot
+}
+
+func NewLatencyTracker(seconds int) *LatencyTracker {
+	if seconds <= 0 {
+		seconds = DEFAULT_LATENCY_SECONDS
+	}
+	t := &LatencyTracker{slots: make([]latencySlot, seconds)}
+	t.clear()
+	return t
+}
+
+// slot return the slot of sec, nil if sec is too old to be kept
+func (t *LatencyTracker) slot(sec int64, now time.Time) *latencySlot {
+	if sec <= now.Unix()-int64(len(t.slots)) {
+		return nil
+	}
+	s := &t.slots[int(sec%int64(len(t.slots)))]
+	if s.sec != sec {
+		s.reset(sec)
+	}
+	return s
+}
+
+// Record a latency of request started at start
+func (t *LatencyTracker) Record(start time.Time, latency float64) {
+	t.Lock()
+	defer t.Unlock()
+	s := t.slot(start.Unix(), time.Now())
+	if s == nil {
+		return
+	}
+	if s.count == 0 || latency < s.min {
+		s.min = latency
+	}
+	if latency > s.max {
+		s.max = latency
+	}
+	s.count++
+	s.sum += latency
+	s.bins[latencyBin(latency)]++
+}
+
+// RecordError record an error of request started at start
+func (t *LatencyTracker) RecordError(start time.Time) {
+	t.Lock()
+	defer t.Unlock()
+	if s := t.slot(start.Unix(), time.Now()); s != nil {
+		s.errors++
+	}
+}
+
+// Stats return stats of the last window seconds, including the current one
+func (t *LatencyTracker) Stats(window int) *LatencyStats {
+	return t.statsAt(time.Now(), window)
+}
+
+func (t *LatencyTracker) statsAt(now time.Time, window int) *LatencyStats {
+	if window > len(t.slots) {
+		window = len(t.slots)
+	}
+	r := &LatencyStats{Window: window}
+	var bins [LATENCY_BINS]uint32
+	var sum float64
+	min := math.Inf(1)
+
+	t.Lock()
+	end := now.Unix()
+	for sec := end - int64(window) + 1; sec <= end; sec++ {
+		s := &t.slots[int(sec%int64(len(t.slots)))]
+		if s.sec != sec {
+			continue
+		}
+		r.Errors += s.errors
+		if s.count == 0 {
+			continue
+		}
+		r.Count += s.count
+		sum += s.sum
+		min = math.Min(min, s.min)
+		r.Max = math.Max(r.Max, s.max)
+		for i, n := range s.bins {
+			bins[i] += n
+		}
+	}
+	t.Unlock()
+
+	if total := r.Count + r.Errors; total > 0 {
+		r.ErrorRate = float64(r.Errors) / float64(total)
+	}
+	if r.Count == 0 {
+		return r
+	}
+	r.Avg = sum / float64(r.Count)
+	r.P50 = percentile(&bins, r.Count, 0.50, min, r.Max)
+	r.P95 = percentile(&bins, r.Count, 0.95, min, r.Max)
+	r.P99 = percentile(&bins, r.Count, 0.99, min, r.Max)
+	return r
+}
+
+// percentile interpolate the q quantile in its bin, within [min, max] seen
+func percentile(bins *[LATENCY_BINS]uint32, count int, q, min, max float64) float64 {
+	rank := q * float64(count)
+	var cum float64
+	for i, n := range bins {
+		if n == 0 {
+			continue
+		}
+		if cum+float64(n) >= rank {
+			lower := 0.0
+			if i > 0 {
+				lower = latencyBinBound(i - 1)
+			}
+			v := lower + (latencyBinBound(i)-lower)*(rank-cum)/float64(n)
+			return math.Max(min, math.Min(max, v))
+		}
+		cum += float64(n)
+	}
+	return max
+}
+
+// Seconds return latencies and errors of each of the last window seconds, oldest first
+func (t *LatencyTracker) Seconds(window int) []Response {
+	return t.secondsAt(time.Now(), window)
+}
+
+func (t *LatencyTracker) secondsAt(now time.Time, window int) []Response {
+	if window > len(t.slots) {
+		window = len(t.slots)
+	}
+	r := make([]Response, 0, window)
+	t.Lock()
+	defer t.Unlock()
+	end := now.Unix()
+	for sec := end - int64(window) + 1; sec <= end; sec++ {
+		res := Response{ReqTime: time.Unix(sec, 0)}
+		if s := &t.slots[int(sec%int64(len(t.slots)))]; s.sec == sec {
+			res.Count = s.count
+			res.Sum = s.sum
+			res.Errors = s.errors
+		}
+		r = append(r, res)
+	}
+	return r
+}
+
+func (t *LatencyTracker) clear() {
+	t.Lock()
+	defer t.Unlock()
+	for i := range t.slots {
+		t.slots[i].reset(-1)
+	}
+}
+
+// latencySeconds return the seconds a tracker should keep for all windows
+func latencySeconds() int {
+	n := proxyConf.ResTimeSeconds
+	if proxyConf.ErrorSeconds > n {
+		n = proxyConf.ErrorSeconds
+	}
+	for _, w := range proxyConf.LatencyWindows {
+		if w > n {
+			n = w
+		}
+	}
+	return n
+}
+
+// scoreOf return the latency used to score a host, by score_percentile
+func scoreOf(stats *LatencyStats) float64 {
+	switch proxyConf.ScorePercentile {
+	case 50:
+		return stats.P50
+	case 95:
+		return stats.P95
+	case 99:
+		return stats.P99
+	}
+	return stats.Avg
+}
@@ -0,0 +1,74 @@
+package dstore
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLatencyBin(t *testing.T) {
+	assert := assert.New(t)
+	assert.Equal(0, latencyBin(0))
+	assert.Equal(0, latencyBin(LATENCY_BIN_BASE))
+	assert.Equal(LATENCY_BINS-1, latencyBin(math.MaxFloat64))
+	for _, v := range []float64{17, 100, 999, 4000, 123456} {
+		i := latencyBin(v)
+		assert.True(v <= latencyBinBound(i), "%f in bin %d", v, i)
+		assert.True(v > latencyBinBound(i-1), "%f in bin %d", v, i)
+	}
+}
+
+func TestLatencyTracker(t *testing.T) {
+	assert := assert.New(t)
+	tracker := NewLatencyTracker(10)
+	now := time.Now()
+
+	// 1..1000 in the current second, 10 errors 2 seconds ago
+	for i := 1; i <= 1000; i++ {
+		tracker.Record(now, float64(i))
+	}
+	for i := 0; i < 10; i++ {
+		tracker.RecordError(now.Add(-2 * time.Second))
+	}
+	// too old to be kept
+	tracker.Record(now.Add(-20*time.Second), 1e6)
+
+	stats := tracker.statsAt(now, 10)
+	assert.Equal(1000, stats.Count)
+	assert.Equal(10, stats.Errors)
+	assert.InDelta(10.0/1010, stats.ErrorRate, 1e-9)
+	assert.InDelta(500.5, stats.Avg, 1e-9)
+	assert.Equal(1000.0, stats.Max)
+	assert.InDelta(500, stats.P50, 50)
+	assert.InDelta(950, stats.P95, 50)
+	assert.InDelta(990, stats.P99, 50)
+	assert.True(stats.P50 <= stats.P95 && stats.P95 <= stats.P99 && stats.P99 <= stats.Max)
+
+	// errors 2 seconds ago are out of a window of 2 seconds
+	stats = tracker.statsAt(now, 2)
+	assert.Equal(1000, stats.Count)
+	assert.Equal(0, stats.Errors)
+
+	// windows larger than capacity are cut
+	assert.Equal(10, tracker.statsAt(now, 100).Window)
+
+	// slots of stale seconds are skipped and reused
+	later := now.Add(10 * time.Second)
+	stats = tracker.statsAt(later, 10)
+	assert.Equal(0, stats.Count)
+	assert.Equal(0, stats.Errors)
+	assert.Equal(0.0, stats.P99)
+
+	seconds := tracker.secondsAt(now, 3)
+	assert.Len(seconds, 3)
+	assert.Equal(now.Unix(), seconds[2].ReqTime.Unix())
+	assert.Equal(1000, seconds[2].Count)
+	assert.Equal(10, seconds[0].Errors)
+
+	tracker.clear()
+	stats = tracker.statsAt(now, 10)
+	assert.Equal(0, stats.Count)
+	assert.Equal(0, stats.Errors)
+}
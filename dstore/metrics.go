@@ -10,6 +10,22 @@ var (
 	rrrStoreReqs *prometheus.CounterVec
 	rrrStoreErr *prometheus.CounterVec
 	rrrStoreLag *prometheus.GaugeVec
+	hedgedReqs *prometheus.CounterVec
+	readRepairReqs *prometheus.CounterVec
+	hintedHandoffs *prometheus.CounterVec
+	hintsQueued *prometheus.GaugeVec
+	quorumReadReqs *prometheus.CounterVec
+	dualWRetryQueueDepth prometheus.Gauge
+	dualWRetryQueueAge prometheus.Gauge
+	dualWRetries *prometheus.CounterVec
+	verifyReads *prometheus.CounterVec
+	cstarCfgReloads *prometheus.CounterVec
+	cstarCfgVersion *prometheus.GaugeVec
+	cstarCfgLoadedTime *prometheus.GaugeVec
+	hostHealthy *prometheus.GaugeVec
+	healthStateChanges *prometheus.CounterVec
+	circuitBreakerState *prometheus.GaugeVec
+	circuitBreakerTransitions *prometheus.CounterVec
 	cmdReqDurationSeconds *prometheus.HistogramVec
 	cmdE2EDurationSeconds *prometheus.HistogramVec
 	BdbProxyPromRegistry *prometheus.Registry
@@ -85,4 +101,162 @@ func init() {
 		[]string{"host"},
 	)
 	BdbProxyPromRegistry.MustRegister(rrrStoreLag)
+
+	hedgedReqs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gobeansproxy",
+			Name: "hedged_reqs",
+			Help: "hedged read requests counter, event is fired or won",
+		},
+		[]string{"cmd", "event"},
+	)
+	BdbProxyPromRegistry.MustRegister(hedgedReqs)
+
+	readRepairReqs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gobeansproxy",
+			Name: "read_repair_reqs",
+			Help: "read repair counter, result is attempted/succeeded/failed/dropped",
+		},
+		[]string{"result"},
+	)
+	BdbProxyPromRegistry.MustRegister(readRepairReqs)
+
+	hintedHandoffs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gobeansproxy",
+			Name: "hinted_handoffs",
+			Help: "hinted handoff counter, event is added/replayed/dropped/expired",
+		},
+		[]string{"event"},
+	)
+	BdbProxyPromRegistry.MustRegister(hintedHandoffs)
+
+	hintsQueued = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gobeansproxy",
+			Name: "hints_queued",
+			Help: "hints waiting for replay to the host",
+		},
+		[]string{"host"},
+	)
+	BdbProxyPromRegistry.MustRegister(hintsQueued)
+
+	quorumReadReqs = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gobeansproxy",
+			Name: "quorum_read_reqs",
+			Help: "quorum read counter, result is consistent/inconsistent/failed",
+		},
+		[]string{"result"},
+	)
+	BdbProxyPromRegistry.MustRegister(quorumReadReqs)
+
+	dualWRetryQueueDepth = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "gobeansproxy",
+			Name: "dual_write_retry_queue_depth",
+			Help: "failed dual writes waiting for retry",
+		},
+	)
+	BdbProxyPromRegistry.MustRegister(dualWRetryQueueDepth)
+
+	dualWRetryQueueAge = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace: "gobeansproxy",
+			Name: "dual_write_retry_oldest_age_seconds",
+			Help: "age of the oldest failed dual write waiting for retry",
+		},
+	)
+	BdbProxyPromRegistry.MustRegister(dualWRetryQueueAge)
+
+	dualWRetries = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gobeansproxy",
+			Name: "dual_write_retries",
+			Help: "dual write retry counter, result is applied/failed/skipped",
+		},
+		[]string{"result"},
+	)
+	BdbProxyPromRegistry.MustRegister(dualWRetries)
+
+	verifyReads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gobeansproxy",
+			Name: "verify_reads",
+			Help: "shadow read counter of prefixes in verify status, result is match/mismatch/error/dropped",
+		},
+		[]string{"prefix", "result"},
+	)
+	BdbProxyPromRegistry.MustRegister(verifyReads)
+
+	cstarCfgReloads = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gobeansproxy",
+			Name: "cstar_cfg_reloads",
+			Help: "periodic check of c* prefix cfg, result is reloaded/unchanged/failed",
+		},
+		[]string{"config", "result"},
+	)
+	BdbProxyPromRegistry.MustRegister(cstarCfgReloads)
+
+	cstarCfgVersion = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gobeansproxy",
+			Name: "cstar_cfg_version",
+			Help: "version (hash) of c* prefix cfg loaded, should be the same on all proxies",
+		},
+		[]string{"config"},
+	)
+	BdbProxyPromRegistry.MustRegister(cstarCfgVersion)
+
+	cstarCfgLoadedTime = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gobeansproxy",
+			Name: "cstar_cfg_loaded_timestamp_seconds",
+			Help: "unix time c* prefix cfg is loaded",
+		},
+		[]string{"config"},
+	)
+	BdbProxyPromRegistry.MustRegister(cstarCfgLoadedTime)
+
+	hostHealthy = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gobeansproxy",
+			Name: "host_healthy",
+			Help: "health state of beansdb host by health checks, 1 is up and 0 is down",
+		},
+		[]string{"host"},
+	)
+	BdbProxyPromRegistry.MustRegister(hostHealthy)
+
+	healthStateChanges = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gobeansproxy",
+			Name: "health_state_changes",
+			Help: "health state change counter of beansdb host, state is up/down",
+		},
+		[]string{"host", "state"},
+	)
+	BdbProxyPromRegistry.MustRegister(healthStateChanges)
+
+	circuitBreakerState = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace: "gobeansproxy",
+			Name: "circuit_breaker_state",
+			Help: "circuit breaker state of beansdb host, 0 is closed, 1 is half open and 2 is open",
+		},
+		[]string{"host"},
+	)
+	BdbProxyPromRegistry.MustRegister(circuitBreakerState)
+
+	circuitBreakerTransitions = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace: "gobeansproxy",
+			Name: "circuit_breaker_transitions",
+			Help: "circuit breaker state transition counter of beansdb host, state is the new one: closed/open/half_open",
+		},
+		[]string{"host", "state"},
+	)
+	BdbProxyPromRegistry.MustRegister(circuitBreakerTransitions)
 }
@@ -0,0 +1,124 @@
+package dstore
+
+import (
+	"time"
+
+	mc "github.com/douban/gobeansdb/memcache"
+)
+
+// metaReturnType 用来在 quorumGet 的 goroutine 之间传递 meta 的结果
+type metaReturnType struct {
+	host      *Host
+	meta      *ItemMeta
+	err       error
+	startTime time.Time
+}
+
+// newerMeta return true if a is newer than b, nil is older than any meta
+func newerMeta(a, b *ItemMeta) bool {
+	if a == nil {
+		return false
+	}
+	if b == nil {
+		return true
+	}
+	if abs(a.Ver) != abs(b.Ver) {
+		return abs(a.Ver) > abs(b.Ver)
+	}
+	return a.TS > b.TS
+}
+
+// quorumGet get meta of key from R of hosts in parallel, a host failed is
+// replaced by the next one, and the value is got from the host holding the
+// newest version. Key is not found if the newest version is deleted.
+func (c *StorageClient) quorumGet(hosts []*Host, key string) (item *mc.Item, err error) {
+	r := c.R
+	if r > len(hosts) {
+		r = len(hosts)
+	}
+	results := make(chan metaReturnType, len(hosts))
+	next := 0
+	launch := func() {
+		host := hosts[next]
+		next++
+		go func() {
+			start := time.Now()
+			meta, err := host.GetMeta(key)
+			results <- metaReturnType{host: host, meta: meta, err: err, startTime: start}
+		}()
+	}
+	for next < r {
+		launch()
+	}
+
+	answered := make([]metaReturnType, 0, r)
+	for pending := r; pending > 0; pending-- {
+		res := <-results
+		if res.err != nil {
+			err = res.err
+			if isWaitForRetry(res.err) {
+				c.sched.FeedbackError(res.host, key, res.startTime, FeedbackConnectErrDefault)
+			} else {
+				c.sched.FeedbackError(res.host, key, res.startTime, FeedbackNonConnectErrDefault)
+			}
+			if next < len(hosts) {
+				launch()
+				pending++
+			}
+			continue
+		}
+		c.sched.FeedbackLatency(res.host, key, res.startTime, time.Now().Sub(res.startTime))
+		answered = append(answered, res)
+	}
+	if len(answered) < c.R {
+		quorumReadReqs.WithLabelValues("failed").Inc()
+		return nil, err
+	}
+	err = nil
+
+	var newest *ItemMeta
+	for _, res := range answered {
+		if newerMeta(res.meta, newest) {
+			newest = res.meta
+		}
+	}
+	stale := []*Host{}
+	latest := []*Host{}
+	for _, res := range answered {
+		c.SuccessedTargets = append(c.SuccessedTargets, res.host.Addr)
+		if res.meta == nil || abs(res.meta.Ver) < abs(newest.Ver) {
+			stale = append(stale, res.host)
+		} else {
+			latest = append(latest, res.host)
+		}
+	}
+	if newest == nil {
+		quorumReadReqs.WithLabelValues("consistent").Inc()
+		return nil, nil
+	}
+	if len(stale) == 0 {
+		quorumReadReqs.WithLabelValues("consistent").Inc()
+	} else {
+		quorumReadReqs.WithLabelValues("inconsistent").Inc()
+	}
+	if newest.Ver < 0 {
+		return nil, nil
+	}
+
+	for _, host := range latest {
+		start := time.Now()
+		item, err = host.Get(key)
+		if err != nil {
+			c.sched.FeedbackError(host, key, start, FeedbackNonConnectErrDefault)
+			continue
+		}
+		if item != nil {
+			c.SuccessedTargets = []string{host.Addr}
+			if proxyConf.QuorumReadRepair && len(stale) > 0 {
+				enqueueReadRepair(&readRepairJob{key: key, src: host, peers: stale})
+			}
+		}
+		return
+	}
+	return
+}
@@ -0,0 +1,72 @@
+package dstore
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNewerMeta(t *testing.T) {
+	assert := assert.New(t)
+	assert.True(newerMeta(&ItemMeta{Ver: 1}, nil))
+	assert.False(newerMeta(nil, &ItemMeta{Ver: 1}))
+	assert.True(newerMeta(&ItemMeta{Ver: -3}, &ItemMeta{Ver: 2}))
+	assert.False(newerMeta(&ItemMeta{Ver: 2}, &ItemMeta{Ver: -3}))
+	assert.True(newerMeta(&ItemMeta{Ver: 2, TS: 2}, &ItemMeta{Ver: 2, TS: 1}))
+}
+
+func TestQuorumGet(t *testing.T) {
+	teardown := setupSuite(t)
+	defer teardown(t)
+	assert := assert.New(t)
+
+	c := newDStoreOnlyClient()
+	c.R = c.N
+	proxyConf.QuorumReadEnable = true
+	proxyConf.QuorumReadRepair = true
+	defer func() {
+		proxyConf.QuorumReadEnable = false
+		proxyConf.QuorumReadRepair = false
+	}()
+
+	key := fmt.Sprintf("/test/quorum/%d", time.Now().UnixNano())
+	hosts := GetScheduler().GetHostsByKey(key)[:c.N]
+	old := newItem(0, []byte("old"))
+	for _, host := range hosts {
+		ok, _ := host.Set(key, old, false)
+		assert.True(ok)
+	}
+	old.Free()
+	// only the last replica holds the newest value
+	latest := newItem(0, []byte("new"))
+	ok, _ := hosts[c.N-1].Set(key, latest, false)
+	assert.True(ok)
+	latest.Free()
+
+	item, err := c.Get(key)
+	assert.Nil(err)
+	if assert.NotNil(item) {
+		assert.Equal("new", string(item.Body))
+		item.Free()
+	}
+	assert.Equal([]string{hosts[c.N-1].Addr}, c.SuccessedTargets)
+
+	// stale replicas are repaired in background
+	time.Sleep(time.Second)
+	for _, host := range hosts {
+		meta, err := host.GetMeta(key)
+		assert.Nil(err)
+		if assert.NotNil(meta) {
+			assert.Equal(2, meta.Ver)
+		}
+	}
+
+	// a deleted newest version means not found
+	ok, _ = hosts[0].Delete(key)
+	assert.True(ok)
+	item, err = c.Get(key)
+	assert.Nil(err)
+	assert.Nil(item)
+}
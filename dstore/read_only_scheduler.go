@@ -34,10 +34,25 @@ func NewRRReadScheduler(route *dbcfg.RouteTable) *RRReadScheduler {
 func (sch *RRReadScheduler) GetHostsByKey(key string) (hosts []*Host) {
 	next := sch.current.Add(1) % sch.totalHostsI32
 	sch.current.Store(next)
+	// skip hosts with circuit breaker open, unless all of them are
+	for i := int32(0); i < sch.totalHostsI32; i++ {
+		if idx := (next + i) % sch.totalHostsI32; !sch.hosts[idx].breaker.IsOpen() {
+			next = idx
+			break
+		}
+	}
 	rrrStoreReqs.WithLabelValues(sch.hosts[next].Addr).Inc()
 	return sch.hosts[next:next+1]
 }
 
+func (sch *RRReadScheduler) GetHostLatency(host *Host, key string) float64 {
+	return 0
+}
+
+func (sch *RRReadScheduler) GetPrimaryHost(key string) (*Host, bool) {
+	return nil, false
+}
+
 func (sch *RRReadScheduler) FeedbackError(host *Host, key string, startTime time.Time, errorCode float64) {
 	rrrStoreErr.WithLabelValues(host.Addr, fmt.Sprintf("%f", errorCode)).Inc()
 	return
@@ -76,8 +91,12 @@ func (sch *RRReadScheduler) Stats() map[string]map[string]float64 {
 	return nil
 }
 
+func (sch *RRReadScheduler) HealthStats() map[string]*HostHealth {
+	return nil
+}
+
 // get latencies of hosts in the bucket
-func (sch *RRReadScheduler) LatenciesStats() map[string]map[string][QUEUECAP]Response {
+func (sch *RRReadScheduler) LatenciesStats() map[string]map[string][]*LatencyStats {
 	return nil
 }
 
@@ -86,8 +105,12 @@ func (sch *RRReadScheduler) Partition() map[string]map[string]int {
 	return nil
 }
 
-// return average latency  and arc(percentage)
-func (sch *RRReadScheduler) GetBucketInfo(bucketID int64) map[string]map[string]map[string][]Response {
+func (sch *RRReadScheduler) BalanceStats() (string, map[string]map[string]*HostBalanceStats) {
+	return NoBucketsRounRobinROSchduler, nil
+}
+
+// return score, arc(percentage) and latencies of hosts in the bucket
+func (sch *RRReadScheduler) GetBucketInfo(bucketID int64) map[string]*HostBucketInfo {
 	return nil
 }
 
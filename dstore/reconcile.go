@@ -0,0 +1,233 @@
+package dstore
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	mc "github.com/douban/gobeansdb/memcache"
+)
+
+// max mismatches kept in ReconcileReport, others are only counted
+const RECONCILE_MAX_MISMATCHES = 1000
+
+// line of dual write error log written by cassandra.DualWriteErrorMgr,
+// Time is when the write failed
+type dualWErrLogLine struct {
+	Key  string    `json:"key"`
+	Op   string    `json:"op"`
+	Time time.Time `json:"time"`
+}
+
+type ReconcileMismatch struct {
+	Key    string `json:"key"`
+	Reason string `json:"reason"`
+	Fixed  bool   `json:"fixed"`
+	Error  string `json:"error,omitempty"`
+}
+
+type ReconcileReport struct {
+	Files      []string             `json:"files"`
+	Lines      int                  `json:"lines"`
+	BadLines   int                  `json:"bad_lines"`
+	Keys       int                  `json:"keys"`
+	Consistent int                  `json:"consistent"`
+	Mismatched int                  `json:"mismatched"`
+	Fixed      int                  `json:"fixed"`
+	Skipped    int                  `json:"skipped"`
+	Errors     int                  `json:"errors"`
+	DryRun     bool                 `json:"dry_run"`
+	Elapsed    string               `json:"elapsed"`
+	Mismatches []*ReconcileMismatch `json:"mismatches"`
+}
+
+// FindDualWErrLogs return the dual write error log file and its rotated
+// backups (maybe gzipped) in dir, the oldest first.
+func FindDualWErrLogs(dir, fname string) ([]string, error) {
+	ext := filepath.Ext(fname)
+	prefix := strings.TrimSuffix(fname, ext)
+	// lumberjack backups are named <prefix>-<timestamp><ext>[.gz]
+	backups, err := filepath.Glob(filepath.Join(dir, prefix+"-*"+ext+"*"))
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(backups)
+	files := []string{}
+	for _, f := range backups {
+		if strings.HasSuffix(f, ext) || strings.HasSuffix(f, ext+".gz") {
+			files = append(files, f)
+		}
+	}
+	current := filepath.Join(dir, fname)
+	if _, err := os.Stat(current); err == nil {
+		files = append(files, current)
+	}
+	return files, nil
+}
+
+// ReadDualWErrLogs read failed writes from dual write error logs, keys are
+// deduplicated and kept in the order they first appear, with the time of
+// the last failed write of each.
+func ReadDualWErrLogs(files []string, report *ReconcileReport) ([]*DualWRetryEntry, error) {
+	seen := make(map[string]*DualWRetryEntry)
+	entries := []*DualWRetryEntry{}
+	for _, path := range files {
+		err := readDualWErrLog(path, func(line []byte) {
+			report.Lines++
+			l := new(dualWErrLogLine)
+			if err := json.Unmarshal(line, l); err != nil || l.Key == "" {
+				report.BadLines++
+				return
+			}
+			if e, ok := seen[l.Key]; ok {
+				if l.Time.After(e.Time) {
+					e.Op, e.Time = l.Op, l.Time
+				}
+				return
+			}
+			e := &DualWRetryEntry{Key: l.Key, Op: l.Op, Time: l.Time}
+			seen[l.Key] = e
+			entries = append(entries, e)
+		})
+		if err != nil {
+			return nil, fmt.Errorf("read %s err: %s", path, err)
+		}
+		report.Files = append(report.Files, path)
+	}
+	report.Keys = len(entries)
+	return entries, nil
+}
+
+func readDualWErrLog(path string, handle func(line []byte)) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var r io.Reader = f
+	if strings.HasSuffix(path, ".gz") {
+		gz, err := gzip.NewReader(f)
+		if err != nil {
+			return err
+		}
+		defer gz.Close()
+		r = gz
+	}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if line := bytes.TrimSpace(scanner.Bytes()); len(line) > 0 {
+			handle(line)
+		}
+	}
+	return scanner.Err()
+}
+
+// diffItems return why c* item differs from beansdb item, "" if they are the same
+func diffItems(bitem, citem *mc.Item) string {
+	switch {
+	case bitem == nil && citem == nil:
+		return ""
+	case bitem == nil:
+		return "deleted in beansdb"
+	case citem == nil:
+		return "missing in cstar"
+	case bitem.Flag != citem.Flag:
+		return "flag differs"
+	case !bytes.Equal(bitem.Body, citem.Body):
+		return "body differs"
+	}
+	return ""
+}
+
+// Reconcile compare keys of failed writes in beansdb and c*, and write the
+// value in beansdb to c* if they differ and not dryRun. At most rate keys are
+// checked per second if rate > 0.
+func Reconcile(entries []*DualWRetryEntry, dryRun bool, rate int, report *ReconcileReport) {
+	start := time.Now()
+	report.DryRun = dryRun
+	var ticker *time.Ticker
+	if rate > 0 {
+		ticker = time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+	}
+
+	for _, e := range entries {
+		if ticker != nil {
+			<-ticker.C
+		}
+		if !isDualWriteKey(e.Key) {
+			report.Skipped++
+			continue
+		}
+		m, err := reconcileKey(e, dryRun)
+		if err != nil {
+			logger.Errorf("reconcile %s err: %s", e.Key, err)
+			report.Errors++
+		}
+		if m == nil {
+			if err == nil {
+				report.Consistent++
+			}
+			continue
+		}
+		report.Mismatched++
+		if m.Fixed {
+			report.Fixed++
+		}
+		if len(report.Mismatches) < RECONCILE_MAX_MISMATCHES {
+			report.Mismatches = append(report.Mismatches, m)
+		}
+	}
+	report.Elapsed = time.Since(start).String()
+}
+
+// reconcileKey make c* the same as beansdb for the key of failed write e,
+// the value is written at the time of e so newer writes are not overwritten
+func reconcileKey(e *DualWRetryEntry, dryRun bool) (*ReconcileMismatch, error) {
+	key := e.Key
+	bitem, meta, err := getNewestFromBeansdb(key)
+	if err != nil {
+		return nil, err
+	}
+	if bitem != nil {
+		defer freeGotItem(bitem)
+	}
+	citem, err := CqlStore.Get(key)
+	if err != nil {
+		return nil, err
+	}
+	if citem != nil {
+		defer citem.Free()
+	}
+
+	reason := diffItems(bitem, citem)
+	if reason == "" {
+		return nil, nil
+	}
+	m := &ReconcileMismatch{Key: key, Reason: reason}
+	if dryRun {
+		return m, nil
+	}
+	if meta == nil {
+		// never on beansdb, only the version of c* seen here is deleted
+		_, err = CqlStore.DeleteAt(key, citem.ReceiveTime)
+	} else {
+		err = syncKeyToCstar(CqlStore, key, bitem, e.Time)
+	}
+	if err != nil {
+		m.Error = err.Error()
+		return m, err
+	}
+	m.Fixed = true
+	return m, nil
+}
@@ -0,0 +1,76 @@
+package dstore
+
+import (
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	mc "github.com/douban/gobeansdb/memcache"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadDualWErrLogs(t *testing.T) {
+	assert := assert.New(t)
+	dir := t.TempDir()
+
+	old := filepath.Join(dir, "dual_write_err-2023-01-01T00-00-00.000.log.gz")
+	f, err := os.Create(old)
+	assert.Nil(err)
+	gz := gzip.NewWriter(f)
+	gz.Write([]byte(`{"key":"/test/reconcile/1","level":"error","msg":"timeout","op":"set","time":"2023-01-01T00:00:00.5+08:00"}
+{"key":"/test/reconcile/2","level":"error","msg":"timeout","op":"del","time":"2023-01-01T00:00:00.6+08:00"}
+`))
+	gz.Close()
+	f.Close()
+	backup := filepath.Join(dir, "dual_write_err-2023-01-02T00-00-00.000.log")
+	os.WriteFile(backup, []byte(`{"key":"/test/reconcile/2","level":"error","msg":"timeout","op":"set","time":"2023-01-02T00:00:00.123456789+08:00"}
+not json
+`), 0644)
+	current := filepath.Join(dir, "dual_write_err.log")
+	os.WriteFile(current, []byte(`{"key":"/test/reconcile/3","level":"error","msg":"timeout","op":"incr"}
+{"key":"/test/reconcile/1","level":"error","msg":"timeout","op":"append","time":"2022-12-31T00:00:00+08:00"}
+`), 0644)
+	os.WriteFile(filepath.Join(dir, "other.log"), []byte(`{"key":"/other"}`), 0644)
+
+	files, err := FindDualWErrLogs(dir, "dual_write_err.log")
+	assert.Nil(err)
+	assert.Equal([]string{old, backup, current}, files)
+
+	report := new(ReconcileReport)
+	entries, err := ReadDualWErrLogs(files, report)
+	assert.Nil(err)
+	keys := []string{}
+	for _, e := range entries {
+		keys = append(keys, e.Key)
+	}
+	assert.Equal([]string{"/test/reconcile/1", "/test/reconcile/2", "/test/reconcile/3"}, keys)
+	// time of the last failed write is kept
+	tz := time.FixedZone("", 8*3600)
+	assert.True(time.Date(2023, 1, 1, 0, 0, 0, 5e8, tz).Equal(entries[0].Time))
+	assert.Equal("set", entries[0].Op)
+	assert.True(time.Date(2023, 1, 2, 0, 0, 0, 123456789, tz).Equal(entries[1].Time))
+	assert.Equal("set", entries[1].Op)
+	assert.True(entries[2].Time.IsZero())
+	assert.Equal(6, report.Lines)
+	assert.Equal(1, report.BadLines)
+	assert.Equal(3, report.Keys)
+}
+
+func newDiffItem(flag int, body string) *mc.Item {
+	item := &mc.Item{Flag: flag}
+	item.Body = []byte(body)
+	return item
+}
+
+func TestDiffItems(t *testing.T) {
+	assert := assert.New(t)
+	a := newDiffItem(0, "a")
+	assert.Equal("", diffItems(nil, nil))
+	assert.Equal("", diffItems(a, newDiffItem(0, "a")))
+	assert.Equal("deleted in beansdb", diffItems(nil, a))
+	assert.Equal("missing in cstar", diffItems(a, nil))
+	assert.Equal("flag differs", diffItems(a, newDiffItem(1, "a")))
+	assert.Equal("body differs", diffItems(a, newDiffItem(0, "b")))
+}
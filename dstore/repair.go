@@ -0,0 +1,165 @@
+package dstore
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/douban/gobeansdb/cmem"
+	mc "github.com/douban/gobeansdb/memcache"
+)
+
+const (
+	// jobs waiting for read repair, new jobs are dropped when it is full
+	READ_REPAIR_QUEUE_CAP = 1024
+)
+
+var (
+	readRepairOnce  sync.Once
+	readRepairQueue chan *readRepairJob
+)
+
+// readRepairJob copy key from src to the peers which miss the key
+// or hold an older version of it.
+type readRepairJob struct {
+	key   string
+	src   *Host
+	peers []*Host
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+// getItemWithVersion get key from src and set it with the version of meta,
+// so gobeansdb will ignore it when writing to a host which has been updated
+// by clients in the meantime.
+func getItemWithVersion(key string, src *Host, meta *ItemMeta) (*mc.Item, error) {
+	item, err := src.Get(key)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	item.Exptime = meta.Ver
+	item.ReceiveTime = time.Unix(meta.TS, 0)
+	return item, nil
+}
+
+// freeGotItem free item got from host which is not returned to client
+func freeGotItem(item *mc.Item) {
+	cmem.DBRL.GetData.SubSizeAndCount(item.Cap)
+	item.Free()
+}
+
+// syncKeyTo make dst hold the version of key described by meta, which is got from src
+func syncKeyTo(key string, src *Host, meta *ItemMeta, dst *Host) error {
+	if meta.Ver < 0 {
+		_, err := dst.Delete(key)
+		return err
+	}
+	item, err := getItemWithVersion(key, src, meta)
+	if err != nil {
+		return err
+	}
+	if item == nil {
+		return fmt.Errorf("%s not found on %s", key, src.Addr)
+	}
+	defer freeGotItem(item)
+	if ok, err := dst.Set(key, item, false); !ok {
+		if err == nil {
+			err = fmt.Errorf("not stored")
+		}
+		return err
+	}
+	return nil
+}
+
+func startReadRepairWorkers() {
+	readRepairQueue = make(chan *readRepairJob, READ_REPAIR_QUEUE_CAP)
+	workers := proxyConf.ReadRepairConcurrency
+	if workers <= 0 {
+		workers = 1
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range readRepairQueue {
+				job.run()
+			}
+		}()
+	}
+}
+
+// tryReadRepair is called after key was found on src, missed is true when
+// some replica answered not found before src. Reads without missed replica
+// only check versions of peers with probability of read_repair_chance.
+func tryReadRepair(key string, src *Host, hosts []*Host, missed bool) {
+	if !proxyConf.ReadRepairEnable || len(key) == 0 || key[0] == '@' || key[0] == '?' {
+		return
+	}
+	if !missed && rand.Float64() >= proxyConf.ReadRepairChance {
+		return
+	}
+
+	peers := make([]*Host, 0, len(hosts))
+	for _, host := range hosts {
+		if host != nil && host != src {
+			peers = append(peers, host)
+		}
+	}
+	if len(peers) == 0 {
+		return
+	}
+
+	enqueueReadRepair(&readRepairJob{key: key, src: src, peers: peers})
+}
+
+func enqueueReadRepair(job *readRepairJob) {
+	readRepairOnce.Do(startReadRepairWorkers)
+	select {
+	case readRepairQueue <- job:
+	default:
+		readRepairReqs.WithLabelValues("dropped").Inc()
+	}
+}
+
+func (job *readRepairJob) run() {
+	srcMeta, err := job.src.GetMeta(job.key)
+	if err != nil || srcMeta == nil || srcMeta.Ver < 0 {
+		// src is down or key is deleted after we read it
+		return
+	}
+
+	stale := []*Host{}
+	for _, peer := range job.peers {
+		meta, err := peer.GetMeta(job.key)
+		if err != nil {
+			continue
+		}
+		if meta == nil || abs(meta.Ver) < srcMeta.Ver {
+			stale = append(stale, peer)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+
+	item, err := getItemWithVersion(job.key, job.src, srcMeta)
+	if err != nil || item == nil {
+		return
+	}
+	defer freeGotItem(item)
+
+	for _, peer := range stale {
+		readRepairReqs.WithLabelValues("attempted").Inc()
+		if ok, err := peer.Set(job.key, item, false); ok {
+			readRepairReqs.WithLabelValues("succeeded").Inc()
+		} else {
+			readRepairReqs.WithLabelValues("failed").Inc()
+			logger.Warnf("read repair key %s from %s to %s failed: %v",
+				job.key, job.src.Addr, peer.Addr, err)
+		}
+	}
+}
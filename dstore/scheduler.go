@@ -31,20 +31,34 @@ type Scheduler interface {
 	// route a key to hosts
 	GetHostsByKey(key string) (hosts []*Host)
 
+	// average latency (Microsecond) of host in the bucket of key, 0 if unknown
+	GetHostLatency(host *Host, key string) float64
+
+	// the fixed main host owning key, which does not change with latencies,
+	// alive is false when the host is down
+	GetPrimaryHost(key string) (host *Host, alive bool)
+
 	// route some keys to group of hosts
 	DivideKeysByBucket(keys []string) [][]string
 
 	// internal status
 	Stats() map[string]map[string]float64
 
-	// get latencies of hosts in the bucket
-	LatenciesStats() map[string]map[string][QUEUECAP]Response
+	// health state of hosts by health checks
+	HealthStats() map[string]*HostHealth
+
+	// get latency percentiles and error rates of hosts in each bucket,
+	// in windows of latency_windows_seconds
+	LatenciesStats() map[string]map[string][]*LatencyStats
 
 	// get percentage of hosts in the bucket
 	Partition() map[string]map[string]int
 
-	// return average latency  and arc(percentage)
-	GetBucketInfo(bucketID int64) map[string]map[string]map[string][]Response
+	// balance strategy and status of hosts in each bucket
+	BalanceStats() (strategy string, stats map[string]map[string]*HostBalanceStats)
+
+	// return score, arc(percentage) and latencies of hosts in the bucket
+	GetBucketInfo(bucketID int64) map[string]*HostBucketInfo
 
 	Close()
 }
@@ -60,6 +74,9 @@ type ManualScheduler struct {
 	// backups[bucket] is a list of host index.
 	backupsCon []*Bucket
 
+	// probers[host.Index] check the health of host for all buckets of it
+	probers []*HealthProber
+
 	hashMethod dbutil.HashMethod
 
 	// bucketWidth: 2^bucketWidth = route.NumBucket
@@ -78,6 +95,21 @@ func GetScheduler() Scheduler {
 func InitGlobalManualScheduler(route *dbcfg.RouteTable, n int, schedulerName string) {
 	switch schedulerName {
 	case BucketsManualSchduler, "":
+		if !IsValidBalanceStrategy(proxyConf.BalanceStrategy) {
+			logger.Fatalf(
+				"Unsupported balance strategy %s, must be: %s, %s, %s or %s",
+				proxyConf.BalanceStrategy,
+				BalanceArc, BalanceLeastOutstanding, BalanceP2CEWMA, BalanceStrict,
+			)
+		}
+		if _, _, err := parseHealthCheckCmd(proxyConf.HealthCheckCmd); err != nil {
+			logger.Fatalf("%s", err)
+		}
+		switch proxyConf.ScorePercentile {
+		case 0, 50, 95, 99:
+		default:
+			logger.Fatalf("Unsupported score percentile %d, must be 0, 50, 95 or 99", proxyConf.ScorePercentile)
+		}
 		globalScheduler = NewManualScheduler(route, n)
 	case NoBucketsRounRobinROSchduler:
 		if n != 1 {
@@ -134,6 +166,7 @@ func NewManualScheduler(route *dbcfg.RouteTable, n int) *ManualScheduler {
 
 	sch.hashMethod = dbutil.Fnv1a
 	sch.bucketWidth = calBitWidth(route.NumBucket)
+	sch.startHealthProbers()
 
 	// scheduler 对各个 host 的打分机制
 	go sch.procFeedback()
@@ -147,7 +180,6 @@ func NewManualScheduler(route *dbcfg.RouteTable, n int) *ManualScheduler {
 				close(sch.feedChan)
 				break
 			}
-			sch.checkFails() //
 			sch.tryRebalance()
 			time.Sleep(5 * time.Second)
 		}
@@ -186,7 +218,8 @@ func (sch *ManualScheduler) GetHostsByKey(key string) (hosts []*Host) {
 	bucketNum := getBucketByKey(sch.hashMethod, sch.bucketWidth, key)
 	bucket := sch.bucketsCon[bucketNum]
 	hosts = make([]*Host, sch.N+len(sch.backupsCon[bucketNum].hostsList))
-	hostsCon := bucket.GetHosts(key)
+	// hosts with circuit breaker open are tried last
+	hostsCon := closedFirst(bucket.GetHosts(key))
 	for i, host := range hostsCon {
 		if i < sch.N {
 			hosts[i] = host
@@ -199,6 +232,26 @@ func (sch *ManualScheduler) GetHostsByKey(key string) (hosts []*Host) {
 	return
 }
 
+func (sch *ManualScheduler) getHostByAddr(addr string) *Host {
+	for _, host := range sch.hosts {
+		if host.Addr == addr {
+			return host
+		}
+	}
+	return nil
+}
+
+func (sch *ManualScheduler) GetHostLatency(host *Host, key string) float64 {
+	bucketNum := getBucketByKey(sch.hashMethod, sch.bucketWidth, key)
+	_, hostBucket := sch.bucketsCon[bucketNum].getHostByAddr(host.Addr)
+	return hostBucket.score
+}
+
+func (sch *ManualScheduler) GetPrimaryHost(key string) (*Host, bool) {
+	bucketNum := getBucketByKey(sch.hashMethod, sch.bucketWidth, key)
+	return sch.bucketsCon[bucketNum].GetPrimaryHost(key)
+}
+
 type Feedback struct {
 	addr      string
 	bucket    int
@@ -247,12 +300,6 @@ func (sch *ManualScheduler) feedback(addr string, bucketNum int, startTime time.
 	}
 }
 
-func (sch *ManualScheduler) checkFails() {
-	for _, bucket := range sch.bucketsCon {
-		sch.checkFailsForBucket(bucket)
-	}
-}
-
 func (sch *ManualScheduler) tryRebalance() {
 	for _, bucket := range sch.bucketsCon {
 		bucket.ReBalance()
@@ -260,18 +307,41 @@ func (sch *ManualScheduler) tryRebalance() {
 
 }
 
-func (sch *ManualScheduler) checkFailsForBucket(bucket *Bucket) {
-	hosts := bucket.hostsList
-	for _, hostBucket := range hosts {
-		if item, err := hostBucket.host.Get("@"); err == nil {
-			item.Free()
-			bucket.riseHost(hostBucket.host.Addr)
-		} else {
-			logger.Infof(
-				"beansdb server %s in Bucket %X's Down while check fails , err is %s",
-				hostBucket.host.Addr, bucket.ID, err)
+// startHealthProbers start a prober for each host, state changes of
+// the host are applied to all buckets containing it
+func (sch *ManualScheduler) startHealthProbers() {
+	hostBuckets := make([][]*Bucket, len(sch.hosts))
+	for _, buckets := range [][]*Bucket{sch.bucketsCon, sch.backupsCon} {
+		for _, bucket := range buckets {
+			if bucket == nil {
+				continue
+			}
+			for _, hb := range bucket.hostsList {
+				hostBuckets[hb.host.Index] = append(hostBuckets[hb.host.Index], bucket)
+			}
+		}
+	}
+	sch.probers = make([]*HealthProber, len(sch.hosts))
+	for i, host := range sch.hosts {
+		p, err := newHealthProber(host, hostBuckets[i])
+		if err != nil {
+			logger.Errorf("create health prober of %s err: %s", host.Addr, err)
+			continue
+		}
+		sch.probers[i] = p
+		go p.run()
+	}
+}
+
+// HealthStats return the health state of each host by addr
+func (sch *ManualScheduler) HealthStats() map[string]*HostHealth {
+	r := make(map[string]*HostHealth, len(sch.probers))
+	for _, p := range sch.probers {
+		if p != nil {
+			r[p.host.Addr] = p.Health()
 		}
 	}
+	return r
 }
 
 func (sch *ManualScheduler) DivideKeysByBucket(keys []string) [][]string {
@@ -303,8 +373,8 @@ func (sch *ManualScheduler) Stats() map[string]map[string]float64 {
 	return r
 }
 
-func (sch *ManualScheduler) LatenciesStats() map[string]map[string][QUEUECAP]Response {
-	r := make(map[string]map[string][QUEUECAP]Response, len(sch.bucketsCon))
+func (sch *ManualScheduler) LatenciesStats() map[string]map[string][]*LatencyStats {
+	r := make(map[string]map[string][]*LatencyStats, len(sch.bucketsCon))
 
 	for _, bucket := range sch.bucketsCon {
 		var bkt string
@@ -313,9 +383,13 @@ func (sch *ManualScheduler) LatenciesStats() map[string]map[string][QUEUECAP]Res
 		} else {
 			bkt = fmt.Sprintf("%x", bucket.ID)
 		}
-		r[bkt] = make(map[string][QUEUECAP]Response, len(bucket.hostsList))
+		r[bkt] = make(map[string][]*LatencyStats, len(bucket.hostsList))
 		for _, host := range bucket.hostsList {
-			r[bkt][host.host.Addr] = *host.lantency.resData
+			stats := make([]*LatencyStats, 0, len(proxyConf.LatencyWindows))
+			for _, window := range proxyConf.LatencyWindows {
+				stats = append(stats, host.latency.Stats(window))
+			}
+			r[bkt][host.host.Addr] = stats
 		}
 
 	}
@@ -341,16 +415,42 @@ func (sch *ManualScheduler) Partition() map[string]map[string]int {
 	return r
 }
 
-// return addr:score:offset:response
-func (sch *ManualScheduler) GetBucketInfo(bucketID int64) map[string]map[string]map[string][]Response {
+func (sch *ManualScheduler) BalanceStats() (string, map[string]map[string]*HostBalanceStats) {
+	r := make(map[string]map[string]*HostBalanceStats, len(sch.bucketsCon))
+	strategy := BalanceArc
+	for _, bucket := range sch.bucketsCon {
+		var bkt string
+		if sch.bucketWidth > 4 {
+			bkt = fmt.Sprintf("%02x", bucket.ID)
+		} else {
+			bkt = fmt.Sprintf("%x", bucket.ID)
+		}
+		r[bkt] = bucket.balanceStats()
+		strategy = bucket.balancer.Name()
+	}
+	return strategy, r
+}
+
+// HostBucketInfo is the status of a host in bucket
+type HostBucketInfo struct {
+	Score float64 `json:"score"`
+	Arc   int     `json:"arc"`
+	// stats of response_time_seconds, which the score is from
+	Stats *LatencyStats `json:"stats"`
+	// latencies and errors of each second in response_time_seconds
+	Seconds []Response `json:"seconds"`
+}
+
+// return addr:info
+func (sch *ManualScheduler) GetBucketInfo(bucketID int64) map[string]*HostBucketInfo {
 	bkt := sch.bucketsCon[bucketID]
-	r := make(map[string]map[string]map[string][]Response, len(bkt.hostsList))
+	r := make(map[string]*HostBucketInfo, len(bkt.hostsList))
 	for i, hostInBucket := range bkt.hostsList {
-		r[hostInBucket.host.Addr] = make(map[string]map[string][]Response)
-		score := fmt.Sprintf("%f", hostInBucket.score)
-		offset := fmt.Sprintf("%d", bkt.partition.getArc(i))
-		r[hostInBucket.host.Addr][score] = map[string][]Response{
-			offset: hostInBucket.lantency.Get(proxyConf.ResTimeSeconds, latencyDataType),
+		r[hostInBucket.host.Addr] = &HostBucketInfo{
+			Score:   hostInBucket.score,
+			Arc:     bkt.partition.getArc(i),
+			Stats:   hostInBucket.latency.Stats(proxyConf.ResTimeSeconds),
+			Seconds: hostInBucket.latency.Seconds(proxyConf.ResTimeSeconds),
 		}
 	}
 	return r
@@ -358,4 +458,9 @@ func (sch *ManualScheduler) GetBucketInfo(bucketID int64) map[string]map[string]
 
 func (sch *ManualScheduler) Close() {
 	sch.quit = true
+	for _, p := range sch.probers {
+		if p != nil {
+			p.Stop()
+		}
+	}
 }
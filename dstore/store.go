@@ -20,9 +20,12 @@ var (
 	proxyConf = &config.Proxy
 	// ErrWriteFailed 表示成功写入的节点数小于 StorageClient.W
 	ErrWriteFailed = errors.New("write failed")
+	// ErrIncrPrimaryDown 表示 key 的 primary 节点宕机，incr 无法进行
+	ErrIncrPrimaryDown = errors.New("primary host for incr is down")
 	PrefixStorageSwitcher *cassandra.PrefixSwitcher
 	PrefixTableFinder *cassandra.KeyTableFinder
 	CqlStore *cassandra.CassandraStore
+	PrefixSwitchCoordinator *cassandra.SwitchCoordinator
 )
 
 type Storage struct {
@@ -62,6 +65,41 @@ func (s *Storage) InitStorageEngine(pCfg *config.ProxyConfig) error {
 		}
 		s.dualWErrHandler = dualWErrHandler
 		logger.Infof("dual write log send to: %s", s.dualWErrHandler.EFile)
+		if pCfg.CoordinatedSwitchEnable && pCfg.PrefixRWDispatcherCfg.Enable {
+			c, err := cassandra.NewSwitchCoordinator(
+				fmt.Sprintf("%s:%d", pCfg.Hostname, pCfg.Port),
+				pCfg.Confdir,
+				time.Duration(pCfg.CoordinatedSwitchIntervalSec)*time.Second,
+				&pCfg.CassandraStoreCfg,
+				switcher,
+				cstar,
+			)
+			if err != nil {
+				return err
+			}
+			PrefixSwitchCoordinator = c
+			go c.Run()
+		}
+		startCfgReloaders(pCfg, cstar, switcher)
+		if pCfg.DStoreConfig.Enable && pCfg.VerifyReadSampleRate > 0 {
+			InitGlobalShadowVerifier(
+				pCfg.VerifyReadSampleRate,
+				pCfg.VerifyReadConcurrency,
+				pCfg.VerifyMismatchLogSize,
+			)
+		}
+		if dualWErrCfg.RetryEnable {
+			q, err := InitGlobalDualWRetryQueue(
+				dualWErrCfg.DumpToDir,
+				dualWErrCfg.RetrySegmentSize,
+				time.Duration(dualWErrCfg.RetryMaxBackoffSec)*time.Second,
+			)
+			if err != nil {
+				return err
+			}
+			dualWErrHandler.Retrier = q
+			logger.Infof("dual write retry queue saved to: %s", dualWErrCfg.DumpToDir)
+		}
 	} else {
 		switcher, err := cassandra.NewPrefixSwitcher(proxyConf, nil)
 		if err != nil {
@@ -69,6 +107,18 @@ func (s *Storage) InitStorageEngine(pCfg *config.ProxyConfig) error {
 		}
 		s.PSwitcher = switcher
 	}
+
+	if pCfg.DStoreConfig.Enable && pCfg.HintedHandoffEnable {
+		err := InitGlobalHintStore(
+			pCfg.HintedHandoffDir,
+			pCfg.HintedHandoffMaxHints,
+			time.Duration(pCfg.HintedHandoffTTLSec)*time.Second,
+		)
+		if err != nil {
+			return err
+		}
+		logger.Infof("hinted handoff saved to: %s", pCfg.HintedHandoffDir)
+	}
 	return nil
 }
 
@@ -149,9 +199,26 @@ func (c *StorageClient) Get(key string) (item *mc.Item, err error) {
 	if bReadEnable {
 		totalReqs.WithLabelValues("get", "beansdb").Inc()
 		c.sched = GetScheduler()
+		if v := GetShadowVerifier(); v != nil {
+			defer func() {
+				if err == nil {
+					v.maybeVerify(c.pswitcher, key, item)
+				}
+			}()
+		}
 
 		hosts := c.sched.GetHostsByKey(key)
 		cnt := 0
+		if proxyConf.QuorumReadEnable && c.R > 1 && key[0] != '?' && key[0] != '@' {
+			return c.quorumGet(hosts[:c.N], key)
+		}
+		if proxyConf.HedgedReadEnable && c.N > 1 {
+			item, cnt, err = c.hedgedGet(hosts[:c.N], key)
+			if item == nil && cnt >= c.R {
+				err = nil
+			}
+			return
+		}
 		for _, host := range hosts[:c.N] {
 			start := time.Now()
 			item, err = host.Get(key)
@@ -162,6 +229,7 @@ func (c *StorageClient) Get(key string) (item *mc.Item, err error) {
 						c.sched.FeedbackLatency(host, key, start, time.Now().Sub(start))
 					}
 					c.SuccessedTargets = []string{host.Addr}
+					tryReadRepair(key, host, hosts[:c.N], cnt > 1)
 					return
 				} else {
 					c.SuccessedTargets = append(c.SuccessedTargets, host.Addr)
@@ -228,6 +296,8 @@ func (c *StorageClient) getMulti(keys []string) (rs map[string]*mc.Item, targets
 		start := time.Now()
 		r, er := host.GetMulti(keys)
 		if er == nil {
+			// keys found here were missed by the hosts succeeded before
+			missed := suc > 0
 			suc += 1
 			if r != nil {
 				targets = append(targets, host.Addr)
@@ -235,6 +305,7 @@ func (c *StorageClient) getMulti(keys []string) (rs map[string]*mc.Item, targets
 
 			for k, v := range r {
 				rs[k] = v
+				tryReadRepair(k, host, hosts[:c.N], missed)
 			}
 			if len(rs) == numKeys {
 				break
@@ -316,6 +387,12 @@ func (c *StorageClient) GetMulti(keys []string) (rs map[string]*mc.Item, err err
 			<-reply
 		}
 
+		if v := GetShadowVerifier(); v != nil && err == nil {
+			for _, k := range bkeys {
+				v.maybeVerify(c.pswitcher, k, rs[k])
+			}
+		}
+
 		// keys all find in bdb
 		if len(ckeys) == 0 {
 			return
@@ -350,19 +427,24 @@ func (c *StorageClient) Set(key string, item *mc.Item, noreply bool) (ok bool, e
 		ok = false
 		err = ErrWriteFailed
 		if len(hosts) >= c.N {
-			mainSuc, mainTargets := c.setConcurrently(hosts[:c.N], key, item, noreply)
+			mainSuc, mainTargets, mainFailed := c.setConcurrently(hosts[:c.N], key, item, noreply)
+			backupSuc := 0
 			if mainSuc >= c.W {
 				ok = true
 				err = nil
 				c.SuccessedTargets = mainTargets
 			} else {
-				backupSuc, backupTargets := c.setConcurrently(hosts[c.N:], key, item, noreply)
+				var backupTargets []string
+				backupSuc, backupTargets, _ = c.setConcurrently(hosts[c.N:], key, item, noreply)
 				if mainSuc+backupSuc >= c.W {
 					ok = true
 					err = nil
 					c.SuccessedTargets = append(mainTargets, backupTargets...)
 				}
 			}
+			if mainSuc+backupSuc > 0 {
+				addHints(mainFailed, key, "set")
+			}
 		}
 		cmem.DBRL.SetData.SubSizeAndCount(item.Cap)
 		if err != nil {
@@ -407,7 +489,7 @@ func (c *StorageClient) Set(key string, item *mc.Item, noreply bool) (ok bool, e
 	return ok, err
 }
 
-// cmdReturnType 只在 setConcurrently 函数中使用，
+// cmdReturnType 只在 setConcurrently 和 deleteConcurrently 函数中使用，
 // 用来在 goroutine 之间传递数据
 type cmdReturnType struct {
 	host      *Host
@@ -421,7 +503,7 @@ func (c *StorageClient) setConcurrently(
 	key string,
 	item *mc.Item,
 	noreply bool,
-) (suc int, targets []string) {
+) (suc int, targets []string, failed []*Host) {
 	suc = 0
 	results := make(chan cmdReturnType, len(hosts))
 	for _, host := range hosts {
@@ -438,88 +520,242 @@ func (c *StorageClient) setConcurrently(
 		if res.ok {
 			suc++
 			targets = append(targets, res.host.Addr)
-		} else if !isWaitForRetry(res.err) {
-			c.sched.FeedbackError(res.host, key, res.startTime, FeedbackNonConnectErrSet)
+		} else {
+			failed = append(failed, res.host)
+			if !isWaitForRetry(res.err) {
+				c.sched.FeedbackError(res.host, key, res.startTime, FeedbackNonConnectErrSet)
+			}
 		}
 	}
 	return
 }
 
-func (c *StorageClient) Append(key string, value []byte) (ok bool, err error) {
-	if proxyConf.CassandraStoreCfg.Enable {
-		return false, fmt.Errorf("cstar store do not support append")
+// deleteConcurrently delete key on hosts in parallel, acked is the number of
+// hosts answered without error (including not found), deleted is true when key
+// was found and deleted on any host.
+func (c *StorageClient) deleteConcurrently(
+	hosts []*Host,
+	key string,
+) (acked int, deleted bool, targets []string, failed []*Host, lastErr error) {
+	results := make(chan cmdReturnType, len(hosts))
+	for _, host := range hosts {
+		go func(host *Host) {
+			start := time.Now()
+			ok, err := host.Delete(key)
+			results <- cmdReturnType{host: host, ok: ok, err: err, startTime: start}
+		}(host)
 	}
-	// NOTE: gobeansdb now do not support `append`, this is not tested.
-	c.sched = GetScheduler()
-	suc := 0
-	for i, host := range c.sched.GetHostsByKey(key) {
-		start := time.Now()
-		if ok, err = host.Append(key, value); err == nil && ok {
-			suc++
-			c.SuccessedTargets = append(c.SuccessedTargets, host.Addr)
-		} else if !isWaitForRetry(err) {
-			c.sched.FeedbackError(host, key, start, FeedbackNonConnectErrDefault)
+
+	for i := 0; i < len(hosts); i++ {
+		res := <-results
+		if res.err == nil {
+			acked++
+			deleted = deleted || res.ok
+			targets = append(targets, res.host.Addr)
+		} else {
+			lastErr = res.err
+			failed = append(failed, res.host)
+			if !isWaitForRetry(res.err) {
+				c.sched.FeedbackError(res.host, key, res.startTime, FeedbackNonConnectErrDelete)
+			}
 		}
+	}
+	return
+}
+
+func (c *StorageClient) Append(key string, value []byte) (ok bool, err error) {
+	rwStatus := c.pswitcher.GetStatus(key)
+	bWriteEnable, cWriteEnable := rwStatus.IsWriteOnBeansdb(), rwStatus.IsWriteOnCstar()
+
+	if bWriteEnable {
+		totalReqs.WithLabelValues("append", "beansdb").Inc()
+		// NOTE: gobeansdb now do not support `append`, this is not tested.
+		c.sched = GetScheduler()
+		suc := 0
+		for i, host := range c.sched.GetHostsByKey(key) {
+			start := time.Now()
+			if ok, err = host.Append(key, value); err == nil && ok {
+				suc++
+				c.SuccessedTargets = append(c.SuccessedTargets, host.Addr)
+			} else if !isWaitForRetry(err) {
+				c.sched.FeedbackError(host, key, start, FeedbackNonConnectErrDefault)
+			}
 
-		if suc >= c.W && (i+1) >= c.N {
-			// at least try N backends, and succeed W backends
-			break
+			if suc >= c.W && (i+1) >= c.N {
+				// at least try N backends, and succeed W backends
+				break
+			}
+		}
+		if suc < c.W {
+			ok = false
+			err = ErrWriteFailed
+			errorReqs.WithLabelValues("append", "beansdb").Inc()
+		} else {
+			ok = true
+			err = nil
 		}
 	}
-	if suc < c.W {
-		ok = false
-		err = ErrWriteFailed
-	} else {
-		ok = true
-		err = nil
+
+	if cWriteEnable {
+		if bWriteEnable && err != nil {
+			return ok, err
+		}
+
+		totalReqs.WithLabelValues("append", "cstar").Inc()
+		if !bWriteEnable && !cassandra.IsValidKeyString(key) {
+			return false, fmt.Errorf("Key format invalid")
+		}
+
+		cok, cerr := c.cstar.Append(key, value)
+		if cerr != nil {
+			errorReqs.WithLabelValues("append", "cstar").Inc()
+			logger.Errorf("append on c* failed: %s, key: %s", cerr, key)
+			if bWriteEnable {
+				errorReqs.WithLabelValues("append", "bcdual").Inc()
+				c.dualWErrHandler.HandleErr(key, "append", cerr)
+
+				if rwStatus.IsReadOnBeansdb() {
+					return ok, err
+				}
+			}
+		}
+		c.SuccessedTargets = append(c.SuccessedTargets, c.cstarClusterName)
+		return cok, cerr
 	}
-	return
+
+	return ok, err
 }
 
-// NOTE: Incr command may has consistency problem
-// link: http://github.com/douban/gobeansproxy/issues/7
+// Incr is routed by prefix like Set. When dual write, the value got from
+// beansdb is set to c* instead of incr on both, so they never drift.
 func (c *StorageClient) Incr(key string, value int) (result int, err error) {
-	if proxyConf.CassandraStoreCfg.Enable {
-		return 0, fmt.Errorf("cstar store do not support incr")
+	defer cmem.DBRL.SetData.SubCount(1)
+	rwStatus := c.pswitcher.GetStatus(key)
+	bWriteEnable, cWriteEnable := rwStatus.IsWriteOnBeansdb(), rwStatus.IsWriteOnCstar()
+
+	var item *mc.Item
+	if bWriteEnable {
+		totalReqs.WithLabelValues("incr", "beansdb").Inc()
+		result, item, err = c.incrOnBeansdb(key, value)
+		if item != nil {
+			defer freeGotItem(item)
+		}
+		if err != nil {
+			errorReqs.WithLabelValues("incr", "beansdb").Inc()
+		}
 	}
-	c.sched = GetScheduler()
-	suc := 0
-	for i, host := range c.sched.GetHostsByKey(key) {
-		r, e := host.Incr(key, value)
-		if e != nil {
-			err = e
-			continue
-		}
-		// gobeansdb 的 incr 命令的返回值只有一个 int，当其为 0 时表示失败.
-		// 但是如果一个 key 的初始值为 0，proxy 就无法区分是否失败了。这里先不管
-		// key 初始值为 0 的情况了。
-		if r > 0 {
-			suc++
-			c.SuccessedTargets = append(c.SuccessedTargets, host.Addr)
+
+	if cWriteEnable {
+		if bWriteEnable && err != nil {
+			return
 		}
-		if r > result {
-			result = r
+
+		totalReqs.WithLabelValues("incr", "cstar").Inc()
+		if !bWriteEnable && !cassandra.IsValidKeyString(key) {
+			return 0, fmt.Errorf("Key format invalid")
 		}
-		if suc >= c.W && (i+1) >= c.N {
-			// at least try N backends, and succeed W backends
-			break
+
+		var cresult int
+		var cerr error
+		if bWriteEnable {
+			cresult = result
+			if item == nil {
+				cerr = fmt.Errorf("value of %s after incr is not got from beansdb", key)
+			} else {
+				citem := newItem(item.Flag, item.Body)
+				citem.ReceiveTime = time.Now()
+				_, cerr = c.cstar.Set(key, citem)
+				citem.Free()
+			}
+		} else {
+			cresult, cerr = c.cstar.Incr(key, value)
 		}
+		if cerr != nil {
+			errorReqs.WithLabelValues("incr", "cstar").Inc()
+			logger.Errorf("incr on c* failed: %s, key: %s", cerr, key)
+			if bWriteEnable {
+				errorReqs.WithLabelValues("incr", "bcdual").Inc()
+				c.dualWErrHandler.HandleErr(key, "incr", cerr)
+
+				if rwStatus.IsReadOnBeansdb() {
+					return
+				}
+			}
+		}
+		c.SuccessedTargets = append(c.SuccessedTargets, c.cstarClusterName)
+		return cresult, cerr
 	}
-	// 只要有一个返回成功就返回成功，因为 incr 操作不是可重入的，
-	// 总之最好不要用 incr 操作。
-	if result > 0 {
-		err = nil
-	}
-	cmem.DBRL.SetData.SubCount(1)
+
 	return
 }
 
-// TODO: 弄清楚为什么 delete 不遵循 NWR 规则
+// incrOnBeansdb incr only on the primary host of key, then the value on primary
+// is set to the other main hosts with the version of primary, so replicas
+// never drift (ref: http://github.com/douban/gobeansproxy/issues/7).
+// item is the value got from primary after incr, nil if failed to get it.
+func (c *StorageClient) incrOnBeansdb(key string, value int) (result int, item *mc.Item, err error) {
+	c.sched = GetScheduler()
+	primary, alive := c.sched.GetPrimaryHost(key)
+	if primary == nil {
+		return 0, nil, fmt.Errorf("no primary host for incr %s", key)
+	}
+	if !alive {
+		return 0, nil, fmt.Errorf("%w: %s of key %s", ErrIncrPrimaryDown, primary.Addr, key)
+	}
+
+	start := time.Now()
+	result, err = primary.Incr(key, value)
+	if err != nil {
+		if !isWaitForRetry(err) {
+			c.sched.FeedbackError(primary, key, start, FeedbackNonConnectErrDefault)
+		}
+		return 0, nil, fmt.Errorf("incr %s on primary %s err: %s", key, primary.Addr, err)
+	}
+
+	// get the value back from primary, to propagate it with the version,
+	// and to tell a counter of 0 from a failure of gobeansdb, which also returns 0
+	meta, err := primary.GetMeta(key)
+	if err == nil && meta != nil && meta.Ver >= 0 {
+		item, err = getItemWithVersion(key, primary, meta)
+	}
+	replicas := []*Host{}
+	for _, host := range c.sched.GetHostsByKey(key)[:c.N] {
+		if host != nil && host != primary {
+			replicas = append(replicas, host)
+		}
+	}
+	if item == nil {
+		if result == 0 {
+			return 0, nil, fmt.Errorf("incr %s on primary %s failed", key, primary.Addr)
+		}
+		// replicas will copy the newest version from primary when hints are replayed
+		logger.Warnf("get %s from primary %s after incr err: %v", key, primary.Addr, err)
+		addHints(replicas, key, "set")
+		c.SuccessedTargets = []string{primary.Addr}
+		return result, nil, nil
+	}
+	if result == 0 && string(item.Body) != "0" {
+		freeGotItem(item)
+		return 0, nil, fmt.Errorf("incr %s on primary %s failed", key, primary.Addr)
+	}
+
+	_, targets, failed := c.setConcurrently(replicas, key, item, false)
+	if len(failed) > 0 {
+		logger.Warnf("propagate incr of %s from %s failed on %d hosts", key, primary.Addr, len(failed))
+		addHints(failed, key, "set")
+	}
+	c.SuccessedTargets = append([]string{primary.Addr}, targets...)
+	return result, item, nil
+}
+
+// Delete follow the NWR rule like Set: delete on N main hosts concurrently,
+// and on backup hosts when less than W main hosts succeed.
 func (c *StorageClient) Delete(key string) (flag bool, err error) {
 	timer := prometheus.NewTimer(
 		cmdE2EDurationSeconds.WithLabelValues("del"),
 	)
 	defer timer.ObserveDuration()
+	receiveTime := time.Now()
 
 	rwStatus := c.pswitcher.GetStatus(key)
 	bWriteEnable, cWriteEnable := rwStatus.IsWriteOnBeansdb(), rwStatus.IsWriteOnCstar()
@@ -527,41 +763,45 @@ func (c *StorageClient) Delete(key string) (flag bool, err error) {
 	if bWriteEnable {
 		totalReqs.WithLabelValues("del", "beansdb").Inc()
 		c.sched = GetScheduler()
-		suc := 0
-		errCnt := 0
-		lastErrStr := ""
-		failedHosts := make([]string, 0, 2)
-		for i, host := range c.sched.GetHostsByKey(key) {
-			start := time.Now()
-			ok, err := host.Delete(key)
-			if ok {
-				suc++
-				c.SuccessedTargets = append(c.SuccessedTargets, host.Addr)
-			} else if err != nil {
-				errCnt++
-				lastErrStr = err.Error()
-				failedHosts = append(failedHosts, host.Addr)
-				if i >= c.N {
-					continue
+		hosts := c.sched.GetHostsByKey(key)
+		flag = false
+		err = ErrWriteFailed
+		if len(hosts) >= c.N {
+			mainAcked, mainDeleted, mainTargets, mainFailed, lastErr := c.deleteConcurrently(hosts[:c.N], key)
+			failedHosts := mainFailed
+			backupAcked := 0
+			if mainAcked >= c.W {
+				flag = mainDeleted
+				err = nil
+				c.SuccessedTargets = mainTargets
+			} else {
+				var backupDeleted bool
+				var backupTargets []string
+				var backupFailed []*Host
+				var backupErr error
+				backupAcked, backupDeleted, backupTargets, backupFailed, backupErr = c.deleteConcurrently(hosts[c.N:], key)
+				if backupErr != nil {
+					lastErr = backupErr
 				}
-				if !isWaitForRetry(err) {
-					c.sched.FeedbackError(host, key, start, FeedbackNonConnectErrDelete)
+				failedHosts = append(failedHosts, backupFailed...)
+				if mainAcked+backupAcked >= c.W {
+					flag = mainDeleted || backupDeleted
+					err = nil
+					c.SuccessedTargets = append(mainTargets, backupTargets...)
 				}
 			}
-
-			// TODO: 弄清楚这里为什么不是 suc > c.W
-			if suc >= c.N {
-				break
+			if len(failedHosts) > 0 {
+				addrs := make([]string, len(failedHosts))
+				for i, host := range failedHosts {
+					addrs[i] = host.Addr
+				}
+				logger.Warnf("key: %s was delete failed in %v, and the last error is %s",
+					key, addrs, lastErr)
+			}
+			if mainAcked+backupAcked > 0 {
+				addHints(mainFailed, key, "del")
 			}
 		}
-		if errCnt > 0 {
-			logger.Warnf("key: %s was delete failed in %v, and the last error is %s",
-				key, failedHosts, lastErrStr)
-		}
-		if errCnt < 2 {
-			err = nil
-		}
-		flag = suc > 0
 		if err != nil {
 			errorReqs.WithLabelValues("del", "beansdb").Inc()
 		}
@@ -578,7 +818,7 @@ func (c *StorageClient) Delete(key string) (flag bool, err error) {
 		if !cassandra.IsValidKeyString(key) {
 			return false, fmt.Errorf("invalide key format")
 		}
-		cflag, cerr := c.cstar.Delete(key)
+		cflag, cerr := c.cstar.DeleteAt(key, receiveTime)
 		if cerr != nil {
 			errorReqs.WithLabelValues("del", "cstar").Inc()
 			logger.Errorf("del on c* failed: %s, key: %s", cerr, key)
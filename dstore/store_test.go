@@ -1,6 +1,7 @@
 package dstore
 
 import (
+	"bufio"
 	"errors"
 	"flag"
 	"fmt"
@@ -11,9 +12,11 @@ import (
 	"os/user"
 	"path"
 	"path/filepath"
+	"strings"
 	"testing"
 	"time"
 
+	routecfg "github.com/douban/gobeansdb/config"
 	dbcfg "github.com/douban/gobeansdb/gobeansdb"
 	mc "github.com/douban/gobeansdb/memcache"
 	yaml "gopkg.in/yaml.v2"
@@ -120,6 +123,8 @@ func setupSuite(tb testing.TB) func(tb  testing.TB) {
 			if err := execCmd.Process.Kill(); err != nil {
 				tb.Fatalf("failed to kill process %s: %s", execCmd, err)
 			}
+			// make sure port is released before next suite starts
+			execCmd.Wait()
 		}
 	}
 }
@@ -229,10 +234,7 @@ func testStoreClient(t *testing.T, c mc.StorageClient) {
 	assert.Nil(v6)
 }
 
-func TestDStoreOnly(t *testing.T) {
-	teardown := setupSuite(t)
-	defer teardown(t)
-
+func newDStoreOnlyClient() *StorageClient {
 	homeDir := utils.GetProjectHomeDir()
 	confdir := path.Join(homeDir, ".doubanpde", "scripts", "bdb", "gobeansproxy", "dstore-only", "conf")
 	proxyConf := &config.Proxy
@@ -241,7 +243,316 @@ func TestDStoreOnly(t *testing.T) {
 	InitGlobalManualScheduler(config.Route, proxyConf.N, BucketsManualSchduler)
 	storage := new(Storage)
 	storage.InitStorageEngine(proxyConf)
-	c := NewStorageClient(proxyConf.N, proxyConf.W, proxyConf.R, storage.cstar, storage.PSwitcher, storage.dualWErrHandler)
+	return NewStorageClient(proxyConf.N, proxyConf.W, proxyConf.R, storage.cstar, storage.PSwitcher, storage.dualWErrHandler)
+}
+
+func TestDStoreOnly(t *testing.T) {
+	teardown := setupSuite(t)
+	defer teardown(t)
 
+	c := newDStoreOnlyClient()
 	testStoreClient(t, c)
 }
+
+func TestReadRepair(t *testing.T) {
+	teardown := setupSuite(t)
+	defer teardown(t)
+	testReadRepair(t)
+}
+
+// read repair should work when get is hedged
+func TestHedgedReadRepair(t *testing.T) {
+	teardown := setupSuite(t)
+	defer teardown(t)
+	proxyConf.HedgedReadEnable = true
+	defer func() { proxyConf.HedgedReadEnable = false }()
+	testReadRepair(t)
+}
+
+func testReadRepair(t *testing.T) {
+	assert := assert.New(t)
+
+	c := newDStoreOnlyClient()
+	proxyConf.ReadRepairEnable = true
+	defer func() { proxyConf.ReadRepairEnable = false }()
+
+	key := fmt.Sprintf("/test/read_repair/%d", time.Now().UnixNano())
+	hosts := GetScheduler().GetHostsByKey(key)[:c.N]
+
+	// only the last replica has the key
+	item := newItem(0, []byte("repair me"))
+	ok, err := hosts[c.N-1].Set(key, item, false)
+	item.Free()
+	assert.True(ok)
+	assert.Nil(err)
+
+	v, err := c.Get(key)
+	c.Clean()
+	assert.Nil(err)
+	assert.Equal([]byte("repair me"), v.Body)
+	v.Free()
+
+	srcMeta, _ := hosts[c.N-1].GetMeta(key)
+	assert.NotNil(srcMeta)
+	for _, host := range hosts {
+		var meta *ItemMeta
+		for i := 0; i < 20 && meta == nil; i++ {
+			time.Sleep(100 * time.Millisecond)
+			meta, _ = host.GetMeta(key)
+		}
+		if assert.NotNil(meta, "key should be repaired on %s", host.Addr) {
+			assert.Equal(srcMeta.Ver, meta.Ver)
+		}
+	}
+}
+
+// useRoute replace the global scheduler with a route of main and backup hosts,
+// which serve all the 16 buckets
+func useRoute(tb testing.TB, main []string, backup []string) {
+	rt := "numbucket: 16\nbackup:\n"
+	for _, addr := range backup {
+		rt += fmt.Sprintf("- %s\n", addr)
+	}
+	rt += "main:\n"
+	for _, addr := range main {
+		rt += fmt.Sprintf("- addr: %s\n  buckets: [0, 1, 2, 3, 4, 5, 6, 7, 8, 9, a, b, c, d, e, f]\n", addr)
+	}
+	route := new(routecfg.RouteTable)
+	if err := route.LoadFromYaml([]byte(rt)); err != nil {
+		tb.Fatal(err)
+	}
+	InitGlobalManualScheduler(route, proxyConf.N, BucketsManualSchduler)
+}
+
+func TestDeleteQuorum(t *testing.T) {
+	teardown := setupSuite(t)
+	defer teardown(t)
+	assert := assert.New(t)
+
+	c := newDStoreOnlyClient()
+	defer InitGlobalManualScheduler(config.Route, proxyConf.N, BucketsManualSchduler)
+	hints, err := NewHintStore(t.TempDir(), 0, time.Hour)
+	assert.Nil(err)
+	globalHintStore = hints
+	defer func() { globalHintStore = nil }()
+
+	key := fmt.Sprintf("/test/delete/quorum/%d", time.Now().UnixNano())
+	ok, err := clientSet(c, key, []byte("delete me"), 0)
+	c.Clean()
+	assert.True(ok)
+	assert.Nil(err)
+
+	// all main hosts alive
+	ok, err = c.Delete(key)
+	assert.True(ok)
+	assert.Nil(err)
+	assert.Equal(c.N, len(c.SuccessedTargets))
+	c.Clean()
+
+	// not found is not a failure
+	ok, err = c.Delete(key)
+	assert.False(ok)
+	assert.Nil(err)
+	c.Clean()
+
+	// only one main host alive, fall back to backup to reach W
+	useRoute(t, []string{"127.0.0.1:57980", "127.0.0.1:57960", "127.0.0.1:57961"}, []string{"127.0.0.1:57983"})
+	ok, err = clientSet(c, key, []byte("delete me"), 0)
+	c.Clean()
+	assert.True(ok)
+	assert.Nil(err)
+	// failed set is hinted as well
+	_, err = hints.Purge("")
+	assert.Nil(err)
+	ok, err = c.Delete(key)
+	assert.True(ok)
+	assert.Nil(err)
+	assert.ElementsMatch([]string{"127.0.0.1:57980", "127.0.0.1:57983"}, c.SuccessedTargets)
+	c.Clean()
+	assert.Equal(
+		map[string][]string{
+			"127.0.0.1:57960": {"del " + key},
+			"127.0.0.1:57961": {"del " + key},
+		},
+		hintKeys(hints.List("")),
+	)
+
+	// quorum can not be reached
+	useRoute(t, []string{"127.0.0.1:57980", "127.0.0.1:57960", "127.0.0.1:57961"}, []string{"127.0.0.1:57962"})
+	ok, err = c.Delete(key)
+	assert.False(ok)
+	assert.Equal(ErrWriteFailed, err)
+	c.Clean()
+}
+
+func TestIncrPrimary(t *testing.T) {
+	teardown := setupSuite(t)
+	defer teardown(t)
+	assert := assert.New(t)
+
+	c := newDStoreOnlyClient()
+	defer InitGlobalManualScheduler(config.Route, proxyConf.N, BucketsManualSchduler)
+
+	key := fmt.Sprintf("/test/incr/%d", time.Now().UnixNano())
+	primary, alive := GetScheduler().GetPrimaryHost(key)
+	assert.True(alive)
+	for i := 1; i <= 3; i++ {
+		r, err := c.Incr(key, 2)
+		assert.Nil(err)
+		assert.Equal(2*i, r)
+		assert.Equal(primary.Addr, c.SuccessedTargets[0])
+		assert.Equal(c.N, len(c.SuccessedTargets))
+		c.Clean()
+	}
+
+	// a counter of 0 is not a failure
+	r, err := c.Incr(key, -6)
+	assert.Nil(err)
+	assert.Equal(0, r)
+	c.Clean()
+
+	// all replicas hold the same value and version
+	primaryMeta, _ := primary.GetMeta(key)
+	for _, host := range GetScheduler().GetHostsByKey(key)[:c.N] {
+		item, err := host.Get(key)
+		assert.Nil(err)
+		if assert.NotNil(item) {
+			assert.Equal("0", string(item.Body))
+			freeGotItem(item)
+		}
+		meta, _ := host.GetMeta(key)
+		if assert.NotNil(meta) {
+			assert.Equal(primaryMeta.Ver, meta.Ver)
+		}
+	}
+
+	// primary is down
+	sch := GetScheduler().(*ManualScheduler)
+	bucket := sch.bucketsCon[getBucketByKey(sch.hashMethod, sch.bucketWidth, key)]
+	_, hostBucket := bucket.getHostByAddr(primary.Addr)
+	hostBucket.status = false
+	_, err = c.Incr(key, 1)
+	assert.ErrorIs(err, ErrIncrPrimaryDown)
+	c.Clean()
+	hostBucket.status = true
+
+	// primary is not reachable
+	useRoute(t, []string{"127.0.0.1:57960", "127.0.0.1:57961", "127.0.0.1:57962"}, []string{"127.0.0.1:57983"})
+	_, err = c.Incr(key, 1)
+	assert.NotNil(err)
+}
+
+// startFakeIncrBeansdb start a server which answer every incr with result,
+// and fail all other cmds except the health check `get @`
+func startFakeIncrBeansdb(tb testing.TB, result int) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatalf("listen err: %s", err)
+	}
+	tb.Cleanup(func() { ln.Close() })
+
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func(conn net.Conn) {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				for {
+					line, err := reader.ReadString('\n')
+					if err != nil {
+						return
+					}
+					if strings.HasPrefix(line, "incr ") {
+						fmt.Fprintf(conn, "%d\r\n", result)
+					} else if line == "get @\r\n" {
+						conn.Write([]byte("VALUE @ 0 1\r\n1\r\nEND\r\n"))
+					} else {
+						conn.Write([]byte("SERVER_ERROR busy\r\n"))
+					}
+				}
+			}(conn)
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// replicas are hinted when the value can not be got back from primary after incr
+func TestIncrPrimaryGetFailed(t *testing.T) {
+	homeDir := utils.GetProjectHomeDir()
+	confdir := path.Join(homeDir, "conf")
+	proxyConf := &config.Proxy
+	proxyConf.Load(confdir)
+	assert := assert.New(t)
+
+	c := newDStoreOnlyClient()
+	defer InitGlobalManualScheduler(config.Route, proxyConf.N, BucketsManualSchduler)
+	hints, err := NewHintStore(t.TempDir(), 0, time.Hour)
+	assert.Nil(err)
+	globalHintStore = hints
+	defer func() { globalHintStore = nil }()
+
+	main := []string{}
+	for i := 0; i < c.N; i++ {
+		main = append(main, startFakeIncrBeansdb(t, 3))
+	}
+	useRoute(t, main, []string{"127.0.0.1:57962"})
+
+	key := fmt.Sprintf("/test/incr/getfailed/%d", time.Now().UnixNano())
+	primary, _ := GetScheduler().GetPrimaryHost(key)
+	r, err := c.Incr(key, 3)
+	assert.Nil(err)
+	assert.Equal(3, r)
+	assert.Equal([]string{primary.Addr}, c.SuccessedTargets)
+	c.Clean()
+
+	expected := map[string][]string{}
+	for _, addr := range main {
+		if addr != primary.Addr {
+			expected[addr] = []string{"set " + key}
+		}
+	}
+	assert.Equal(expected, hintKeys(hints.List("")))
+}
+
+func TestExplainKey(t *testing.T) {
+	teardown := setupSuite(t)
+	defer teardown(t)
+	assert := assert.New(t)
+
+	c := newDStoreOnlyClient()
+	key := fmt.Sprintf("/test/explain/%d", time.Now().UnixNano())
+
+	e := ExplainKey(key, false)
+	sch := GetScheduler().(*ManualScheduler)
+	assert.Equal(getBucketByKey(sch.hashMethod, sch.bucketWidth, key), e.Bucket)
+	assert.True(e.ReadOnBeansdb)
+	owner, _ := GetScheduler().GetPrimaryHost(key)
+	assert.Equal(owner.Addr, e.Owner)
+	hosts := GetScheduler().GetHostsByKey(key)
+	if assert.Equal(len(hosts), len(e.Hosts)) {
+		owners := 0
+		for i, h := range e.Hosts {
+			assert.Equal(hosts[i].Addr, h.Addr)
+			assert.Nil(h.Meta)
+			if h.Owner {
+				owners++
+			}
+		}
+		assert.Equal(1, owners)
+		assert.Equal("main", e.Hosts[0].Role)
+	}
+
+	ok, err := clientSet(c, key, []byte("explain me"), 0)
+	c.Clean()
+	assert.True(ok)
+	assert.Nil(err)
+	e = ExplainKey(key, true)
+	for _, h := range e.Hosts[:c.N] {
+		if assert.NotNil(h.Meta, "meta of %s", h.Addr) {
+			assert.Equal(1, h.Meta.Ver)
+		}
+	}
+}
@@ -0,0 +1,211 @@
+package dstore
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	mc "github.com/douban/gobeansdb/memcache"
+	"github.com/douban/gobeansproxy/cassandra"
+)
+
+const (
+	DEFAULT_VERIFY_READ_CONCURRENCY = 4
+	DEFAULT_VERIFY_MISMATCH_LOG_SIZE = 1000
+	// prefix label of keys not matching any prefix
+	VERIFY_DEFAULT_PREFIX = "default"
+)
+
+var globalShadowVerifier *ShadowVerifier
+
+// verifyJob is a get served by beansdb to be compared with c*,
+// the item is copied since it is freed after the response is sent
+type verifyJob struct {
+	key    string
+	prefix string
+	item   *mc.Item
+}
+
+type VerifyMismatch struct {
+	Key    string    `json:"key"`
+	Prefix string    `json:"prefix"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+}
+
+type VerifyPrefixStats struct {
+	Match    int64 `json:"match"`
+	Mismatch int64 `json:"mismatch"`
+	Error    int64 `json:"error"`
+	Dropped  int64 `json:"dropped"`
+}
+
+// ShadowVerifier compare sampled beansdb reads of prefixes in verify status
+// with c* in background, the latest mismatches are kept in a ring.
+type ShadowVerifier struct {
+	sampleRate float64
+	jobs       chan *verifyJob
+	// get key from c*
+	get func(key string) (*mc.Item, error)
+
+	sync.Mutex
+	stats      map[string]*VerifyPrefixStats
+	mismatches []*VerifyMismatch
+	next       int
+	logSize    int
+}
+
+func GetShadowVerifier() *ShadowVerifier {
+	return globalShadowVerifier
+}
+
+func InitGlobalShadowVerifier(sampleRate float64, concurrency, logSize int) {
+	globalShadowVerifier = NewShadowVerifier(sampleRate, concurrency, logSize)
+}
+
+func NewShadowVerifier(sampleRate float64, concurrency, logSize int) *ShadowVerifier {
+	if concurrency <= 0 {
+		concurrency = DEFAULT_VERIFY_READ_CONCURRENCY
+	}
+	if logSize <= 0 {
+		logSize = DEFAULT_VERIFY_MISMATCH_LOG_SIZE
+	}
+	v := &ShadowVerifier{
+		sampleRate: sampleRate,
+		jobs:       make(chan *verifyJob, concurrency*64),
+		stats:      make(map[string]*VerifyPrefixStats),
+		logSize:    logSize,
+	}
+	v.get = func(key string) (*mc.Item, error) {
+		return CqlStore.Get(key)
+	}
+	for i := 0; i < concurrency; i++ {
+		go v.worker()
+	}
+	return v
+}
+
+// maybeVerify compare item got from beansdb with c* by chance
+// if key is in verify status
+func (v *ShadowVerifier) maybeVerify(switcher *cassandra.PrefixSwitcher, key string, item *mc.Item) {
+	if len(key) == 0 || key[0] == '?' || key[0] == '@' || rand.Float64() >= v.sampleRate {
+		return
+	}
+	status, prefix := switcher.GetStatusAndPrefix(key)
+	if !status.IsVerify() {
+		return
+	}
+	if prefix == "" {
+		prefix = VERIFY_DEFAULT_PREFIX
+	}
+
+	job := &verifyJob{key: key, prefix: prefix}
+	if item != nil {
+		job.item = &mc.Item{Flag: item.Flag}
+		job.item.Body = append([]byte{}, item.Body...)
+	}
+	select {
+	case v.jobs <- job:
+	default:
+		v.record(prefix, "dropped", nil)
+	}
+}
+
+func (v *ShadowVerifier) worker() {
+	for job := range v.jobs {
+		v.verify(job)
+	}
+}
+
+func (v *ShadowVerifier) verify(job *verifyJob) {
+	citem, err := v.get(job.key)
+	if err != nil {
+		logger.Warnf("verify read %s on c* err: %s", job.key, err)
+		v.record(job.prefix, "error", nil)
+		return
+	}
+	if citem != nil {
+		defer citem.Free()
+	}
+	reason := diffItems(job.item, citem)
+	if reason == "" {
+		v.record(job.prefix, "match", nil)
+		return
+	}
+	v.record(job.prefix, "mismatch", &VerifyMismatch{
+		Key:    job.key,
+		Prefix: job.prefix,
+		Reason: reason,
+		Time:   time.Now(),
+	})
+}
+
+func (v *ShadowVerifier) record(prefix, result string, m *VerifyMismatch) {
+	verifyReads.WithLabelValues(prefix, result).Inc()
+
+	v.Lock()
+	defer v.Unlock()
+	stats, ok := v.stats[prefix]
+	if !ok {
+		stats = new(VerifyPrefixStats)
+		v.stats[prefix] = stats
+	}
+	switch result {
+	case "match":
+		stats.Match++
+	case "mismatch":
+		stats.Mismatch++
+	case "error":
+		stats.Error++
+	case "dropped":
+		stats.Dropped++
+	}
+	if m == nil {
+		return
+	}
+	if len(v.mismatches) < v.logSize {
+		v.mismatches = append(v.mismatches, m)
+	} else {
+		v.mismatches[v.next] = m
+	}
+	v.next = (v.next + 1) % v.logSize
+}
+
+// Stats return counters by prefix
+func (v *ShadowVerifier) Stats() map[string]VerifyPrefixStats {
+	v.Lock()
+	defer v.Unlock()
+	r := make(map[string]VerifyPrefixStats, len(v.stats))
+	for prefix, stats := range v.stats {
+		r[prefix] = *stats
+	}
+	return r
+}
+
+// Mismatches return the latest mismatches of prefix (all if ""), the oldest first
+func (v *ShadowVerifier) Mismatches(prefix string) []*VerifyMismatch {
+	v.Lock()
+	defer v.Unlock()
+	r := []*VerifyMismatch{}
+	n := len(v.mismatches)
+	start := 0
+	if n == v.logSize {
+		start = v.next
+	}
+	for i := 0; i < n; i++ {
+		m := v.mismatches[(start+i)%n]
+		if prefix == "" || m.Prefix == prefix {
+			r = append(r, m)
+		}
+	}
+	return r
+}
+
+// Reset clear counters and mismatches, e.g. after data of a prefix is fixed
+func (v *ShadowVerifier) Reset() {
+	v.Lock()
+	defer v.Unlock()
+	v.stats = make(map[string]*VerifyPrefixStats)
+	v.mismatches = nil
+	v.next = 0
+}
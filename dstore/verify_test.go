@@ -0,0 +1,109 @@
+package dstore
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	dbcfg "github.com/douban/gobeansdb/config"
+	mc "github.com/douban/gobeansdb/memcache"
+	"github.com/douban/gobeansproxy/cassandra"
+	"github.com/douban/gobeansproxy/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestShadowVerifier(t *testing.T) {
+	assert := assert.New(t)
+
+	cfg := &config.ProxyConfig{}
+	cfg.DStoreConfig.Enable = true
+	cfg.CassandraStoreCfg = config.CassandraStoreCfg{
+		Enable: true,
+		PrefixRWDispatcherCfg: config.PrefixDisPatcherCfg{
+			Enable: true,
+			StaticCfg: map[string][]string{
+				"verify": {"/test/verify/"},
+			},
+		},
+		SwitchToKeyDefault: "br1w1cr0w1",
+	}
+	switcher, err := cassandra.NewPrefixSwitcher(cfg, nil)
+	assert.Nil(err)
+
+	// no workers, jobs are checked in channel
+	v := &ShadowVerifier{
+		sampleRate: 1,
+		jobs:       make(chan *verifyJob, 1),
+		stats:      make(map[string]*VerifyPrefixStats),
+		logSize:    3,
+	}
+	item := &mc.Item{Flag: 1}
+	item.Body = []byte("body")
+	v.maybeVerify(switcher, "/test/dual/a", item)
+	v.maybeVerify(switcher, "?/test/verify/a", item)
+	assert.Equal(0, len(v.jobs))
+
+	v.maybeVerify(switcher, "/test/verify/a", item)
+	item.Body[0] = 'x'
+	job := <-v.jobs
+	assert.Equal("/test/verify/", job.prefix)
+	assert.Equal("body", string(job.item.Body))
+
+	v.maybeVerify(switcher, "/test/verify/b", nil)
+	v.maybeVerify(switcher, "/test/verify/c", nil)
+	assert.Nil((<-v.jobs).item)
+	assert.Equal(int64(1), v.Stats()["/test/verify/"].Dropped)
+
+	// bounded mismatch log
+	for i := 0; i < 5; i++ {
+		v.record("/test/verify/", "mismatch", &VerifyMismatch{
+			Key:    fmt.Sprintf("/test/verify/%d", i),
+			Prefix: "/test/verify/",
+		})
+	}
+	v.record("/test/verify/", "match", nil)
+	ms := v.Mismatches("")
+	assert.Equal(3, len(ms))
+	assert.Equal("/test/verify/2", ms[0].Key)
+	assert.Equal("/test/verify/4", ms[2].Key)
+	assert.Equal(0, len(v.Mismatches("/other/")))
+	stats := v.Stats()["/test/verify/"]
+	assert.Equal(int64(5), stats.Mismatch)
+	assert.Equal(int64(1), stats.Match)
+
+	v.Reset()
+	assert.Equal(0, len(v.Mismatches("")))
+	assert.Equal(0, len(v.Stats()))
+}
+
+// items got from c* are freed after compared, large bodies are in C memory
+func TestShadowVerifierFree(t *testing.T) {
+	assert := assert.New(t)
+	size := int(dbcfg.MCConf.BodyInC) + 1
+	body := bytes.Repeat([]byte("v"), size)
+	var citem *mc.Item
+	v := &ShadowVerifier{
+		stats:   make(map[string]*VerifyPrefixStats),
+		logSize: 3,
+		get: func(key string) (*mc.Item, error) {
+			citem = &mc.Item{}
+			if !citem.Alloc(size) {
+				t.Fatalf("alloc %d failed", size)
+			}
+			copy(citem.Body, body)
+			return citem, nil
+		},
+	}
+	job := &verifyJob{key: "/test/verify/large", prefix: "/test/verify/"}
+	job.item = &mc.Item{}
+	job.item.Body = body
+
+	// body larger than BodyInC is in c memory, which is released by Free
+	v.verify(job)
+	assert.Equal(uintptr(0), citem.Addr, "c* item is not freed")
+	assert.Equal(int64(1), v.Stats()["/test/verify/"].Match)
+
+	v.verify(&verifyJob{key: "/test/verify/large", prefix: "/test/verify/"})
+	assert.Equal(uintptr(0), citem.Addr, "c* item is not freed")
+	assert.Equal(int64(1), v.Stats()["/test/verify/"].Mismatch)
+}
@@ -0,0 +1,218 @@
+package gobeansproxy
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+
+	"github.com/douban/gobeansproxy/cassandra"
+	"github.com/douban/gobeansproxy/config"
+	"github.com/douban/gobeansproxy/dstore"
+)
+
+// subcommands of the proxy binary, e.g. `gobeansproxy antientropy -confdir conf/ -bucket a`
+var subcommands = map[string]func(args []string){
+	"antientropy": antiEntropyMain,
+	"reconcile":   reconcileMain,
+	"cfg":         cfgMain,
+}
+
+// loadSubcommandConf load proxy config for subcommands which talk to beansdb directly
+func loadSubcommandConf(confdir string) {
+	proxyConf.InitDefault()
+	if confdir != "" {
+		proxyConf.Load(confdir)
+	}
+}
+
+func antiEntropyMain(args []string) {
+	fs := flag.NewFlagSet("antientropy", flag.ExitOnError)
+	confdir := fs.String("confdir", "", "path of proxy config dir, required for the route")
+	bucket := fs.String("bucket", "", "bucket to check in hex, all buckets if empty")
+	repair := fs.Bool("repair", false, "copy the newest version to the replicas differ")
+	fs.Parse(args)
+	if *confdir == "" {
+		fmt.Fprintln(fs.Output(), "-confdir is required")
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	loadSubcommandConf(*confdir)
+	dstore.InitGlobalManualScheduler(config.Route, proxyConf.N, dstore.BucketsManualSchduler)
+
+	buckets := []int{}
+	if *bucket != "" {
+		id, err := strconv.ParseInt(*bucket, 16, 16)
+		if err != nil {
+			log.Fatalf("bad bucket %s: %s", *bucket, err)
+		}
+		buckets = append(buckets, int(id))
+	} else {
+		for id := 0; id < config.Route.NumBucket; id++ {
+			buckets = append(buckets, id)
+		}
+	}
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	failed := false
+	for _, id := range buckets {
+		report, err := dstore.CheckBucket(id, *repair)
+		if err != nil {
+			log.Fatalf("check bucket %x err: %s", id, err)
+		}
+		if len(report.Errors) > 0 {
+			failed = true
+		}
+		enc.Encode(report)
+	}
+	if failed {
+		os.Exit(1)
+	}
+}
+
+// reconcileMain compare keys in dual write error logs between beansdb and c*,
+// e.g. `gobeansproxy reconcile -confdir conf/ -dry-run [files...]`
+func reconcileMain(args []string) {
+	fs := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	confdir := fs.String("confdir", "", "path of proxy config dir")
+	dir := fs.String("dir", "", "dir of dual write error logs, dump_to_dir in config if empty")
+	dryRun := fs.Bool("dry-run", false, "only report mismatches, do not write to c*")
+	rate := fs.Int("rate", 100, "max keys checked per second, no limit if 0")
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: gobeansproxy reconcile [flags] [log files...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Parse(args)
+
+	loadSubcommandConf(*confdir)
+	if !proxyConf.DStoreConfig.Enable || !proxyConf.CassandraStoreCfg.Enable {
+		log.Fatalf("both beansdb and cassandra must be enabled to reconcile")
+	}
+	dstore.InitGlobalManualScheduler(config.Route, proxyConf.N, dstore.BucketsManualSchduler)
+	cstar, err := cassandra.NewCassandraStore(&proxyConf.CassandraStoreCfg)
+	if err != nil {
+		log.Fatalf("init cassandra err: %s", err)
+	}
+	defer cstar.Close()
+	switcher, err := cassandra.NewPrefixSwitcher(proxyConf, cstar)
+	if err != nil {
+		log.Fatalf("init prefix switcher err: %s", err)
+	}
+	dstore.CqlStore = cstar
+	dstore.PrefixStorageSwitcher = switcher
+
+	files := fs.Args()
+	if len(files) == 0 {
+		ecfg := proxyConf.CassandraStoreCfg.DualWErrCfg
+		if *dir == "" {
+			*dir = ecfg.DumpToDir
+		}
+		files, err = dstore.FindDualWErrLogs(*dir, ecfg.FName)
+		if err != nil {
+			log.Fatalf("find dual write error logs in %s err: %s", *dir, err)
+		}
+	}
+
+	report := new(dstore.ReconcileReport)
+	entries, err := dstore.ReadDualWErrLogs(files, report)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	dstore.Reconcile(entries, *dryRun, *rate, report)
+
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(report)
+	if report.Errors > 0 {
+		os.Exit(1)
+	}
+}
+
+// cfgMain export or import prefix dispatcher cfg in c* directly, e.g.
+// `gobeansproxy cfg export -confdir conf/ > cfg.yaml`,
+// `gobeansproxy cfg import -confdir conf/ -dry-run cfg.yaml`
+func cfgMain(args []string) {
+	usage := "usage: gobeansproxy cfg export|import [flags] [file]"
+	if len(args) == 0 || (args[0] != "export" && args[0] != "import") {
+		log.Fatal(usage)
+	}
+	action := args[0]
+	fs := flag.NewFlagSet("cfg "+action, flag.ExitOnError)
+	confdir := fs.String("confdir", "", "path of proxy config dir")
+	format := fs.String("format", "yaml", "export format, yaml or json")
+	dryRun := fs.Bool("dry-run", false, "only show the changes of import")
+	force := fs.Bool("force", false, "skip the transition check of rwswitcher")
+	operator := fs.String("operator", os.Getenv("USER"), "who imports the cfg")
+	fs.Usage = func() {
+		fmt.Fprintln(fs.Output(), usage)
+		fs.PrintDefaults()
+	}
+	fs.Parse(args[1:])
+
+	loadSubcommandConf(*confdir)
+	if !proxyConf.CassandraStoreCfg.Enable {
+		log.Fatalf("cassandra must be enabled")
+	}
+	cstar, err := cassandra.NewCassandraStore(&proxyConf.CassandraStoreCfg)
+	if err != nil {
+		log.Fatalf("init cassandra err: %s", err)
+	}
+	defer cstar.Close()
+	switcher, err := cassandra.NewPrefixSwitcher(proxyConf, cstar)
+	if err != nil {
+		log.Fatalf("init prefix switcher err: %s", err)
+	}
+	ccfg := &proxyConf.CassandraStoreCfg
+	var finder *cassandra.KeyTableFinder
+	if ccfg.PrefixTableDispatcherCfg.Enable {
+		finder = cstar.GetPrefixTableFinder()
+	}
+
+	if action == "export" {
+		b, err := cassandra.ExportCfg(ccfg, switcher, finder).Marshal(*format)
+		if err != nil {
+			log.Fatalf("%s", err)
+		}
+		os.Stdout.Write(b)
+		return
+	}
+
+	var b []byte
+	if file := fs.Arg(0); file == "" || file == "-" {
+		b, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		b, err = ioutil.ReadFile(file)
+	}
+	if err != nil {
+		log.Fatalf("read cfg err: %s", err)
+	}
+	data, err := cassandra.ParseDispatcherCfgs(b)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	plan, err := cassandra.PlanImport(
+		ccfg, switcher, finder, data,
+		cassandra.SwitchOperator{Who: *operator, Force: *force, Client: "cli"},
+	)
+	if err != nil {
+		log.Fatalf("%s", err)
+	}
+	enc := json.NewEncoder(os.Stdout)
+	enc.SetIndent("", "  ")
+	enc.Encode(plan)
+	if *dryRun || plan.Empty() {
+		return
+	}
+	if len(plan.RWSwitcher) > 0 && ccfg.CoordinatedSwitchEnable && ccfg.PrefixRWDispatcherCfg.Enable {
+		log.Fatalf("coordinated switch is enabled, switch prefixes of rwswitcher by PUT /cstar-cfg only")
+	}
+	if err := cassandra.ApplyImport(plan, cstar); err != nil {
+		log.Fatalf("%s", err)
+	}
+	log.Printf("cfg imported, proxies load it by cfg reloader or POST /cstar-cfg")
+}
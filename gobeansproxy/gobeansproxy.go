@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"runtime"
 
 	dbcfg "github.com/douban/gobeansdb/config"
@@ -22,6 +23,13 @@ var (
 )
 
 func Main() {
+	if len(os.Args) > 1 {
+		if cmd, ok := subcommands[os.Args[1]]; ok {
+			cmd(os.Args[2:])
+			return
+		}
+	}
+
 	var version = flag.Bool("version", false, "print vresion of beansproxy")
 	var confdir = flag.String("confdir", "", "path of proxy config dir")
 	var dumpconf = flag.Bool("dumpconf", false, "print configuration")
@@ -2,6 +2,7 @@ package gobeansproxy
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"net/http"
@@ -92,6 +93,12 @@ func (t *templateHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 
+	if t.filename == "templates/health.html" {
+		data = map[string]interface{}{
+			"health": dstore.GetScheduler().HealthStats(),
+		}
+	}
+
 	if t.filename == "templates/buckets.html" {
 		data = map[string]interface{}{
 			"buckets": dstore.GetScheduler().Partition(),
@@ -111,10 +118,17 @@ func startWeb() {
 	http.Handle("/score/", &templateHandler{filename: "templates/score.html"})
 	http.Handle("/bucketinfo/", &templateHandler{filename: "templates/bucketinfo.html"})
 	http.Handle("/buckets", &templateHandler{filename: "templates/buckets.html"})
+	http.Handle("/health", &templateHandler{filename: "templates/health.html"})
 	http.HandleFunc("/score/json", handleScore)
 	http.HandleFunc("/api/response_stats", handleSche)
 	http.HandleFunc("/api/partition", handlePartition)
 	http.HandleFunc("/api/bucket/", handleBucket)
+	http.HandleFunc("/api/health", handleHealth)
+	http.HandleFunc("/api/hints", handleHints)
+	http.HandleFunc("/api/antientropy/", handleAntiEntropy)
+	http.HandleFunc("/api/dualwrite/retry", handleDualWRetry)
+	http.HandleFunc("/api/verify", handleVerify)
+	http.HandleFunc("/api/explain", handleExplain)
 
 	// same as gobeansdb
 	http.HandleFunc("/config/", handleConfig)
@@ -131,6 +145,10 @@ func startWeb() {
 			promhttp.HandlerOpts{Registry: dstore.BdbProxyPromRegistry}),
 	)
 	http.HandleFunc("/cstar-cfg", handleCstarCfgReload)
+	http.HandleFunc("/cstar-cfg/history", handleCstarCfgHistory)
+	http.HandleFunc("/cstar-cfg/rollback", handleCstarCfgRollback)
+	http.HandleFunc("/cstar-cfg/export", handleCstarCfgExport)
+	http.HandleFunc("/cstar-cfg/import", handleCstarCfgImport)
 
 	webaddr := fmt.Sprintf("%s:%d", proxyConf.Listen, proxyConf.WebPort)
 	go func() {
@@ -186,10 +204,21 @@ func handleSche(w http.ResponseWriter, r *http.Request) {
 	handleJson(w, responseStats)
 }
 
+// partition is the arcs of hosts in each bucket, used by the arc strategy
 func handlePartition(w http.ResponseWriter, r *http.Request) {
 	defer handleWebPanic(w)
-	partition := dstore.GetScheduler().Partition()
-	handleJson(w, partition)
+	sch := dstore.GetScheduler()
+	strategy, hosts := sch.BalanceStats()
+	handleJson(w, map[string]interface{}{
+		"strategy":  strategy,
+		"partition": sch.Partition(),
+		"hosts":     hosts,
+	})
+}
+
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+	handleJson(w, dstore.GetScheduler().HealthStats())
 }
 
 func handleBucket(w http.ResponseWriter, r *http.Request) {
@@ -201,6 +230,179 @@ func handleBucket(w http.ResponseWriter, r *http.Request) {
 	handleJson(w, bktInfo)
 }
 
+// GET list hints, DELETE purge hints, both can be filtered by ?host=addr
+func handleHints(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := make(map[string]interface{})
+	hints := dstore.GetHintStore()
+	if hints == nil {
+		resp["error"] = "hinted handoff is disabled"
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+
+	host := r.URL.Query().Get("host")
+	switch r.Method {
+	case "GET":
+		resp["hints"] = hints.List(host)
+	case "DELETE":
+		n, err := hints.Purge(host)
+		if err != nil {
+			resp["error"] = fmt.Sprintf("purge hints err: %s", err)
+			w.WriteHeader(http.StatusInternalServerError)
+			handleJson(w, resp)
+			return
+		}
+		resp["purged"] = n
+	default:
+		resp["error"] = "unsupported method"
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	resp["message"] = "success"
+	handleJson(w, resp)
+}
+
+// GET show where ?key= lives, with its metadata on each backend if ?live=1
+func handleExplain(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	key := r.URL.Query().Get("key")
+	if key == "" {
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, map[string]string{"error": "key is required"})
+		return
+	}
+	live, _ := strconv.ParseBool(r.URL.Query().Get("live"))
+	handleJson(w, dstore.ExplainKey(key, live))
+}
+
+// GET show stats and the first ?limit=n pending entries,
+// POST ?action=pause|resume|drain control the retry worker
+func handleDualWRetry(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := make(map[string]interface{})
+	q := dstore.GetDualWRetryQueue()
+	if q == nil {
+		resp["error"] = "dual write retry is disabled"
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		limit, err := getFormValueInt(r, "limit", 100)
+		if err != nil {
+			resp["error"] = fmt.Sprintf("bad limit: %s", err)
+			w.WriteHeader(http.StatusBadRequest)
+			handleJson(w, resp)
+			return
+		}
+		resp["stats"] = q.Stats()
+		resp["entries"] = q.List(limit)
+	case "POST":
+		switch action := r.URL.Query().Get("action"); action {
+		case "pause":
+			q.Pause()
+		case "resume":
+			q.Resume()
+		case "drain":
+			n, err := q.Drain()
+			resp["drained"] = n
+			if err != nil {
+				resp["error"] = fmt.Sprintf("drain stopped: %s", err)
+				w.WriteHeader(http.StatusInternalServerError)
+				handleJson(w, resp)
+				return
+			}
+		default:
+			resp["error"] = fmt.Sprintf("unsupported action: %s", action)
+			w.WriteHeader(http.StatusBadRequest)
+			handleJson(w, resp)
+			return
+		}
+		resp["stats"] = q.Stats()
+	default:
+		resp["error"] = "unsupported method"
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	resp["message"] = "success"
+	handleJson(w, resp)
+}
+
+// GET show shadow read stats and mismatches, filtered by ?prefix=,
+// DELETE reset them
+func handleVerify(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := make(map[string]interface{})
+	v := dstore.GetShadowVerifier()
+	if v == nil {
+		resp["error"] = "shadow read verify is disabled"
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		prefix := r.URL.Query().Get("prefix")
+		stats := v.Stats()
+		if prefix != "" {
+			resp["stats"] = map[string]dstore.VerifyPrefixStats{prefix: stats[prefix]}
+		} else {
+			resp["stats"] = stats
+		}
+		resp["mismatches"] = v.Mismatches(prefix)
+	case "DELETE":
+		v.Reset()
+	default:
+		resp["error"] = "unsupported method"
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	resp["message"] = "success"
+	handleJson(w, resp)
+}
+
+// compare replicas of bucket, repair by copying the newest version if ?repair=1
+func handleAntiEntropy(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := make(map[string]interface{})
+	bucketID, err := getBucket(r)
+	if err != nil {
+		resp["error"] = fmt.Sprintf("bad bucket: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	repair := r.URL.Query().Get("repair") == "1"
+	report, err := dstore.CheckBucket(int(bucketID), repair)
+	if err != nil {
+		resp["error"] = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	resp["report"] = report
+	resp["message"] = "success"
+	handleJson(w, resp)
+}
+
 func handleRouteVersion(w http.ResponseWriter, r *http.Request) {
 	defer handleWebPanic(w)
 	if len(proxyConf.ZKServers) == 0 {
@@ -236,7 +438,7 @@ func handleRouteReload(w http.ResponseWriter, r *http.Request) {
 	defer func() {
 		dbcfg.AllowReload = true
 		if err != nil {
-			logger.Errorf("handleRoute err", err.Error())
+			logger.Errorf("handleRoute err: %s", err.Error())
 			w.Write([]byte(fmt.Sprintf(err.Error())))
 			return
 		}
@@ -296,47 +498,96 @@ func handleRouteReload(w http.ResponseWriter, r *http.Request) {
 
 type ReloadableCfg struct {
 	Cfg map[string]string `json:"cfg"`
+	Transitions map[string]*cassandra.PrefixTransition `json:"transitions,omitempty"`
+	Version uint32 `json:"version"`
+	LoadedAt time.Time `json:"loaded_at"`
+	Reload *dstore.CfgReloadStatus `json:"reload,omitempty"`
+	Coordinated *cassandra.CoordinatedSwitchStatus `json:"coordinated,omitempty"`
 	Message string        `json:"message"`
 	Error string          `json:"error"`
 }
 
-func handleCstarCfgReload(w http.ResponseWriter, r *http.Request) {
-	defer handleWebPanic(w)
-
-	w.Header().Set("Content-Type", "application/json")
-	resp := make(map[string]string)
-	cfgName := r.URL.Query().Get("config")
-	var dispatcher cassandra.PrefixDisPatcher
+// getSwitchOperator get who switches prefixes from header X-Operator or
+// ?operator=, and skip the transition check if ?force=1
+func getSwitchOperator(r *http.Request) cassandra.SwitchOperator {
+	who := r.Header.Get("X-Operator")
+	if who == "" {
+		who = r.URL.Query().Get("operator")
+	}
+	if who == "" {
+		who = r.RemoteAddr
+	}
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	return cassandra.SwitchOperator{Who: who, Force: force, Client: r.RemoteAddr}
+}
 
+func getCfgDispatcher(cfgName string) (cassandra.PrefixDisPatcher, error) {
 	switch cfgName {
-	case "tablefinder":
+	case dstore.CFG_TABLEFINDER:
 		if dstore.PrefixTableFinder == nil {
-			resp["error"] = "cassandra is disabled"
-			w.WriteHeader(http.StatusBadRequest)
-			handleJson(w, resp)
-			return
+			return nil, fmt.Errorf("cassandra is disabled")
 		}
-		dispatcher = dstore.PrefixTableFinder
-	case "rwswitcher":
+		return dstore.PrefixTableFinder, nil
+	case dstore.CFG_RWSWITCHER:
 		if dstore.PrefixStorageSwitcher == nil {
-			resp["error"] = "cassandra is disabled"
-			w.WriteHeader(http.StatusBadRequest)
-			handleJson(w, resp)
-			return
+			return nil, fmt.Errorf("cassandra is disabled")
 		}
-		dispatcher = dstore.PrefixStorageSwitcher
-	default:
-		resp["error"] = "unsupported config query arg, must be: tablefinder/rwswitcher"
+		return dstore.PrefixStorageSwitcher, nil
+	}
+	return nil, fmt.Errorf("unsupported config query arg, must be: tablefinder/rwswitcher")
+}
+
+// errNotStaged is returned for changes of rwswitcher which can not be staged
+// while coordinated switch is enabled, as changing the cfg table directly
+// switches proxies at different times
+var errNotStaged = errors.New(
+	"coordinated switch is enabled, switch prefixes of rwswitcher by PUT /cstar-cfg only")
+
+// coordinated return true if changes of cfg cfgName must be staged by the coordinator
+func coordinated(cfgName string) bool {
+	return cfgName == dstore.CFG_RWSWITCHER && dstore.PrefixSwitchCoordinator != nil
+}
+
+func handleCstarCfgReload(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := make(map[string]string)
+	cfgName := r.URL.Query().Get("config")
+	dispatcher, err := getCfgDispatcher(cfgName)
+	if err != nil {
+		resp["error"] = err.Error()
 		w.WriteHeader(http.StatusBadRequest)
 		handleJson(w, resp)
 		return
 	}
 
+	// bad gateway by default since most errors are from c*
+	code := http.StatusBadGateway
+	var illegalTransition *cassandra.IllegalTransitionError
+
 	switch r.Method {
 	case "GET":
 		response := ReloadableCfg{
 			Cfg: dispatcher.GetCurrentMap(),
 		}
+		if switcher, ok := dispatcher.(*cassandra.PrefixSwitcher); ok {
+			transitions, err := switcher.GetTransitions(&config.Proxy.CassandraStoreCfg, dstore.CqlStore)
+			if err != nil {
+				resp["error"] = err.Error()
+				break
+			}
+			response.Transitions = transitions
+		}
+		if v, ok := dispatcher.(interface{ CfgVersion() (uint32, time.Time) }); ok {
+			response.Version, response.LoadedAt = v.CfgVersion()
+		}
+		if reloader := dstore.GetCfgReloader(cfgName); reloader != nil {
+			response.Reload = reloader.Status()
+		}
+		if coordinated(cfgName) {
+			response.Coordinated = dstore.PrefixSwitchCoordinator.Status()
+		}
 		response.Message = "success"
 		w.WriteHeader(http.StatusOK)
 		handleJson(w, response)
@@ -380,9 +631,25 @@ func handleCstarCfgReload(w http.ResponseWriter, r *http.Request) {
 			resp["error"] = fmt.Sprintf("parse req err: doesn't match {'prefix': {'<dispatch_to>': ['prefix1', 'prefix2']}}")
 			break
 		}
-		err = dispatcher.Upsert(staticCfg, pdata, dstore.CqlStore)
+		if coordinated(cfgName) {
+			// applied by all proxies after they acked it
+			staged, err := dstore.PrefixSwitchCoordinator.Stage(pdata, getSwitchOperator(r))
+			if err != nil {
+				resp["error"] = fmt.Sprintf("stage data %v err: %s", data, err)
+				if errors.As(err, &illegalTransition) {
+					code = http.StatusConflict
+				}
+				break
+			}
+			resp["staged"] = staged.ID
+			break
+		}
+		err = cassandra.UpsertCfg(dispatcher, staticCfg, pdata, dstore.CqlStore, getSwitchOperator(r))
 		if err != nil {
 			resp["error"] = fmt.Sprintf("upsert data %v err: %s", data, err)
+			if errors.As(err, &illegalTransition) {
+				code = http.StatusConflict
+			}
 			break
 		}
 
@@ -393,6 +660,23 @@ func handleCstarCfgReload(w http.ResponseWriter, r *http.Request) {
 			break
 		}
 	case "DELETE":
+		if staged, _ := strconv.ParseBool(r.URL.Query().Get("staged")); staged {
+			if !coordinated(cfgName) {
+				resp["error"] = "coordinated switch is disabled"
+				code = http.StatusBadRequest
+				break
+			}
+			if err := dstore.PrefixSwitchCoordinator.Abort(getSwitchOperator(r)); err != nil {
+				resp["error"] = err.Error()
+				code = http.StatusConflict
+			}
+			break
+		}
+		if coordinated(cfgName) {
+			resp["error"] = errNotStaged.Error()
+			code = http.StatusConflict
+			break
+		}
 		// load cfg static
 		staticCfg, err := dispatcher.LoadStaticCfg(config.Proxy.Confdir)
 		if err != nil {
@@ -419,9 +703,12 @@ func handleCstarCfgReload(w http.ResponseWriter, r *http.Request) {
 			resp["error"] = fmt.Sprintf("req data should like: {'prefix': <your data>}")
 			break
 		}
-		err = dispatcher.DeletePrefix(staticCfg, prefix, dstore.CqlStore)
+		err = cassandra.DeleteCfg(dispatcher, staticCfg, prefix, dstore.CqlStore, getSwitchOperator(r))
 		if err != nil {
 			resp["error"] = fmt.Sprintf("upsert data %v err: %s", data, err)
+			if errors.As(err, &illegalTransition) {
+				code = http.StatusConflict
+			}
 			break
 		}
 
@@ -438,10 +725,206 @@ func handleCstarCfgReload(w http.ResponseWriter, r *http.Request) {
 
 	
 	if _, ok := resp["error"]; ok {
-		w.WriteHeader(http.StatusBadGateway)
+		w.WriteHeader(code)
 	} else {
 		w.WriteHeader(http.StatusOK)
 		resp["message"] = "success"
 	}
 	handleJson(w, resp)
 }
+
+// GET ?config=tablefinder|rwswitcher&limit=n list changes of the c* cfg table, newest first
+func handleCstarCfgHistory(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := make(map[string]interface{})
+	dispatcher, err := getCfgDispatcher(r.URL.Query().Get("config"))
+	if err != nil {
+		resp["error"] = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	if r.Method != "GET" {
+		resp["error"] = "unsupported method"
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	limit, err := getFormValueInt(r, "limit", 100)
+	if err != nil {
+		resp["error"] = fmt.Sprintf("bad limit: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	history, err := cassandra.ListCfgHistory(dispatcher, &config.Proxy.CassandraStoreCfg, limit, dstore.CqlStore)
+	if err != nil {
+		resp["error"] = err.Error()
+		w.WriteHeader(http.StatusBadGateway)
+		handleJson(w, resp)
+		return
+	}
+	resp["history"] = history
+	resp["message"] = "success"
+	handleJson(w, resp)
+}
+
+// POST ?config=tablefinder|rwswitcher&id=<history id> restore the c* cfg table
+// as it was right after the change id, and reload the cfg
+func handleCstarCfgRollback(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := make(map[string]interface{})
+	cfgName := r.URL.Query().Get("config")
+	dispatcher, err := getCfgDispatcher(cfgName)
+	if err != nil {
+		resp["error"] = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	id := r.URL.Query().Get("id")
+	if r.Method != "POST" || id == "" {
+		resp["error"] = "POST with ?id=<history id> required"
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	if coordinated(cfgName) {
+		resp["error"] = errNotStaged.Error()
+		w.WriteHeader(http.StatusConflict)
+		handleJson(w, resp)
+		return
+	}
+
+	code := http.StatusBadGateway
+	var illegalTransition *cassandra.IllegalTransitionError
+	staticCfg, err := dispatcher.LoadStaticCfg(config.Proxy.Confdir)
+	if err == nil {
+		var changes []*cassandra.CfgChange
+		changes, err = cassandra.RollbackCfg(dispatcher, staticCfg, id, dstore.CqlStore, getSwitchOperator(r))
+		resp["changes"] = changes
+		if errors.As(err, &illegalTransition) {
+			code = http.StatusConflict
+		}
+	}
+	if err == nil {
+		err = dispatcher.LoadCfg(staticCfg, dstore.CqlStore)
+	}
+	if err != nil {
+		resp["error"] = fmt.Sprintf("rollback to %s err: %s", id, err)
+		w.WriteHeader(code)
+		handleJson(w, resp)
+		return
+	}
+	resp["message"] = "success"
+	handleJson(w, resp)
+}
+
+// GET ?format=yaml|json export the merged static and c* cfg of both dispatchers
+func handleCstarCfgExport(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+
+	if dstore.PrefixStorageSwitcher == nil {
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, map[string]string{"error": "cassandra is disabled"})
+		return
+	}
+	format := r.URL.Query().Get("format")
+	cfgs := cassandra.ExportCfg(
+		&config.Proxy.CassandraStoreCfg, dstore.PrefixStorageSwitcher, dstore.PrefixTableFinder)
+	b, err := cfgs.Marshal(format)
+	if err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, map[string]string{"error": err.Error()})
+		return
+	}
+	if format == "json" {
+		w.Header().Set("Content-Type", "application/json")
+	} else {
+		w.Header().Set("Content-Type", "application/x-yaml")
+	}
+	w.Write(b)
+}
+
+// POST a file exported by /cstar-cfg/export in yaml or json, to make the c* cfg
+// tables the same as it, ?dry_run=1 only shows the changes, ?force=1 skips the
+// transition check of rwswitcher
+func handleCstarCfgImport(w http.ResponseWriter, r *http.Request) {
+	defer handleWebPanic(w)
+
+	w.Header().Set("Content-Type", "application/json")
+	resp := make(map[string]interface{})
+	if dstore.PrefixStorageSwitcher == nil || r.Method != "POST" {
+		resp["error"] = "POST with cassandra enabled required"
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	b, err := ioutil.ReadAll(r.Body)
+	defer r.Body.Close()
+	if err != nil {
+		resp["error"] = fmt.Sprintf("get body from req err: %s", err)
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	data, err := cassandra.ParseDispatcherCfgs(b)
+	if err != nil {
+		resp["error"] = err.Error()
+		w.WriteHeader(http.StatusBadRequest)
+		handleJson(w, resp)
+		return
+	}
+	staticCfg, err := dstore.PrefixStorageSwitcher.LoadStaticCfg(config.Proxy.Confdir)
+	if err != nil {
+		resp["error"] = fmt.Sprintf("load static cfg err: %s", err)
+		w.WriteHeader(http.StatusBadGateway)
+		handleJson(w, resp)
+		return
+	}
+
+	var finder *cassandra.KeyTableFinder
+	if staticCfg.PrefixTableDispatcherCfg.Enable {
+		finder = dstore.PrefixTableFinder
+	}
+	plan, err := cassandra.PlanImport(
+		staticCfg, dstore.PrefixStorageSwitcher, finder, data, getSwitchOperator(r))
+	if err != nil {
+		resp["error"] = err.Error()
+		w.WriteHeader(http.StatusConflict)
+		handleJson(w, resp)
+		return
+	}
+	resp["changes"] = plan
+	if dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run")); dryRun || plan.Empty() {
+		resp["message"] = "success"
+		handleJson(w, resp)
+		return
+	}
+	if len(plan.RWSwitcher) > 0 && coordinated(dstore.CFG_RWSWITCHER) {
+		resp["error"] = errNotStaged.Error()
+		w.WriteHeader(http.StatusConflict)
+		handleJson(w, resp)
+		return
+	}
+
+	err = cassandra.ApplyImport(plan, dstore.CqlStore)
+	if err == nil && len(plan.RWSwitcher) > 0 {
+		err = dstore.PrefixStorageSwitcher.LoadCfg(staticCfg, dstore.CqlStore)
+	}
+	if err == nil && len(plan.TableFinder) > 0 {
+		err = finder.LoadCfg(staticCfg, dstore.CqlStore)
+	}
+	if err != nil {
+		resp["error"] = err.Error()
+		w.WriteHeader(http.StatusBadGateway)
+		handleJson(w, resp)
+		return
+	}
+	resp["message"] = "success"
+	handleJson(w, resp)
+}
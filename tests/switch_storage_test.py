@@ -101,24 +101,40 @@ class TestSwitchStorage:
             assert r[k] == v
             assert self.client.delete(k)
 
+    @pytest.mark.parametrize("status", [
+        p_status_brw, p_status_brw_cw, p_status_bw_crw, p_status_crw,
+    ])
+    def test_incr(self, status):
+        self.switch_store(status)
+        key = self.format_key(f'incr_{status}')
+        self.client.delete(key)
+        assert self.client.incr(key, 3) == 3
+        assert self.client.incr(key, 2) == 5
+        assert self.client.incr(key, -5) == 0
+        assert self.client.incr(key, 0) == 0
+        assert self.client.delete(key)
+
     def trigger_reload(self):
         resp = self.web_req.post(self.web_addr)
         assert resp.json().get('message') == "success", 'failed, resp: {}'.format(resp.json())
 
-    def update_rw_dispatch_cfg(self, switch_to, prefixes):
+    def update_rw_dispatch_cfg(self, switch_to, prefixes, force=False):
         data = {
             "prefix": {
                 switch_to: prefixes
             }
         }
-        resp = self.web_req.put(self.web_addr, json=data)
+        resp = self.web_req.put(self.web_addr, json=data,
+                                params={'force': int(force), 'operator': 'pytest'})
         assert 'error' not in resp.json()
 
     def clean_rw_dispatch_cfg(self, prefix):
         data = {
             "prefix": prefix
         }
-        resp = self.web_req.delete(self.web_addr, json=data)
+        # static cfg is rewritten after clean, so skip the transition check
+        resp = self.web_req.delete(self.web_addr, json=data,
+                                   params={'force': 1, 'operator': 'pytest'})
         assert 'error' not in resp.json()
         
     def switch_store(self, switch_to, use_static_cfg=True):
@@ -127,7 +143,10 @@ class TestSwitchStorage:
         if self.status == switch_to:
             return
 
-        self.clean_rw_dispatch_cfg(self.prefix)
+        # skipping stages must be forced
+        force = abs(order_of_status[switch_to] - order_of_status[self.status]) > 1
+        if use_static_cfg:
+            self.clean_rw_dispatch_cfg(self.prefix)
         with open(store_proxy_cfg, 'r+') as f:
             data = load(f, Loader=Loader)
             if use_static_cfg:
@@ -147,9 +166,19 @@ class TestSwitchStorage:
             self.trigger_reload()
         else:
             # using put api for cfg update
-            self.update_rw_dispatch_cfg(switch_to, [self.prefix])
+            self.update_rw_dispatch_cfg(switch_to, [self.prefix], force)
         self.status = switch_to
 
+    def test_illegal_switch(self):
+        # beansdb only -> cassandra only loses data
+        data = {"prefix": {p_status_crw: [self.prefix]}}
+        resp = self.web_req.put(self.web_addr, json=data)
+        assert resp.status_code == 409
+        assert 'illegal switch' in resp.json()['error']
+
+        resp = self.web_req.get(self.web_addr)
+        assert resp.json()['cfg'].get(self.prefix) != p_status_crw
+
     def test_switch_store(self):
 
         switch_to = [
@@ -213,3 +242,27 @@ class TestSwitchStorage:
         self.switch_store(p_status_brw)
         assert self.client.delete(key), f'stages: {stages} -> stage: {stage} error'
         assert self.client.delete(no_switch_key), f'stages: {stages} -> stage: {stage} error'
+
+    def test_history_rollback(self):
+        history_addr = self.web_addr.replace('/cstar-cfg?', '/cstar-cfg/history?')
+        rollback_addr = self.web_addr.replace('/cstar-cfg?', '/cstar-cfg/rollback?')
+
+        self.switch_store(p_status_brw_cw, use_static_cfg=False)
+        resp = self.web_req.get(history_addr, params={'limit': 1})
+        last = resp.json()['history'][0]
+        assert last['prefix'] == self.prefix
+        assert last['new'] == p_status_brw_cw
+        assert last['who'] == 'pytest'
+
+        self.switch_store(p_status_bw_crw, use_static_cfg=False)
+        resp = self.web_req.post(rollback_addr, params={'id': last['id'], 'operator': 'pytest'})
+        assert resp.json().get('message') == 'success', resp.json()
+        resp = self.web_req.get(self.web_addr)
+        assert resp.json()['cfg'][self.prefix] == p_status_brw_cw
+        self.status = p_status_brw_cw
+
+        resp = self.web_req.get(history_addr, params={'limit': 1})
+        last = resp.json()['history'][0]
+        assert last['op'] == 'rollback'
+        assert last['old'] == p_status_bw_crw
+        self.switch_store(p_status_brw)